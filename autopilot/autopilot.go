@@ -0,0 +1,375 @@
+package autopilot
+
+import (
+	"dpasswd/fsm"
+	"dpasswd/transport"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// Config tunes when servers count as healthy and what the autopilot does
+// about unhealthy and new servers.
+type Config struct {
+	// CleanupDeadServers removes servers that were unhealthy for longer than
+	// DeadServerTimeout
+	CleanupDeadServers bool
+	DeadServerTimeout  time.Duration
+	// LastContactThreshold is how long a server may not answer the leader
+	// and MaxTrailingLogs how far it may lag behind before it is unhealthy
+	LastContactThreshold time.Duration
+	MaxTrailingLogs      uint64
+	// ServerStabilizationTime is how long a new server has to be healthy
+	// before it is promoted to voter
+	ServerStabilizationTime time.Duration
+	// MinQuorum is the number of voters dead servers are never removed
+	// below. With 0 a dead voter is removed whenever the healthy voters have
+	// a quorum, so a cluster of three shrinks to two.
+	MinQuorum int
+	Interval  time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		CleanupDeadServers:      true,
+		DeadServerTimeout:       5 * time.Minute,
+		LastContactThreshold:    2 * time.Second,
+		MaxTrailingLogs:         250,
+		ServerStabilizationTime: 10 * time.Second,
+		MinQuorum:               0,
+		Interval:                time.Second,
+	}
+}
+
+// ServerHealth is the health of a server as seen by the leader.
+type ServerHealth struct {
+	ID           string     `json:"id"`
+	Address      string     `json:"address"`
+	Suffrage     string     `json:"suffrage"`
+	Leader       bool       `json:"leader"`
+	PendingVoter bool       `json:"pending_voter"`
+	Healthy      bool       `json:"healthy"`
+	StableSince  time.Time  `json:"stable_since"`
+	LastContact  *time.Time `json:"last_contact,omitempty"`
+	MatchIndex   uint64     `json:"match_index"`
+	Lag          uint64     `json:"replication_lag"`
+}
+
+// State is the health of the cluster as seen by the leader. FailureTolerance
+// is how many more voters may fail before the cluster loses its quorum.
+type State struct {
+	Healthy          bool           `json:"healthy"`
+	FailureTolerance int            `json:"failure_tolerance"`
+	Voters           int            `json:"voters"`
+	Servers          []ServerHealth `json:"servers"`
+}
+
+var ErrNotLeader = errors.New("not the leader")
+
+// Autopilot watches the servers of a raft group while the local node is its
+// leader. It removes servers that stay unhealthy, as long as the remaining
+// voters keep a quorum, and promotes servers that joined as pending voters
+// once they were healthy for the stabilization time.
+type Autopilot struct {
+	raft    *raft.Raft
+	db      *badger.DB
+	tracker *transport.Tracker
+	config  Config
+	logger  hclog.Logger
+
+	mu          sync.RWMutex
+	leaderSince time.Time
+	servers     map[raft.ServerID]*ServerHealth
+	state       *State
+	// kept lists the dead servers already reported as kept for the quorum
+	kept map[raft.ServerID]bool
+
+	shutdownCh   chan struct{}
+	shutdownDone chan struct{}
+}
+
+func New(r *raft.Raft, db *badger.DB, tracker *transport.Tracker, config Config, logger hclog.Logger) *Autopilot {
+	return &Autopilot{
+		raft:         r,
+		db:           db,
+		tracker:      tracker,
+		config:       config,
+		logger:       logger,
+		servers:      make(map[raft.ServerID]*ServerHealth),
+		kept:         make(map[raft.ServerID]bool),
+		shutdownCh:   make(chan struct{}),
+		shutdownDone: make(chan struct{}),
+	}
+}
+
+func (a *Autopilot) Start() {
+	go a.run()
+}
+
+func (a *Autopilot) Stop() {
+	close(a.shutdownCh)
+	<-a.shutdownDone
+}
+
+// State returns the health of the cluster from the last check.
+func (a *Autopilot) State() (State, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.state == nil {
+		return State{}, ErrNotLeader
+	}
+	return *a.state, nil
+}
+
+func (a *Autopilot) run() {
+	defer close(a.shutdownDone)
+	ticker := time.NewTicker(a.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.shutdownCh:
+			return
+		}
+
+		if a.raft.State() != raft.Leader {
+			a.reset()
+			continue
+		}
+		if err := a.check(); err != nil {
+			a.logger.Error("error checking server health", "error", err)
+		}
+	}
+}
+
+// reset forgets what was learned while being the leader, the next leader
+// term starts over with every server given the full grace period.
+func (a *Autopilot) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.leaderSince = time.Time{}
+	a.servers = make(map[raft.ServerID]*ServerHealth)
+	a.kept = make(map[raft.ServerID]bool)
+	a.state = nil
+}
+
+func (a *Autopilot) check() error {
+	configFuture := a.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	state := a.update(configFuture.Configuration())
+
+	if a.config.CleanupDeadServers {
+		a.removeDeadServers(state)
+	}
+	a.promoteStableServers(state)
+	return nil
+}
+
+// update refreshes the health of every server in the configuration.
+func (a *Autopilot) update(cfg raft.Configuration) State {
+	now := time.Now()
+	_, leaderID := a.raft.LeaderWithID()
+	lastIndex := a.raft.LastIndex()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.leaderSince.IsZero() {
+		a.leaderSince = now
+	}
+
+	state := State{Healthy: true}
+	healthyVoters := 0
+	seen := make(map[raft.ServerID]bool, len(cfg.Servers))
+	for _, srv := range cfg.Servers {
+		seen[srv.ID] = true
+		health := ServerHealth{
+			ID:           string(srv.ID),
+			Address:      string(srv.Address),
+			Suffrage:     srv.Suffrage.String(),
+			Leader:       srv.ID == leaderID,
+			PendingVoter: a.pendingVoter(srv.ID),
+		}
+
+		if health.Leader {
+			health.Healthy = true
+			health.MatchIndex = lastIndex
+		} else {
+			// Progress tracked during an earlier leader term is outdated,
+			// a server only counts as silent from the start of this term
+			lastContact := a.leaderSince
+			if p, ok := a.tracker.Progress(srv.ID); ok {
+				health.MatchIndex = p.MatchIndex
+				if p.LastContact.After(lastContact) {
+					lastContact = p.LastContact
+				}
+				contact := p.LastContact
+				health.LastContact = &contact
+			}
+			if lastIndex > health.MatchIndex {
+				health.Lag = lastIndex - health.MatchIndex
+			}
+			health.Healthy = now.Sub(lastContact) <= a.config.LastContactThreshold && health.Lag <= a.config.MaxTrailingLogs
+		}
+
+		prev, ok := a.servers[srv.ID]
+		switch {
+		case !ok:
+			health.StableSince = now
+		case prev.Healthy != health.Healthy:
+			health.StableSince = now
+			if health.Healthy {
+				a.logger.Info("server is healthy again", "node", srv.ID)
+			} else {
+				a.logger.Warn("server is unhealthy", "node", srv.ID, "match_index", health.MatchIndex, "lag", health.Lag)
+			}
+		default:
+			health.StableSince = prev.StableSince
+		}
+		a.servers[srv.ID] = &health
+
+		if srv.Suffrage == raft.Voter {
+			state.Voters++
+			if health.Healthy {
+				healthyVoters++
+			}
+		}
+		if !health.Healthy {
+			state.Healthy = false
+		}
+		state.Servers = append(state.Servers, health)
+	}
+	for id := range a.servers {
+		if !seen[id] {
+			delete(a.servers, id)
+		}
+	}
+	for id := range a.kept {
+		if h, ok := a.servers[id]; !ok || h.Healthy {
+			delete(a.kept, id)
+		}
+	}
+
+	state.FailureTolerance = healthyVoters - (state.Voters/2 + 1)
+	if state.FailureTolerance < 0 {
+		state.FailureTolerance = 0
+	}
+	sort.Slice(state.Servers, func(i, j int) bool { return state.Servers[i].ID < state.Servers[j].ID })
+	a.state = &state
+	return state
+}
+
+// removeDeadServers removes the servers that were unhealthy for longer than
+// the dead server timeout. Nonvoters can always go, a voter only while the
+// healthy voters form a quorum that can commit the change and at least
+// MinQuorum voters are left. At most one voter is removed per check,
+// so the health of the rest is looked at again before the next one goes.
+func (a *Autopilot) removeDeadServers(state State) {
+	now := time.Now()
+	healthyVoters := 0
+	for _, srv := range state.Servers {
+		if srv.Suffrage == raft.Voter.String() && srv.Healthy {
+			healthyVoters++
+		}
+	}
+
+	voters := state.Voters
+	removedVoter := false
+	for _, srv := range state.Servers {
+		if srv.Healthy || srv.Leader || now.Sub(srv.StableSince) < a.config.DeadServerTimeout {
+			continue
+		}
+
+		if srv.Suffrage == raft.Voter.String() {
+			if removedVoter {
+				continue
+			}
+			if voters-1 < a.config.MinQuorum || healthyVoters < voters/2+1 {
+				if a.markKept(raft.ServerID(srv.ID)) {
+					continue
+				}
+				a.logger.Warn("not removing dead server, the cluster would lose its quorum", "node", srv.ID, "voters", voters, "healthy_voters", healthyVoters, "min_quorum", a.config.MinQuorum)
+				continue
+			}
+		}
+
+		a.logger.Warn("removing dead server", "node", srv.ID, "unhealthy_since", srv.StableSince.Format(time.RFC3339))
+		if err := a.removeServer(raft.ServerID(srv.ID)); err != nil {
+			a.logger.Error("error removing dead server", "node", srv.ID, "error", err)
+			continue
+		}
+		if srv.Suffrage == raft.Voter.String() {
+			voters--
+			removedVoter = true
+		}
+	}
+}
+
+// markKept records that a dead server is kept for the quorum and reports
+// whether that was already known.
+func (a *Autopilot) markKept(id raft.ServerID) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	known := a.kept[id]
+	a.kept[id] = true
+	return known
+}
+
+func (a *Autopilot) removeServer(id raft.ServerID) error {
+	if err := a.raft.RemoveServer(id, 0, 0).Error(); err != nil {
+		return err
+	}
+	a.tracker.Forget(id)
+
+	for _, key := range []string{fsm.NodeHTTPAddressKey(string(id)), fsm.PendingVoterKey(string(id))} {
+		if err := fsm.ApplyCommand(a.raft, fsm.CommandPayload{Operation: "DELETE", Key: key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promoteStableServers turns pending voters into voters once they were
+// healthy for the stabilization time.
+func (a *Autopilot) promoteStableServers(state State) {
+	now := time.Now()
+	for _, srv := range state.Servers {
+		if !srv.PendingVoter {
+			continue
+		}
+		if srv.Suffrage == raft.Voter.String() {
+			// Promoted by hand or before a leader change
+			if err := fsm.ApplyCommand(a.raft, fsm.CommandPayload{Operation: "DELETE", Key: fsm.PendingVoterKey(srv.ID)}); err != nil {
+				a.logger.Error("error clearing pending voter", "node", srv.ID, "error", err)
+			}
+			continue
+		}
+		if !srv.Healthy || now.Sub(srv.StableSince) < a.config.ServerStabilizationTime {
+			continue
+		}
+
+		a.logger.Info("promoting stable server to voter", "node", srv.ID, "healthy_since", srv.StableSince.Format(time.RFC3339))
+		if err := a.raft.AddVoter(raft.ServerID(srv.ID), raft.ServerAddress(srv.Address), 0, 0).Error(); err != nil {
+			a.logger.Error("error promoting server", "node", srv.ID, "error", err)
+			continue
+		}
+		if err := fsm.ApplyCommand(a.raft, fsm.CommandPayload{Operation: "DELETE", Key: fsm.PendingVoterKey(srv.ID)}); err != nil {
+			a.logger.Error("error clearing pending voter", "node", srv.ID, "error", err)
+		}
+	}
+}
+
+func (a *Autopilot) pendingVoter(id raft.ServerID) bool {
+	var pending bool
+	if err := fsm.ReadMeta(a.db, fsm.PendingVoterKey(string(id)), &pending); err != nil {
+		a.logger.Error("error reading pending voter", "node", id, "error", err)
+	}
+	return pending
+}
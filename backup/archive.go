@@ -0,0 +1,363 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"dpasswd/events"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// maxSegmentEntries is the number of log entries after which a new segment
+// is started.
+const maxSegmentEntries = 10000
+
+// Segment is an archived part of the raft log, holding the entries First to
+// Last as gzipped JSON lines. The segments of a log are named
+// log-<first>-<last>.jsonl.gz with zero-padded indexes, so that they sort by
+// index.
+type Segment struct {
+	Name  string `json:"name"`
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+}
+
+// ArchiveGap is a part of the raft log missing from the archive, because it
+// was compacted before it was archived or a restored snapshot took up its
+// index without an entry. The archive continues after Backup, so a recovery
+// to a point after the gap starts from Backup or a later backup.
+type ArchiveGap struct {
+	From        uint64    `json:"from"`
+	To          uint64    `json:"to"`
+	Backup      string    `json:"backup"`
+	BackupIndex uint64    `json:"backup_index"`
+	DetectedAt  time.Time `json:"detected_at"`
+}
+
+// ErrStopReading is returned by the callback of ReadSegment to stop early.
+var ErrStopReading = errors.New("stop reading")
+
+// segmentEntry is a raft log entry as stored in a segment.
+type segmentEntry struct {
+	Index      uint64       `json:"index"`
+	Term       uint64       `json:"term"`
+	Type       raft.LogType `json:"type"`
+	AppendedAt time.Time    `json:"appended_at,omitempty"`
+	Data       []byte       `json:"data,omitempty"`
+}
+
+// ParseSegmentName returns the indexes of a segment written by a scheduler
+// with the given prefix.
+func ParseSegmentName(prefix, name string) (Segment, bool) {
+	rest := strings.TrimPrefix(name, prefix+"log-")
+	if rest == name {
+		return Segment{}, false
+	}
+	rest = strings.TrimSuffix(rest, ".enc")
+	if !strings.HasSuffix(rest, ".jsonl.gz") {
+		return Segment{}, false
+	}
+	parts := strings.Split(strings.TrimSuffix(rest, ".jsonl.gz"), "-")
+	if len(parts) != 2 {
+		return Segment{}, false
+	}
+	first, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return Segment{}, false
+	}
+	last, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil || last < first {
+		return Segment{}, false
+	}
+	return Segment{Name: name, First: first, Last: last}, true
+}
+
+// ListSegments returns the segments of the log archived with the given prefix
+// ordered by index.
+func ListSegments(target Target, prefix string) ([]Segment, error) {
+	objects, err := target.List(prefix + "log-")
+	if err != nil {
+		return nil, err
+	}
+	var segments []Segment
+	for _, o := range objects {
+		if segment, ok := ParseSegmentName(prefix, o.Name); ok {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].First < segments[j].First })
+	return segments, nil
+}
+
+// ArchiveLog stores the entries applied since the last archived segment in
+// new segments.
+func (s *Scheduler) ArchiveLog() {
+	start := time.Now()
+	archived, err := s.archiveLog()
+
+	s.mu.Lock()
+	s.status.ArchivedIndex = archived
+	if err != nil {
+		s.status.LastArchiveFailure = &start
+		s.status.LastArchiveError = err.Error()
+	} else {
+		s.status.LastArchive = &start
+		s.status.LastArchiveError = ""
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.logger.Error("error archiving raft log", "target", s.config.Target, "error", err)
+	}
+}
+
+// archiveLog returns the last index in the archive. Only applied entries are
+// archived, as they are committed and cannot change anymore.
+func (s *Scheduler) archiveLog() (uint64, error) {
+	segments, err := ListSegments(s.config.Target, s.config.Prefix)
+	if err != nil {
+		return 0, err
+	}
+	var archived uint64
+	if len(segments) > 0 {
+		archived = segments[len(segments)-1].Last
+	}
+
+	first, err := s.config.Log.FirstIndex()
+	if err != nil {
+		return archived, err
+	}
+	if first == 0 {
+		return archived, nil
+	}
+	next := archived + 1
+	if next < first {
+		if next, err = s.bridgeGap(archived, next, first-1); err != nil {
+			return archived, err
+		}
+	}
+
+	applied := s.raft.AppliedIndex()
+	for next <= applied {
+		last := next + maxSegmentEntries - 1
+		if last > applied {
+			last = applied
+		}
+		entries, err := s.readLog(next, last)
+		if err != nil {
+			return archived, err
+		}
+		if len(entries) == 0 {
+			// A restored snapshot takes up an index without an entry, the
+			// log before it cannot be replayed past it
+			if next, err = s.bridgeGap(archived, next, next); err != nil {
+				return archived, err
+			}
+			continue
+		}
+		last = next + uint64(len(entries)) - 1
+
+		name, size, _, err := s.store(fmt.Sprintf("%slog-%020d-%020d.jsonl.gz", s.config.Prefix, next, last), func(w io.Writer) error {
+			gz := gzip.NewWriter(w)
+			encoder := json.NewEncoder(gz)
+			for _, entry := range entries {
+				if err := encoder.Encode(entry); err != nil {
+					return err
+				}
+			}
+			return gz.Close()
+		})
+		if err != nil {
+			return archived, err
+		}
+		s.logger.Debug("raft log archived", "name", name, "first", next, "last", last, "bytes", size)
+		archived = last
+		next = last + 1
+	}
+	return archived, nil
+}
+
+// bridgeGap continues the archive after the entries from to to, which are
+// not in the log. The entries after them can only be replayed on top of a
+// backup at index to or later, so the archive restarts after the oldest such
+// backup, which is taken now if there is none yet. It returns the next index
+// to archive. A gap in an existing archive is reported once.
+func (s *Scheduler) bridgeGap(archived, from, to uint64) (uint64, error) {
+	name, index, err := s.backupAfter(to)
+	if err != nil {
+		return 0, err
+	}
+	if name == "" {
+		s.RunOnce()
+		if name, index, err = s.backupAfter(to); err != nil {
+			return 0, err
+		}
+		if name == "" {
+			return 0, fmt.Errorf("the raft log misses the entries %d to %d and no backup after them could be written: %s", from, to, s.Status().LastError)
+		}
+	}
+
+	s.mu.Lock()
+	reported := archived == 0 || (s.status.LastArchiveGap != nil && s.status.LastArchiveGap.From == from)
+	if !reported {
+		s.status.LastArchiveGap = &ArchiveGap{From: from, To: to, Backup: name, BackupIndex: index, DetectedAt: time.Now()}
+	}
+	s.mu.Unlock()
+	if !reported {
+		s.logger.Error("raft log misses entries that were not archived, the archive continues after a backup", "from", from, "to", to, "backup", name, "backup_index", index)
+		if s.config.Bus != nil {
+			s.config.Bus.Publish(events.Event{
+				Type:   events.ArchiveGap,
+				Group:  s.config.Group,
+				Index:  from,
+				Backup: name,
+			})
+		}
+	}
+	return index + 1, nil
+}
+
+// backupAfter returns the name and index of the oldest backup at index or
+// later, the name is empty if there is none.
+func (s *Scheduler) backupAfter(index uint64) (string, uint64, error) {
+	objects, err := s.config.Target.List(s.config.Prefix + "backup-")
+	if err != nil {
+		return "", 0, err
+	}
+	var name string
+	var nameIndex uint64
+	for _, o := range objects {
+		if _, i, ok := ParseName(s.config.Prefix, o.Name); ok && i >= index && (name == "" || i < nameIndex) {
+			name, nameIndex = o.Name, i
+		}
+	}
+	return name, nameIndex, nil
+}
+
+// readLog reads the entries first to last, up to the first one missing.
+func (s *Scheduler) readLog(first, last uint64) ([]segmentEntry, error) {
+	var entries []segmentEntry
+	for index := first; index <= last; index++ {
+		var l raft.Log
+		err := s.config.Log.GetLog(index, &l)
+		if errors.Is(err, raft.ErrLogNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading log index %d: %w", index, err)
+		}
+		entries = append(entries, segmentEntry{
+			Index:      l.Index,
+			Term:       l.Term,
+			Type:       l.Type,
+			AppendedAt: l.AppendedAt,
+			Data:       l.Data,
+		})
+	}
+	return entries, nil
+}
+
+// removeSegmentsBefore removes the segments holding only entries up to index.
+// The newest segment is kept, as the archiving continues after it.
+func (s *Scheduler) removeSegmentsBefore(index uint64) error {
+	segments, err := ListSegments(s.config.Target, s.config.Prefix)
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+	for _, segment := range segments[:len(segments)-1] {
+		if segment.Last > index {
+			break
+		}
+		if err := s.config.Target.Delete(segment.Name); err != nil {
+			return fmt.Errorf("error removing %s: %w", segment.Name, err)
+		}
+		if err := s.config.Target.Delete(segment.Name + ".sha256"); err != nil {
+			return fmt.Errorf("error removing %s.sha256: %w", segment.Name, err)
+		}
+		s.logger.Debug("expired log segment removed", "name", segment.Name)
+	}
+	return nil
+}
+
+// ReadSegment verifies a segment against its checksum file and calls fn with
+// its entries in order. Encrypted segments are decrypted with key. fn stops
+// the reading early by returning ErrStopReading.
+func ReadSegment(target Target, name string, key []byte, fn func(*raft.Log) error) error {
+	data, err := getVerified(target, name)
+	if err != nil {
+		return err
+	}
+	r, err := decrypted(bytes.NewReader(data), key)
+	if err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%s is not a log segment: %w", name, err)
+	}
+	decoder := json.NewDecoder(gz)
+	for {
+		var entry segmentEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading %s: %w", name, err)
+		}
+		err := fn(&raft.Log{
+			Index:      entry.Index,
+			Term:       entry.Term,
+			Type:       entry.Type,
+			AppendedAt: entry.AppendedAt,
+			Data:       entry.Data,
+		})
+		if errors.Is(err, ErrStopReading) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// getVerified reads a file from the target and checks it against the
+// checksum in its NAME.sha256 file.
+func getVerified(target Target, name string) ([]byte, error) {
+	sumFile, err := readAll(target, name+".sha256")
+	if err != nil {
+		return nil, fmt.Errorf("error reading checksum of %s: %w", name, err)
+	}
+	fields := strings.Fields(string(sumFile))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%s.sha256 holds no checksum", name)
+	}
+	data, err := readAll(target, name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", name, err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != fields[0] {
+		return nil, fmt.Errorf("checksum of %s does not match %s.sha256", name, name)
+	}
+	return data, nil
+}
+
+func readAll(target Target, name string) ([]byte, error) {
+	rc, err := target.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rc.Close()
+	}()
+	return io.ReadAll(rc)
+}
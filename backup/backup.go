@@ -0,0 +1,289 @@
+// Package backup packs raft snapshots of the store into archives that can be
+// restored into a fresh cluster.
+//
+// A backup is a gzipped tar archive holding the snapshot data as
+// snapshot.json followed by manifest.json, which describes the snapshot and
+// carries its checksum. The manifest comes last so that the snapshot can be
+// streamed without buffering it.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// FormatVersion is the version of the archive layout
+	FormatVersion = 1
+
+	snapshotName = "snapshot.json"
+	manifestName = "manifest.json"
+)
+
+// Manifest describes the snapshot of a backup.
+type Manifest struct {
+	FormatVersion      int                  `json:"format_version"`
+	CreatedAt          time.Time            `json:"created_at"`
+	NodeID             string               `json:"node_id,omitempty"`
+	SnapshotID         string               `json:"snapshot_id"`
+	SnapshotVersion    raft.SnapshotVersion `json:"snapshot_version"`
+	Index              uint64               `json:"index"`
+	Term               uint64               `json:"term"`
+	Configuration      []Server             `json:"configuration"`
+	ConfigurationIndex uint64               `json:"configuration_index"`
+	Size               int64                `json:"size"`
+	// SHA256 is the hex encoded checksum of the snapshot data
+	SHA256 string `json:"sha256"`
+}
+
+// Server is a member of the configuration stored with the snapshot.
+type Server struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+}
+
+// Snapshot takes a snapshot of the FSM of r and opens it. When nothing was
+// applied since the last snapshot, the latest snapshot of store is opened
+// instead.
+func Snapshot(r *raft.Raft, store raft.SnapshotStore) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	future := r.Snapshot()
+	if err := future.Error(); err != nil {
+		if !errors.Is(err, raft.ErrNothingNewToSnapshot) || store == nil {
+			return nil, nil, err
+		}
+		snapshots, err := store.List()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(snapshots) == 0 {
+			return nil, nil, raft.ErrNothingNewToSnapshot
+		}
+		return store.Open(snapshots[0].ID)
+	}
+	return future.Open()
+}
+
+// Write streams the snapshot data read from snapshot to w as a backup and
+// returns its manifest.
+func Write(w io.Writer, nodeID string, meta *raft.SnapshotMeta, snapshot io.Reader) (Manifest, error) {
+	manifest := Manifest{
+		FormatVersion:      FormatVersion,
+		CreatedAt:          time.Now().UTC(),
+		NodeID:             nodeID,
+		SnapshotID:         meta.ID,
+		SnapshotVersion:    meta.Version,
+		Index:              meta.Index,
+		Term:               meta.Term,
+		Configuration:      make([]Server, 0, len(meta.Configuration.Servers)),
+		ConfigurationIndex: meta.ConfigurationIndex,
+		Size:               meta.Size,
+	}
+	for _, srv := range meta.Configuration.Servers {
+		manifest.Configuration = append(manifest.Configuration, Server{
+			ID:       string(srv.ID),
+			Address:  string(srv.Address),
+			Suffrage: srv.Suffrage.String(),
+		})
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    snapshotName,
+		Mode:    0600,
+		Size:    meta.Size,
+		ModTime: manifest.CreatedAt,
+	}); err != nil {
+		return manifest, err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, hash), snapshot)
+	if err != nil {
+		return manifest, err
+	}
+	if n != meta.Size {
+		return manifest, fmt.Errorf("snapshot has %d bytes instead of %d", n, meta.Size)
+	}
+	manifest.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: manifest.CreatedAt,
+	}); err != nil {
+		return manifest, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return manifest, err
+	}
+	if err := tw.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, gz.Close()
+}
+
+// Backup is a backup read back and verified. Its snapshot data is kept in a
+// temporary file until Close.
+type Backup struct {
+	Manifest Manifest
+	file     *os.File
+}
+
+// Read reads a backup from r, spooling its snapshot to a temporary file, and
+// verifies the size and checksum of the snapshot and that it holds a list of
+// entries the FSM can restore. Encrypted backups are decrypted with key.
+func Read(r io.Reader, key []byte) (*Backup, error) {
+	r, err := decrypted(r, key)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a backup: %w", err)
+	}
+	tr := tar.NewReader(gz)
+
+	f, err := os.CreateTemp("", "dpasswd-restore-*")
+	if err != nil {
+		return nil, err
+	}
+	b := &Backup{file: f}
+
+	var hash string
+	var size int64
+	var haveSnapshot, haveManifest bool
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = b.Close()
+			return nil, fmt.Errorf("error reading backup: %w", err)
+		}
+
+		switch hdr.Name {
+		case snapshotName:
+			h := sha256.New()
+			if size, err = io.Copy(io.MultiWriter(f, h), tr); err != nil {
+				_ = b.Close()
+				return nil, fmt.Errorf("error reading snapshot: %w", err)
+			}
+			hash = hex.EncodeToString(h.Sum(nil))
+			haveSnapshot = true
+		case manifestName:
+			if err := json.NewDecoder(tr).Decode(&b.Manifest); err != nil {
+				_ = b.Close()
+				return nil, fmt.Errorf("error reading manifest: %w", err)
+			}
+			haveManifest = true
+		}
+	}
+
+	switch {
+	case !haveSnapshot:
+		err = fmt.Errorf("backup has no %s", snapshotName)
+	case !haveManifest:
+		err = fmt.Errorf("backup has no %s", manifestName)
+	case b.Manifest.FormatVersion != FormatVersion:
+		err = fmt.Errorf("unsupported backup format version %d", b.Manifest.FormatVersion)
+	case size != b.Manifest.Size:
+		err = fmt.Errorf("snapshot has %d bytes, the manifest says %d", size, b.Manifest.Size)
+	case hash != b.Manifest.SHA256:
+		err = fmt.Errorf("snapshot checksum %s does not match %s of the manifest", hash, b.Manifest.SHA256)
+	}
+	if err == nil {
+		err = b.validate()
+	}
+	if err != nil {
+		_ = b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// validate checks that the snapshot decodes, as raft panics when the FSM
+// fails to restore it.
+func (b *Backup) validate() error {
+	data, err := b.Open()
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(data)
+	if tok, err := decoder.Token(); err != nil || tok != json.Delim('[') {
+		return fmt.Errorf("snapshot is not a list of entries")
+	}
+	for decoder.More() {
+		var entry struct {
+			Key string
+		}
+		if err := decoder.Decode(&entry); err != nil {
+			return fmt.Errorf("invalid snapshot entry: %w", err)
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+	return nil
+}
+
+// Meta returns the snapshot metadata to restore the snapshot with.
+func (b *Backup) Meta() *raft.SnapshotMeta {
+	var configuration raft.Configuration
+	for _, srv := range b.Manifest.Configuration {
+		suffrage := raft.Voter
+		switch srv.Suffrage {
+		case raft.Nonvoter.String():
+			suffrage = raft.Nonvoter
+		case raft.Staging.String():
+			suffrage = raft.Staging
+		}
+		configuration.Servers = append(configuration.Servers, raft.Server{
+			Suffrage: suffrage,
+			ID:       raft.ServerID(srv.ID),
+			Address:  raft.ServerAddress(srv.Address),
+		})
+	}
+	return &raft.SnapshotMeta{
+		Version:            b.Manifest.SnapshotVersion,
+		ID:                 b.Manifest.SnapshotID,
+		Index:              b.Manifest.Index,
+		Term:               b.Manifest.Term,
+		Configuration:      configuration,
+		ConfigurationIndex: b.Manifest.ConfigurationIndex,
+		Size:               b.Manifest.Size,
+	}
+}
+
+// Open returns the snapshot data from its start.
+func (b *Backup) Open() (io.Reader, error) {
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return b.file, nil
+}
+
+// Close removes the temporary file of the snapshot.
+func (b *Backup) Close() error {
+	err := b.file.Close()
+	if rmErr := os.Remove(b.file.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
@@ -0,0 +1,223 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Encrypted backups start with encryptedMagic and a random nonce prefix,
+// followed by chunks of at most chunkSize bytes sealed with AES-256-GCM. Each
+// chunk is preceded by its sealed length, whose top bit marks the last chunk,
+// so that a truncated backup fails to decrypt.
+const (
+	encryptedMagic = "DPBKENC1"
+	chunkSize      = 64 * 1024
+	lastChunk      = 1 << 31
+	noncePrefixLen = 8
+)
+
+var ErrEncrypted = errors.New("backup is encrypted and no key is configured")
+
+// KeySize is the size of the keys backups are encrypted with.
+const KeySize = 32
+
+// ParseKey accepts a key as 32 raw bytes, or hex or base64 encoded.
+func ParseKey(data []byte) ([]byte, error) {
+	if len(data) == KeySize {
+		return data, nil
+	}
+	s := string(bytes.TrimSpace(data))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("the key must be %d bytes, raw or hex or base64 encoded", KeySize)
+}
+
+// LoadKey reads a key with ParseKey from a file.
+func LoadKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(data)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+// NewEncryptWriter encrypts what is written to it into w. Close writes the
+// last chunk and must be called.
+func NewEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, noncePrefixLen)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, encryptedMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		free := chunkSize - len(e.buf)
+		if free == 0 {
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if free > len(p) {
+			free = len(p)
+		}
+		e.buf = append(e.buf, p[:free]...)
+		p = p[free:]
+		n += free
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	header := make([]byte, 4)
+	length := uint32(len(e.buf) + e.aead.Overhead())
+	if last {
+		length |= lastChunk
+	}
+	binary.BigEndian.PutUint32(header, length)
+	// The header is authenticated with the chunk, which keeps the last
+	// chunk marker from being cut off
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.counter), e.buf, header)
+	e.counter++
+	e.buf = e.buf[:0]
+	if _, err := e.w.Write(header); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, noncePrefixLen+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixLen:], counter)
+	return nonce
+}
+
+type decryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	done    bool
+}
+
+// NewDecryptReader decrypts a backup written through NewEncryptWriter.
+func NewDecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(encryptedMagic)+noncePrefixLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("error reading encryption header: %w", err)
+	}
+	if string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, errors.New("backup is not encrypted")
+	}
+	return &decryptReader{r: r, aead: aead, prefix: header[len(encryptedMagic):]}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		if err == io.EOF {
+			return errors.New("encrypted backup is truncated")
+		}
+		return err
+	}
+	length := binary.BigEndian.Uint32(header)
+	last := length&lastChunk != 0
+	length &^= lastChunk
+	if length > chunkSize+uint32(d.aead.Overhead()) {
+		return errors.New("invalid encrypted chunk")
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		return fmt.Errorf("encrypted backup is truncated: %w", err)
+	}
+	plain, err := d.aead.Open(sealed[:0], chunkNonce(d.prefix, d.counter), sealed, header)
+	if err != nil {
+		return errors.New("error decrypting backup, wrong key or corrupted data")
+	}
+	d.counter++
+	d.buf = plain
+	d.done = last
+	return nil
+}
+
+// decrypted returns r decrypted when it holds an encrypted backup, and r
+// unchanged otherwise.
+func decrypted(r io.Reader, key []byte) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(encryptedMagic))
+	if err != nil || string(magic) != encryptedMagic {
+		return br, nil
+	}
+	if key == nil {
+		return nil, ErrEncrypted
+	}
+	return NewDecryptReader(br, key)
+}
@@ -0,0 +1,102 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+)
+
+func encrypt(t *testing.T, key, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewEncryptWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(key, sealed []byte) ([]byte, error) {
+	r, err := NewDecryptReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty, shorter than a chunk, exactly one chunk and several chunks
+	for _, size := range []int{0, 100, chunkSize, 3*chunkSize + 17} {
+		plain := make([]byte, size)
+		if _, err := rand.Read(plain); err != nil {
+			t.Fatal(err)
+		}
+		got, err := decrypt(key, encrypt(t, key, plain))
+		if err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: decrypted data differs", size)
+		}
+	}
+}
+
+func TestDecryptFailures(t *testing.T) {
+	key := make([]byte, KeySize)
+	plain := bytes.Repeat([]byte("backup"), chunkSize)
+	sealed := encrypt(t, key, plain)
+
+	// Cut off after the header, inside a chunk and at a chunk boundary, where
+	// only the missing last chunk marker reveals the truncation
+	boundary := len(encryptedMagic) + noncePrefixLen + 4 + chunkSize + 16
+	for _, n := range []int{len(encryptedMagic) + noncePrefixLen, len(sealed) / 2, boundary} {
+		if _, err := decrypt(key, sealed[:n]); err == nil || !strings.Contains(err.Error(), "truncated") {
+			t.Errorf("expected a backup cut off after %d of %d bytes to be truncated, got %v", n, len(sealed), err)
+		}
+	}
+
+	otherKey := make([]byte, KeySize)
+	otherKey[0] = 1
+	if _, err := decrypt(otherKey, sealed); err == nil {
+		t.Error("expected decrypting with another key to fail")
+	}
+
+	corrupted := append([]byte(nil), sealed...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	if _, err := decrypt(key, corrupted); err == nil {
+		t.Error("expected decrypting corrupted data to fail")
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	raw := bytes.Repeat([]byte{0xab}, KeySize)
+	for _, data := range []string{
+		string(raw),
+		strings.Repeat("ab", KeySize) + "\n",
+		"q6urq6urq6urq6urq6urq6urq6urq6urq6urq6urq6s=",
+	} {
+		key, err := ParseKey([]byte(data))
+		if err != nil {
+			t.Fatalf("%q: %s", data, err)
+		}
+		if !bytes.Equal(key, raw) {
+			t.Fatalf("%q: got key %x", data, key)
+		}
+	}
+	if _, err := ParseKey([]byte("abab")); err == nil {
+		t.Error("expected a short key to be rejected")
+	}
+}
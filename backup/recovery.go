@@ -0,0 +1,196 @@
+package backup
+
+import (
+	"dpasswd/fsm"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Point is where a point-in-time recovery stops: after the entry with raft
+// index Index, or after the last entry appended at or before Time.
+type Point struct {
+	Index uint64
+	Time  time.Time
+}
+
+func (p Point) String() string {
+	if p.Index > 0 {
+		return fmt.Sprintf("index %d", p.Index)
+	}
+	return p.Time.Format(time.RFC3339)
+}
+
+// before reports whether a backup taken at t of index lies before the point.
+func (p Point) before(t time.Time, index uint64) bool {
+	if p.Index > 0 {
+		return index <= p.Index
+	}
+	return !t.After(p.Time)
+}
+
+// past reports whether the entry l lies after the point.
+func (p Point) past(l *raft.Log) bool {
+	if p.Index > 0 {
+		return l.Index > p.Index
+	}
+	return l.AppendedAt.After(p.Time)
+}
+
+// Recovery is the outcome of a point-in-time recovery.
+type Recovery struct {
+	// Backup is the name of the backup the state was restored from, empty
+	// when the whole log was replayed
+	Backup      string `json:"backup,omitempty"`
+	BackupIndex uint64 `json:"backup_index,omitempty"`
+	// Index, Term and AppendedAt describe the last entry of the recovered
+	// state
+	Index      uint64    `json:"index"`
+	Term       uint64    `json:"term"`
+	AppendedAt time.Time `json:"appended_at,omitempty"`
+	// Commands is the number of commands replayed on top of the backup
+	Commands           int                `json:"commands"`
+	Configuration      raft.Configuration `json:"-"`
+	ConfigurationIndex uint64             `json:"configuration_index"`
+	// Complete is false when the archive ends before the point
+	Complete bool `json:"complete"`
+}
+
+// Recover restores the newest backup of the target before the point into f,
+// and replays the archived log entries after it up to the point. Without such
+// a backup the whole archived log is replayed, if it starts at the first
+// entry. The backups and segments are the ones written by a scheduler with
+// the given prefix.
+func Recover(target Target, prefix string, key []byte, to Point, f raft.FSM) (*Recovery, error) {
+	objects, err := target.List(prefix + "backup-")
+	if err != nil {
+		return nil, fmt.Errorf("error listing backups: %w", err)
+	}
+	var name string
+	var nameTime time.Time
+	var nameIndex uint64
+	for _, o := range objects {
+		t, index, ok := ParseName(prefix, o.Name)
+		if !ok || !to.before(t, index) {
+			continue
+		}
+		if name == "" || index > nameIndex || (index == nameIndex && t.After(nameTime)) {
+			name, nameTime, nameIndex = o.Name, t, index
+		}
+	}
+
+	segments, err := ListSegments(target, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("error listing log segments: %w", err)
+	}
+
+	result := &Recovery{}
+	if name == "" {
+		// Without a backup the archive has to go back to the first entry
+		if len(segments) == 0 || segments[0].First != 1 {
+			return nil, fmt.Errorf("no backup in %s before %s", target, to)
+		}
+	} else if err := restoreBackup(target, name, key, f, result); err != nil {
+		return nil, err
+	}
+	if to.Index > 0 && result.Index == to.Index {
+		result.Complete = true
+		return result, nil
+	}
+
+	for _, segment := range segments {
+		if segment.Last <= result.Index {
+			continue
+		}
+		if segment.First > result.Index+1 {
+			return result, fmt.Errorf("the log archive misses the entries %d to %d, a point after them needs a backup taken after them", result.Index+1, segment.First-1)
+		}
+		err := ReadSegment(target, segment.Name, key, func(l *raft.Log) error {
+			if l.Index <= result.Index {
+				return nil
+			}
+			if l.Index != result.Index+1 {
+				return fmt.Errorf("%s misses the entries %d to %d", segment.Name, result.Index+1, l.Index-1)
+			}
+			if to.past(l) {
+				result.Complete = true
+				return ErrStopReading
+			}
+			if err := replay(f, l, result); err != nil {
+				return err
+			}
+			if to.Index > 0 && l.Index == to.Index {
+				result.Complete = true
+				return ErrStopReading
+			}
+			return nil
+		})
+		if err != nil {
+			return result, err
+		}
+		if result.Complete {
+			break
+		}
+	}
+	return result, nil
+}
+
+// restoreBackup restores the backup name into f.
+func restoreBackup(target Target, name string, key []byte, f raft.FSM, result *Recovery) error {
+	rc, err := target.Get(name)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", name, err)
+	}
+	b, err := Read(rc, key)
+	_ = rc.Close()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", name, err)
+	}
+	defer func() {
+		_ = b.Close()
+	}()
+	data, err := b.Open()
+	if err != nil {
+		return err
+	}
+	if err := f.Restore(io.NopCloser(data)); err != nil {
+		return fmt.Errorf("error restoring %s: %w", name, err)
+	}
+
+	meta := b.Meta()
+	result.Backup = name
+	result.BackupIndex = meta.Index
+	result.Index = meta.Index
+	result.Term = meta.Term
+	result.Configuration = meta.Configuration
+	result.ConfigurationIndex = meta.ConfigurationIndex
+	return nil
+}
+
+// replay applies a command to f and tracks the configuration, like raft does
+// when it applies the entry.
+func replay(f raft.FSM, l *raft.Log, result *Recovery) error {
+	switch l.Type {
+	case raft.LogCommand:
+		// Reads went through the log as well, they change nothing
+		var payload fsm.CommandPayload
+		if err := json.Unmarshal(l.Data, &payload); err == nil && strings.EqualFold(strings.TrimSpace(payload.Operation), "GET") {
+			break
+		}
+		if resp, ok := f.Apply(l).(*fsm.ApplyResponse); ok && resp.Error != nil {
+			return fmt.Errorf("error applying %s of %q at index %d: %w", payload.Operation, payload.Key, l.Index, resp.Error)
+		}
+		result.Commands++
+	case raft.LogConfiguration:
+		result.Configuration = raft.DecodeConfiguration(l.Data)
+		result.ConfigurationIndex = l.Index
+	}
+	result.Index = l.Index
+	result.Term = l.Term
+	result.AppendedAt = l.AppendedAt
+	return nil
+}
@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Retention is how many backups are kept: the newest of each of the last
+// Hourly hours, Daily days and Weekly weeks that have a backup. A backup can
+// count for more than one of them. The newest backup is always kept, and
+// nothing is removed when all three are zero.
+type Retention struct {
+	Hourly int
+	Daily  int
+	Weekly int
+}
+
+// Expired returns the backups the retention does not keep.
+func (r Retention) Expired(backups []Object, takenAt func(Object) time.Time) []Object {
+	if r.Hourly <= 0 && r.Daily <= 0 && r.Weekly <= 0 {
+		return nil
+	}
+	sorted := append([]Object(nil), backups...)
+	sort.Slice(sorted, func(i, j int) bool { return takenAt(sorted[i]).After(takenAt(sorted[j])) })
+
+	keep := make(map[string]bool)
+	if len(sorted) > 0 {
+		keep[sorted[0].Name] = true
+	}
+	periods := []struct {
+		count  int
+		period func(time.Time) string
+	}{
+		{r.Hourly, func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+	}
+	for _, p := range periods {
+		seen := make(map[string]bool)
+		for _, b := range sorted {
+			if len(seen) == p.count {
+				break
+			}
+			period := p.period(takenAt(b).UTC())
+			if !seen[period] {
+				seen[period] = true
+				keep[b.Name] = true
+			}
+		}
+	}
+
+	var expired []Object
+	for _, b := range sorted {
+		if !keep[b.Name] {
+			expired = append(expired, b)
+		}
+	}
+	return expired
+}
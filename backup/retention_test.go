@@ -0,0 +1,49 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetentionExpired(t *testing.T) {
+	now := time.Date(2024, 3, 13, 12, 30, 0, 0, time.UTC) // a Wednesday
+	backups := []Object{
+		{Name: "a", ModTime: now},
+		{Name: "b", ModTime: now.Add(-10 * time.Minute)},
+		// The newest of the previous hour
+		{Name: "c", ModTime: time.Date(2024, 3, 13, 11, 59, 59, 0, time.UTC)},
+		{Name: "d", ModTime: time.Date(2024, 3, 13, 11, 0, 0, 0, time.UTC)},
+		// The newest of the previous day
+		{Name: "e", ModTime: time.Date(2024, 3, 12, 23, 59, 0, 0, time.UTC)},
+		// Sunday, the newest of the previous ISO week, which started on Monday
+		{Name: "f", ModTime: time.Date(2024, 3, 10, 20, 0, 0, 0, time.UTC)},
+		{Name: "g", ModTime: time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)},
+	}
+	takenAt := func(o Object) time.Time { return o.ModTime }
+
+	tests := []struct {
+		name      string
+		retention Retention
+		expired   []string
+	}{
+		{"nothing configured", Retention{}, nil},
+		{"one hour", Retention{Hourly: 1}, []string{"b", "c", "d", "e", "f", "g"}},
+		{"two hours", Retention{Hourly: 2}, []string{"b", "d", "e", "f", "g"}},
+		{"two days", Retention{Daily: 2}, []string{"b", "c", "d", "f", "g"}},
+		{"two weeks", Retention{Weekly: 2}, []string{"b", "c", "d", "e", "g"}},
+		{"overlapping", Retention{Hourly: 2, Daily: 2, Weekly: 3}, []string{"b", "d", "g"}},
+		{"more than there are", Retention{Hourly: 100}, []string{"b", "d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var expired []string
+			for _, o := range tt.retention.Expired(backups, takenAt) {
+				expired = append(expired, o.Name)
+			}
+			if !reflect.DeepEqual(expired, tt.expired) {
+				t.Fatalf("expected %v to expire, got %v", tt.expired, expired)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory bucket that checks the signature of every request
+// the way S3 does, by signing the request again with the secret key.
+type fakeS3 struct {
+	t         *testing.T
+	bucket    string
+	accessKey string
+	secretKey string
+	region    string
+	// pageSize is the number of keys of one listing page
+	pageSize int
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	s := &fakeS3{
+		t:         t,
+		bucket:    "backups",
+		accessKey: "access",
+		secretKey: "secret",
+		region:    "eu-central-1",
+		pageSize:  2,
+		objects:   make(map[string][]byte),
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func (s *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, http.StatusText(status))
+}
+
+// verify signs a copy of req with the headers it claims to have signed and
+// compares the signatures.
+func (s *fakeS3) verify(req *http.Request, body []byte) bool {
+	auth := req.Header.Get("Authorization")
+	i := strings.Index(auth, "SignedHeaders=")
+	if i < 0 {
+		return false
+	}
+	signed := strings.Split(strings.SplitN(auth[i+len("SignedHeaders="):], ",", 2)[0], ";")
+	now, err := time.Parse("20060102T150405Z", req.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	sum := req.Header.Get("X-Amz-Content-Sha256")
+	if hexSHA256(body) != sum {
+		return false
+	}
+
+	check, _ := http.NewRequest(req.Method, "http://"+req.Host+req.URL.RequestURI(), nil)
+	for _, name := range signed {
+		if name != "host" {
+			check.Header.Set(name, req.Header.Get(name))
+		}
+	}
+	check.Header.Del("Authorization")
+	signV4(check, s.accessKey, s.secretKey, s.region, "s3", sum, now)
+	return check.Header.Get("Authorization") == auth
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		s.t.Error(err)
+		return
+	}
+	if !s.verify(req, body) {
+		s.fail(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if path != s.bucket && !strings.HasPrefix(path, s.bucket+"/") {
+		s.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(path, s.bucket), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case key == "" && req.Method == http.MethodGet:
+		s.list(w, req)
+	case req.Method == http.MethodPut:
+		s.objects[key] = body
+	case req.Method == http.MethodGet:
+		data, ok := s.objects[key]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		_, _ = w.Write(data)
+	case req.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, req *http.Request) {
+	prefix := req.URL.Query().Get("prefix")
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start := 0
+	if token := req.URL.Query().Get("continuation-token"); token != "" {
+		start = sort.SearchStrings(keys, token)
+	}
+	var result listBucketResult
+	for _, key := range keys[start:] {
+		if len(result.Contents) == s.pageSize {
+			result.IsTruncated = true
+			result.NextContinuationToken = key
+			break
+		}
+		result.Contents = append(result.Contents, struct {
+			Key          string
+			Size         int64
+			LastModified time.Time
+		}{Key: key, Size: int64(len(s.objects[key])), LastModified: time.Now()})
+	}
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func TestS3Target(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	target, err := NewS3Target(S3Config{
+		Endpoint:  ts.URL,
+		Bucket:    fake.bucket,
+		Region:    fake.region,
+		AccessKey: fake.accessKey,
+		SecretKey: fake.secretKey,
+		Prefix:    "dpasswd/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Names with characters signing has to encode
+	names := []string{"backup-1.tar.gz", "backup-2.tar.gz", "backup 3+4.tar.gz", "other.json"}
+	for _, name := range names {
+		data := []byte("data of " + name)
+		sum := sha256.Sum256(data)
+		if err := target.Put(name, bytes.NewReader(data), int64(len(data)), hex.EncodeToString(sum[:])); err != nil {
+			t.Fatalf("put %s: %s", name, err)
+		}
+	}
+	if _, ok := fake.objects["dpasswd/backup 3+4.tar.gz"]; !ok {
+		t.Fatalf("expected the objects under the prefix, got %v", fake.objects)
+	}
+
+	rc, err := target.Get("backup 3+4.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "data of backup 3+4.tar.gz" {
+		t.Fatalf("got %q", data)
+	}
+
+	// More objects than fit on one page of the listing
+	objects, err := target.List("backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, o := range objects {
+		listed = append(listed, o.Name)
+	}
+	if want := []string{"backup 3+4.tar.gz", "backup-1.tar.gz", "backup-2.tar.gz"}; !reflect.DeepEqual(listed, want) {
+		t.Fatalf("expected %v, got %v", want, listed)
+	}
+
+	if err := target.Delete("backup-1.tar.gz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.Get("backup-1.tar.gz"); err == nil || !strings.Contains(err.Error(), "NoSuchKey") {
+		t.Fatalf("expected the deleted object to be missing, got %v", err)
+	}
+}
+
+func TestS3TargetWrongSecret(t *testing.T) {
+	fake, ts := newFakeS3(t)
+	target, err := NewS3Target(S3Config{
+		Endpoint:  ts.URL,
+		Bucket:    fake.bucket,
+		Region:    fake.region,
+		AccessKey: fake.accessKey,
+		SecretKey: "wrong",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := target.List(""); err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Fatalf("expected the signature to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,356 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"dpasswd/events"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// SchedulerConfig sets what the scheduler backs up where and how often.
+type SchedulerConfig struct {
+	Interval  time.Duration
+	Target    Target
+	Retention Retention
+	// Key encrypts the backups when set
+	Key []byte
+	// Prefix starts the names of the backups, e.g. to tell the raft groups
+	// of a sharded node apart
+	Prefix string
+	NodeID string
+	// Log is the raft log whose committed entries are archived every
+	// LogInterval, nil disables archiving
+	Log         raft.LogStore
+	LogInterval time.Duration
+	// Bus receives the gaps found in the log while archiving it, Group is
+	// the raft group they are published for
+	Bus   *events.Bus
+	Group int
+}
+
+// BackupInfo describes a backup written by the scheduler.
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Index     uint64    `json:"index"`
+	Term      uint64    `json:"term"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Encrypted bool      `json:"encrypted"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Status is the outcome of the scheduled backups of this node.
+type Status struct {
+	Target      string      `json:"target"`
+	Interval    string      `json:"interval"`
+	Encrypted   bool        `json:"encrypted"`
+	Leader      bool        `json:"leader"`
+	LastAttempt *time.Time  `json:"last_attempt,omitempty"`
+	LastSuccess *time.Time  `json:"last_success,omitempty"`
+	LastFailure *time.Time  `json:"last_failure,omitempty"`
+	LastError   string      `json:"last_error,omitempty"`
+	LastBackup  *BackupInfo `json:"last_backup,omitempty"`
+	NextRun     *time.Time  `json:"next_run,omitempty"`
+	// Retained is the number of backups kept after the last retention run
+	Retained int `json:"retained"`
+	// ArchivedIndex is the last raft index in the log archive
+	ArchivedIndex      uint64     `json:"archived_index,omitempty"`
+	LastArchive        *time.Time `json:"last_archive,omitempty"`
+	LastArchiveFailure *time.Time `json:"last_archive_failure,omitempty"`
+	LastArchiveError   string     `json:"last_archive_error,omitempty"`
+	// LastArchiveGap is the last gap in the log the archive continued after
+	LastArchiveGap *ArchiveGap `json:"last_archive_gap,omitempty"`
+}
+
+// OK reports whether the last backup and the last archiving of the log
+// succeeded, or there was none yet.
+func (s Status) OK() bool {
+	backupOK := s.LastFailure == nil || (s.LastSuccess != nil && s.LastSuccess.After(*s.LastFailure))
+	archiveOK := s.LastArchiveFailure == nil || (s.LastArchive != nil && s.LastArchive.After(*s.LastArchiveFailure))
+	return backupOK && archiveOK
+}
+
+// timeFormat is the time in the names of the backups. It sorts like the time.
+const timeFormat = "20060102T150405Z"
+
+// Scheduler writes a backup to the target every interval while this node is
+// the leader, and then removes the backups the retention does not keep. With
+// a log store it also archives the committed raft log in segments, for
+// point-in-time recovery. Each file is stored together with a NAME.sha256
+// file holding the checksum of the stored file.
+type Scheduler struct {
+	raft      *raft.Raft
+	snapshots raft.SnapshotStore
+	config    SchedulerConfig
+	logger    hclog.Logger
+
+	mu     sync.Mutex
+	status Status
+
+	shutdownCh   chan struct{}
+	shutdownDone chan struct{}
+}
+
+func NewScheduler(r *raft.Raft, snapshots raft.SnapshotStore, config SchedulerConfig, logger hclog.Logger) *Scheduler {
+	return &Scheduler{
+		raft:      r,
+		snapshots: snapshots,
+		config:    config,
+		logger:    logger,
+		status: Status{
+			Target:    config.Target.String(),
+			Interval:  config.Interval.String(),
+			Encrypted: config.Key != nil,
+		},
+		shutdownCh:   make(chan struct{}),
+		shutdownDone: make(chan struct{}),
+	}
+}
+
+func (s *Scheduler) Start() {
+	go s.run()
+}
+
+func (s *Scheduler) Stop() {
+	close(s.shutdownCh)
+	<-s.shutdownDone
+}
+
+// Status returns the outcome of the last backups.
+func (s *Scheduler) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.Leader = s.raft.State() == raft.Leader
+	return status
+}
+
+func (s *Scheduler) run() {
+	defer close(s.shutdownDone)
+	timer := time.NewTimer(s.config.Interval)
+	defer timer.Stop()
+	s.setNextRun(time.Now().Add(s.config.Interval))
+
+	var archiveCh <-chan time.Time
+	if s.config.Log != nil && s.config.LogInterval > 0 {
+		ticker := time.NewTicker(s.config.LogInterval)
+		defer ticker.Stop()
+		archiveCh = ticker.C
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			timer.Reset(s.config.Interval)
+			s.setNextRun(time.Now().Add(s.config.Interval))
+			if s.raft.State() == raft.Leader {
+				s.RunOnce()
+			}
+		case <-archiveCh:
+			if s.raft.State() == raft.Leader {
+				s.ArchiveLog()
+			}
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+func (s *Scheduler) setNextRun(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.NextRun = &t
+}
+
+// RunOnce writes a backup and applies the retention.
+func (s *Scheduler) RunOnce() {
+	start := time.Now()
+	info, err := s.backup()
+	if err == nil {
+		s.logger.Info("backup written", "name", info.Name, "index", info.Index, "bytes", info.Size, "duration", time.Since(start))
+	}
+
+	s.mu.Lock()
+	s.status.LastAttempt = &start
+	if err != nil {
+		s.status.LastFailure = &start
+		s.status.LastError = err.Error()
+	} else {
+		s.status.LastSuccess = &start
+		s.status.LastError = ""
+		s.status.LastBackup = &info
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.logger.Error("error writing backup", "target", s.config.Target, "error", err)
+		return
+	}
+
+	retained, err := s.applyRetention()
+	if err != nil {
+		s.logger.Error("error removing expired backups", "target", s.config.Target, "error", err)
+		return
+	}
+	s.mu.Lock()
+	s.status.Retained = retained
+	s.mu.Unlock()
+}
+
+func (s *Scheduler) backup() (BackupInfo, error) {
+	meta, snapshot, err := Snapshot(s.raft, s.snapshots)
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("error taking snapshot: %w", err)
+	}
+	defer func() {
+		_ = snapshot.Close()
+	}()
+
+	now := time.Now().UTC()
+	info := BackupInfo{
+		Index:     meta.Index,
+		Term:      meta.Term,
+		Encrypted: s.config.Key != nil,
+		CreatedAt: now,
+	}
+	name := fmt.Sprintf("%sbackup-%s-%d.tar.gz", s.config.Prefix, now.Format(timeFormat), meta.Index)
+	info.Name, info.Size, info.SHA256, err = s.store(name, func(w io.Writer) error {
+		_, err := Write(w, s.config.NodeID, meta, snapshot)
+		return err
+	})
+	return info, err
+}
+
+// store writes what write produces to the target under name, encrypted when
+// a key is set, together with a NAME.sha256 file. The file is written to a
+// temporary file first, as its size and checksum have to be known before it
+// is uploaded. It returns the stored name, size and checksum.
+func (s *Scheduler) store(name string, write func(io.Writer) error) (string, int64, string, error) {
+	f, err := os.CreateTemp("", "dpasswd-backup-*")
+	if err != nil {
+		return name, 0, "", err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	hash := sha256.New()
+	var w io.Writer = io.MultiWriter(f, hash)
+	var enc io.WriteCloser
+	if s.config.Key != nil {
+		name += ".enc"
+		if enc, err = NewEncryptWriter(w, s.config.Key); err != nil {
+			return name, 0, "", err
+		}
+		w = enc
+	}
+	if err := write(w); err != nil {
+		return name, 0, "", err
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			return name, 0, "", err
+		}
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return name, 0, "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return name, 0, "", err
+	}
+
+	if err := s.config.Target.Put(name, f, size, sum); err != nil {
+		return name, 0, "", fmt.Errorf("error storing %s: %w", name, err)
+	}
+	sumFile := []byte(sum + "  " + name + "\n")
+	if err := s.config.Target.Put(name+".sha256", bytes.NewReader(sumFile), int64(len(sumFile)), hexSHA256(sumFile)); err != nil {
+		return name, 0, "", fmt.Errorf("error storing checksum of %s: %w", name, err)
+	}
+	return name, size, sum, nil
+}
+
+// applyRetention removes the expired backups and returns how many are kept.
+func (s *Scheduler) applyRetention() (int, error) {
+	objects, err := s.config.Target.List(s.config.Prefix + "backup-")
+	if err != nil {
+		return 0, err
+	}
+	var backups []Object
+	for _, o := range objects {
+		if _, _, ok := ParseName(s.config.Prefix, o.Name); ok {
+			backups = append(backups, o)
+		}
+	}
+
+	expired := s.config.Retention.Expired(backups, func(o Object) time.Time {
+		t, _, _ := ParseName(s.config.Prefix, o.Name)
+		return t
+	})
+	for _, o := range expired {
+		if err := s.config.Target.Delete(o.Name); err != nil {
+			return 0, fmt.Errorf("error removing %s: %w", o.Name, err)
+		}
+		if err := s.config.Target.Delete(o.Name + ".sha256"); err != nil {
+			return 0, fmt.Errorf("error removing %s.sha256: %w", o.Name, err)
+		}
+		s.logger.Info("expired backup removed", "name", o.Name)
+	}
+
+	// Recovery starts from a backup, the log before the oldest one is of no
+	// use anymore
+	var oldest uint64
+	expiredNames := make(map[string]bool)
+	for _, o := range expired {
+		expiredNames[o.Name] = true
+	}
+	for _, o := range backups {
+		if _, index, _ := ParseName(s.config.Prefix, o.Name); !expiredNames[o.Name] && (oldest == 0 || index < oldest) {
+			oldest = index
+		}
+	}
+	if oldest > 0 {
+		if err := s.removeSegmentsBefore(oldest); err != nil {
+			return 0, err
+		}
+	}
+	return len(backups) - len(expired), nil
+}
+
+// ParseName returns the time and index of a backup written by a scheduler
+// with the given prefix.
+func ParseName(prefix, name string) (time.Time, uint64, bool) {
+	rest := strings.TrimPrefix(name, prefix+"backup-")
+	if rest == name {
+		return time.Time{}, 0, false
+	}
+	rest = strings.TrimSuffix(rest, ".enc")
+	if !strings.HasSuffix(rest, ".tar.gz") {
+		return time.Time{}, 0, false
+	}
+	parts := strings.Split(strings.TrimSuffix(rest, ".tar.gz"), "-")
+	if len(parts) != 2 {
+		return time.Time{}, 0, false
+	}
+	t, err := time.Parse(timeFormat, parts[0])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	index, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return t, index, true
+}
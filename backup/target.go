@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Object is a file stored on a target.
+type Object struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Target stores backup files under flat names.
+type Target interface {
+	// Put stores size bytes read from r, whose SHA-256 checksum is sum
+	Put(name string, r io.Reader, size int64, sum string) error
+	Get(name string) (io.ReadCloser, error)
+	// List returns the objects whose names start with prefix
+	List(prefix string) ([]Object, error)
+	Delete(name string) error
+	String() string
+}
+
+// DirTarget stores backups in a local directory, e.g. a mounted network
+// share.
+type DirTarget struct {
+	dir string
+}
+
+func NewDirTarget(dir string) (*DirTarget, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirTarget{dir: dir}, nil
+}
+
+// Put writes to a temporary file first, so that a partial backup never has
+// the name of a complete one.
+func (d *DirTarget) Put(name string, r io.Reader, size int64, sum string) error {
+	f, err := os.CreateTemp(d.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("wrote %d bytes instead of %d", n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(d.dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+func (d *DirTarget) Get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.dir, name))
+}
+
+func (d *DirTarget) List(prefix string) ([]Object, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var objects []Object
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		objects = append(objects, Object{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+func (d *DirTarget) Delete(name string) error {
+	err := os.Remove(filepath.Join(d.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *DirTarget) String() string {
+	return d.dir
+}
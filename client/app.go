@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"crypto/aes"
@@ -39,7 +40,7 @@ func main() {
 	}
 
 	var op int
-	fmt.Printf("1) Add new password\n2) Get password\n3) Delete password\nDo: ")
+	fmt.Printf("1) Add new password\n2) Get password\n3) Delete password\n4) List cluster members\nDo: ")
 	_, err := fmt.Scanf("%d", &op)
 	if err != nil {
 		log.Fatal(err)
@@ -53,6 +54,8 @@ func main() {
 	// TODO
 	//case 3:
 	//	delSecret(serverAddr)
+	case 4:
+		listMembers(serverAddr)
 	default:
 		log.Fatal(fmt.Errorf("Error: Unknown operation %d\n", op))
 	}
@@ -188,6 +191,71 @@ func addSecret(serverAddr string) {
 	}
 }
 
+type member struct {
+	ID          string     `json:"id"`
+	RaftAddress string     `json:"raft_address"`
+	HTTPAddress string     `json:"http_address"`
+	Suffrage    string     `json:"suffrage"`
+	Leader      bool       `json:"leader"`
+	LastContact *time.Time `json:"last_contact"`
+	MatchIndex  *uint64    `json:"match_index"`
+	CommitLag   *uint64    `json:"commit_lag"`
+}
+
+type membersResponse struct {
+	Data    []member `json:"data"`
+	Message *string  `json:"message"`
+	Error   *string  `json:"error"`
+}
+
+func listMembers(serverAddr string) {
+	requestURL := fmt.Sprintf("http://%s/raft/members", serverAddr)
+	client := http.Client{
+		Timeout: 30 * time.Second,
+	}
+
+	res, err := client.Get(requestURL)
+	if err != nil {
+		log.Fatalf("error making http request: %s\n", err)
+	}
+	defer func() {
+		_ = res.Body.Close()
+	}()
+
+	if res.StatusCode != http.StatusOK {
+		resBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			log.Fatalf("error reading response body: %s\n", err)
+		}
+		log.Fatalf("error response with status code %d: %s\n", res.StatusCode, resBody)
+	}
+
+	var jsonResponse membersResponse
+	if err := json.NewDecoder(res.Body).Decode(&jsonResponse); err != nil {
+		log.Fatal(err)
+	}
+
+	// Progress of other nodes is only known when asking the leader
+	orDash := func(v *uint64) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprintf("%d", *v)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tRAFT ADDRESS\tHTTP ADDRESS\tSUFFRAGE\tLEADER\tLAST CONTACT\tMATCH INDEX\tCOMMIT LAG")
+	for _, m := range jsonResponse.Data {
+		lastContact := "-"
+		if m.LastContact != nil {
+			lastContact = time.Since(*m.LastContact).Round(time.Millisecond).String() + " ago"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\t%s\t%s\n",
+			m.ID, m.RaftAddress, m.HTTPAddress, m.Suffrage, m.Leader, lastContact, orDash(m.MatchIndex), orDash(m.CommitLag))
+	}
+	_ = w.Flush()
+}
+
 func Encrypt(data []byte, key []byte) ([]byte, error) {
 	key, salt, err := DeriveKey(key, nil)
 	if err != nil {
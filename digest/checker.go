@@ -0,0 +1,274 @@
+// Package digest compares the state digests of the members of a raft group,
+// to detect replicas that silently diverged.
+package digest
+
+import (
+	"dpasswd/events"
+	"dpasswd/fsm"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	gometrics "github.com/armon/go-metrics"
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// Config sets how often the members are compared.
+type Config struct {
+	Interval time.Duration
+	// Timeout bounds how long a member may take to apply the compared index
+	Timeout time.Duration
+	// Group is the raft group compared, asked for with ?group= on sharded
+	// nodes
+	Group int
+}
+
+// MemberResult is the outcome of comparing a member with the leader.
+type MemberResult struct {
+	ID     string `json:"id"`
+	Digest string `json:"digest,omitempty"`
+	Match  *bool  `json:"match,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Result is the outcome of the last comparison.
+type Result struct {
+	Time    time.Time      `json:"time"`
+	Index   uint64         `json:"index"`
+	Digest  string         `json:"digest"`
+	Members []MemberResult `json:"members"`
+}
+
+// Checker compares the digest of the state of the leader with the ones of the
+// other members at the index of the last applied command, every interval
+// while the local node is the leader. A member whose digest differs is
+// logged, counted in the digest.mismatches metric and published as
+// digest_mismatch event, and published as digest_mismatch_resolved once it
+// matches again.
+type Checker struct {
+	raft    *raft.Raft
+	db      *badger.DB
+	digests *fsm.Digests
+	nodeID  raft.ServerID
+	bus     *events.Bus
+	config  Config
+	client  *http.Client
+	logger  hclog.Logger
+
+	mu       sync.Mutex
+	last     *Result
+	diverged map[raft.ServerID]bool
+
+	shutdownCh   chan struct{}
+	shutdownDone chan struct{}
+}
+
+func NewChecker(r *raft.Raft, db *badger.DB, digests *fsm.Digests, nodeID raft.ServerID, bus *events.Bus, config Config, logger hclog.Logger) *Checker {
+	return &Checker{
+		raft:         r,
+		db:           db,
+		digests:      digests,
+		nodeID:       nodeID,
+		bus:          bus,
+		config:       config,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		logger:       logger,
+		diverged:     make(map[raft.ServerID]bool),
+		shutdownCh:   make(chan struct{}),
+		shutdownDone: make(chan struct{}),
+	}
+}
+
+func (c *Checker) Start() {
+	go c.run()
+}
+
+func (c *Checker) Stop() {
+	close(c.shutdownCh)
+	<-c.shutdownDone
+}
+
+// Last returns the outcome of the last comparison, nil if there was none.
+func (c *Checker) Last() *Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+func (c *Checker) run() {
+	defer close(c.shutdownDone)
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.shutdownCh:
+			return
+		}
+
+		if c.raft.State() != raft.Leader {
+			continue
+		}
+		if err := c.Check(); err != nil {
+			c.logger.Error("error comparing state digests", "error", err)
+		}
+	}
+}
+
+// Check compares the members once.
+func (c *Checker) Check() error {
+	// Everything committed is applied to the FSM after the barrier
+	if err := c.raft.Barrier(c.config.Timeout).Error(); err != nil {
+		return err
+	}
+	local, ok := c.digests.Latest()
+	if !ok {
+		return nil
+	}
+	configFuture := c.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+
+	result := &Result{Time: time.Now(), Index: local.Index, Digest: local.Digest}
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == c.nodeID {
+			continue
+		}
+		member := MemberResult{ID: string(srv.ID)}
+		remote, err := c.fetch(srv.ID, local.Index)
+		if err != nil {
+			member.Error = err.Error()
+			c.logger.Warn("error getting state digest of member", "node", srv.ID, "index", local.Index, "error", err)
+			result.Members = append(result.Members, member)
+			continue
+		}
+		match := remote == local.Digest
+		member.Digest, member.Match = remote, &match
+		result.Members = append(result.Members, member)
+		c.report(srv.ID, local, remote, match)
+	}
+	sort.Slice(result.Members, func(i, j int) bool { return result.Members[i].ID < result.Members[j].ID })
+
+	c.mu.Lock()
+	c.last = result
+	for id := range c.diverged {
+		if !hasServer(configFuture.Configuration(), id) {
+			delete(c.diverged, id)
+		}
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Checker) report(id raft.ServerID, local fsm.Digest, remote string, match bool) {
+	c.mu.Lock()
+	was := c.diverged[id]
+	c.diverged[id] = !match
+	c.mu.Unlock()
+
+	labels := []gometrics.Label{{Name: "group", Value: strconv.Itoa(c.config.Group)}, {Name: "peer", Value: string(id)}}
+	if !match {
+		gometrics.IncrCounterWithLabels([]string{"digest", "mismatches"}, 1, labels)
+	}
+	switch {
+	case !match && !was:
+		c.logger.Error("state of member diverged from the leader", "node", id, "index", local.Index, "digest", local.Digest, "member_digest", remote)
+		c.publish(events.DigestMismatch, id, local, remote)
+	case match && was:
+		c.logger.Info("state of member matches the leader again", "node", id, "index", local.Index)
+		c.publish(events.DigestMismatchResolved, id, local, remote)
+	}
+}
+
+func (c *Checker) publish(typ string, id raft.ServerID, local fsm.Digest, remote string) {
+	if c.bus == nil {
+		return
+	}
+	c.bus.Publish(events.Event{
+		Type:       typ,
+		Group:      c.config.Group,
+		Peer:       string(id),
+		Index:      local.Index,
+		Digest:     local.Digest,
+		PeerDigest: remote,
+	})
+}
+
+// fetch asks a member for its digest at index, waiting for it to apply the
+// index for up to the timeout.
+func (c *Checker) fetch(id raft.ServerID, index uint64) (string, error) {
+	addr, err := c.httpAddress(id)
+	if err != nil {
+		return "", fmt.Errorf("no HTTP address known: %w", err)
+	}
+	query := url.Values{}
+	query.Set("index", strconv.FormatUint(index, 10))
+	if c.config.Group != 0 {
+		query.Set("group", strconv.Itoa(c.config.Group))
+	}
+	u := fmt.Sprintf("http://%s/admin/digest?%s", addr, query.Encode())
+
+	deadline := time.Now().Add(c.config.Timeout)
+	for {
+		digest, status, err := c.get(u)
+		if status != http.StatusNotFound || time.Now().After(deadline) {
+			return digest, err
+		}
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-c.shutdownCh:
+			return "", err
+		}
+	}
+}
+
+func (c *Checker) get(u string) (string, int, error) {
+	resp, err := c.client.Get(u)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var body struct {
+		Error string     `json:"error"`
+		Data  fsm.Digest `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", resp.StatusCode, fmt.Errorf("%s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, body.Error)
+	}
+	return body.Data.Digest, resp.StatusCode, nil
+}
+
+func (c *Checker) httpAddress(id raft.ServerID) (string, error) {
+	var addr string
+	if err := fsm.ReadMeta(c.db, fsm.NodeHTTPAddressKey(string(id)), &addr); err != nil {
+		return "", err
+	}
+	if addr == "" {
+		return "", fmt.Errorf("node %s registered none", id)
+	}
+	return addr, nil
+}
+
+func hasServer(cfg raft.Configuration, id raft.ServerID) bool {
+	for _, srv := range cfg.Servers {
+		if srv.ID == id {
+			return true
+		}
+	}
+	return false
+}
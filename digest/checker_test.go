@@ -0,0 +1,140 @@
+package digest_test
+
+import (
+	"dpasswd/digest"
+	"dpasswd/events"
+	"dpasswd/fsm"
+	"dpasswd/testcluster"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// checkMembers runs one comparison and returns whether each member matched.
+func checkMembers(t *testing.T, c *digest.Checker) map[string]bool {
+	t.Helper()
+	if err := c.Check(); err != nil {
+		t.Fatal(err)
+	}
+	matches := make(map[string]bool)
+	for _, m := range c.Last().Members {
+		if m.Error != "" || m.Match == nil {
+			t.Fatalf("error comparing %s: %s", m.ID, m.Error)
+		}
+		matches[m.ID] = *m.Match
+	}
+	return matches
+}
+
+func expectEvents(t *testing.T, ch <-chan events.Event, typ string, n int) {
+	t.Helper()
+	peers := make(map[string]bool)
+	for len(peers) < n {
+		select {
+		case e := <-ch:
+			if e.Type != typ {
+				t.Fatalf("expected %s events, got %+v", typ, e)
+			}
+			peers[e.Peer] = true
+		case <-time.After(time.Second):
+			t.Fatalf("expected %d %s events, got %v", n, typ, peers)
+		}
+	}
+	select {
+	case e := <-ch:
+		t.Fatalf("expected no further event, got %+v", e)
+	default:
+	}
+}
+
+func TestChecker(t *testing.T) {
+	c := testcluster.New(t, 3)
+	leader := c.WaitForLeader(t, 5*time.Second)
+	// Bootstrapped members did not join through the leader, which stores the
+	// HTTP addresses the checker reaches them at
+	for _, n := range c.Nodes() {
+		if err := fsm.ApplyCommand(leader.Raft, fsm.CommandPayload{
+			Operation: "SET",
+			Key:       fsm.NodeHTTPAddressKey(string(n.ID)),
+			Value:     n.HTTPAddress(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.Set(leader, key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Delete(leader, "b"); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertConverged(t, 5*time.Second)
+
+	bus := events.NewBus(string(leader.ID))
+	ch, unsubscribe := bus.Subscribe()
+	defer unsubscribe()
+	config := digest.Config{Timeout: 5 * time.Second}
+
+	checker := digest.NewChecker(leader.Raft, leader.DB, leader.Digests, leader.ID, bus, config, hclog.NewNullLogger())
+	for id, match := range checkMembers(t, checker) {
+		if !match {
+			t.Fatalf("expected %s to match the leader", id)
+		}
+	}
+	if n := len(checker.Last().Members); n != 2 {
+		t.Fatalf("expected both followers to be compared, got %d", n)
+	}
+
+	// A leader whose state diverged from the others at the latest index
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	diverged := fsm.NewRaftFSM(db, hclog.NewNullLogger())
+	local, _ := leader.Digests.Latest()
+	data, _ := json.Marshal(fsm.CommandPayload{Operation: "SET", Key: "diverged", Value: 1})
+	diverged.Apply(&raft.Log{Index: local.Index, Type: raft.LogCommand, Data: data})
+
+	checker = digest.NewChecker(leader.Raft, leader.DB, diverged.Digests(), leader.ID, bus, config, hclog.NewNullLogger())
+	for id, match := range checkMembers(t, checker) {
+		if match {
+			t.Fatalf("expected %s not to match the diverged leader", id)
+		}
+	}
+	expectEvents(t, ch, events.DigestMismatch, 2)
+	checkMembers(t, checker)
+	expectEvents(t, ch, events.DigestMismatch, 0)
+
+	// The diverged state is replaced by the one of the leader and catches up
+	// with the next write
+	future := leader.Raft.Snapshot()
+	if err := future.Error(); err != nil {
+		t.Fatal(err)
+	}
+	_, rc, err := future.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := diverged.Restore(rc); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(leader, "d", "d"); err != nil {
+		t.Fatal(err)
+	}
+	local, _ = leader.Digests.Latest()
+	data, _ = json.Marshal(fsm.CommandPayload{Operation: "SET", Key: "d", Value: "d"})
+	diverged.Apply(&raft.Log{Index: local.Index, Type: raft.LogCommand, Data: data})
+
+	for id, match := range checkMembers(t, checker) {
+		if !match {
+			t.Fatalf("expected %s to match the leader again", id)
+		}
+	}
+	expectEvents(t, ch, events.DigestMismatchResolved, 2)
+}
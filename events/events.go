@@ -0,0 +1,161 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Types of events.
+const (
+	// LeaderChange is published when a node learns about a new leader, or
+	// loses the leader, in which case Leader is empty
+	LeaderChange = "leader_change"
+	// PeerAdded and PeerRemoved are published by the leader when it starts or
+	// stops replicating to a server
+	PeerAdded   = "peer_added"
+	PeerRemoved = "peer_removed"
+	// HeartbeatFailed is published by the leader when a server stops
+	// answering heartbeats, HeartbeatResumed once it answers again
+	HeartbeatFailed  = "heartbeat_failed"
+	HeartbeatResumed = "heartbeat_resumed"
+	// DigestMismatch is published by the leader when the state digest of a
+	// server differs from its own at the same index, DigestMismatchResolved
+	// once they match again
+	DigestMismatch         = "digest_mismatch"
+	DigestMismatchResolved = "digest_mismatch_resolved"
+	// ArchiveGap is published by the leader when the raft log misses entries
+	// the log archive was still waiting for. The archive continues after
+	// Backup, Index is the first missing entry.
+	ArchiveGap = "archive_gap"
+)
+
+// Event is a change in the cluster as observed by this node.
+type Event struct {
+	ID          uint64     `json:"id"`
+	Type        string     `json:"type"`
+	Time        time.Time  `json:"time"`
+	Node        string     `json:"node"`
+	Group       int        `json:"group"`
+	Leader      string     `json:"leader,omitempty"`
+	LeaderAddr  string     `json:"leader_address,omitempty"`
+	Peer        string     `json:"peer,omitempty"`
+	PeerAddr    string     `json:"peer_address,omitempty"`
+	LastContact *time.Time `json:"last_contact,omitempty"`
+	Index       uint64     `json:"index,omitempty"`
+	Digest      string     `json:"digest,omitempty"`
+	PeerDigest  string     `json:"peer_digest,omitempty"`
+	Backup      string     `json:"backup,omitempty"`
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind before
+// further events are dropped for it.
+const subscriberBuffer = 256
+
+// Bus fans the events of this node out to its subscribers.
+type Bus struct {
+	node string
+
+	mu          sync.Mutex
+	nextID      uint64
+	subscribers map[chan Event]struct{}
+}
+
+func NewBus(node string) *Bus {
+	return &Bus{
+		node:        node,
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Publish stamps the event with an ID, the time and the node, and hands it to
+// every subscriber. It never blocks, a subscriber whose buffer is full misses
+// the event.
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	e.ID = b.nextID
+	e.Node = b.node
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving all events published from now on, and
+// a function ending the subscription.
+func (b *Bus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Observe publishes the leader, peer and heartbeat observations of a raft
+// group. Raft reports every failed heartbeat, only the first one of a series
+// is published.
+func Observe(r *raft.Raft, group int, bus *Bus) {
+	obsCh := make(chan raft.Observation, 64)
+	r.RegisterObserver(raft.NewObserver(obsCh, false, func(o *raft.Observation) bool {
+		switch o.Data.(type) {
+		case raft.LeaderObservation, raft.PeerObservation, raft.FailedHeartbeatObservation, raft.ResumedHeartbeatObservation:
+			return true
+		}
+		return false
+	}))
+
+	go func() {
+		failing := make(map[raft.ServerID]bool)
+		for o := range obsCh {
+			e := Event{Group: group}
+			switch data := o.Data.(type) {
+			case raft.LeaderObservation:
+				e.Type = LeaderChange
+				e.Leader, e.LeaderAddr = string(data.LeaderID), string(data.LeaderAddr)
+			case raft.PeerObservation:
+				e.Type = PeerAdded
+				if data.Removed {
+					e.Type = PeerRemoved
+					delete(failing, data.Peer.ID)
+				}
+				e.Peer, e.PeerAddr = string(data.Peer.ID), string(data.Peer.Address)
+			case raft.FailedHeartbeatObservation:
+				if failing[data.PeerID] {
+					continue
+				}
+				failing[data.PeerID] = true
+				e.Type = HeartbeatFailed
+				e.Peer = string(data.PeerID)
+				if !data.LastContact.IsZero() {
+					lastContact := data.LastContact
+					e.LastContact = &lastContact
+				}
+			case raft.ResumedHeartbeatObservation:
+				delete(failing, data.PeerID)
+				e.Type = HeartbeatResumed
+				e.Peer = string(data.PeerID)
+			}
+			bus.Publish(e)
+		}
+	}()
+}
@@ -0,0 +1,70 @@
+package events
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// FileLog appends every event as one line of JSON to a file.
+type FileLog struct {
+	file         *os.File
+	logger       hclog.Logger
+	shutdownCh   chan struct{}
+	shutdownDone chan struct{}
+}
+
+func NewFileLog(path string, logger hclog.Logger) (*FileLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLog{
+		file:         f,
+		logger:       logger,
+		shutdownCh:   make(chan struct{}),
+		shutdownDone: make(chan struct{}),
+	}, nil
+}
+
+// Start writes the events published on the bus from now on.
+func (l *FileLog) Start(bus *Bus) {
+	eventCh, cancel := bus.Subscribe()
+	go func() {
+		defer close(l.shutdownDone)
+		defer cancel()
+
+		encoder := json.NewEncoder(l.file)
+		write := func(e Event) {
+			if err := encoder.Encode(e); err != nil {
+				l.logger.Error("error writing event log", "id", e.ID, "error", err)
+			}
+		}
+		for {
+			select {
+			case e := <-eventCh:
+				write(e)
+			case <-l.shutdownCh:
+				// Keep what was published until now
+				for {
+					select {
+					case e := <-eventCh:
+						write(e)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Stop writes the pending events and closes the file.
+func (l *FileLog) Stop() {
+	close(l.shutdownCh)
+	<-l.shutdownDone
+	if err := l.file.Close(); err != nil {
+		l.logger.Error("error closing event log", "error", err)
+	}
+}
@@ -0,0 +1,135 @@
+package events
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// SignatureHeader carries "sha256=" and the hex encoded HMAC-SHA256 of the
+	// body, keyed with the webhook secret
+	SignatureHeader = "X-Dpasswd-Signature"
+	// EventHeader carries the type of the event
+	EventHeader = "X-Dpasswd-Event"
+	// DeliveryHeader carries the ID of the event, which stays the same when
+	// a delivery is retried
+	DeliveryHeader = "X-Dpasswd-Delivery"
+)
+
+// Webhook posts every event as JSON to an HTTP endpoint. Failed deliveries are
+// retried with exponential backoff, events are delivered one at a time in the
+// order they were published.
+type Webhook struct {
+	URL         string
+	Secret      string
+	MaxAttempts int
+	Backoff     time.Duration
+
+	client       *http.Client
+	logger       hclog.Logger
+	shutdownCh   chan struct{}
+	shutdownDone chan struct{}
+}
+
+func NewWebhook(url, secret string, logger hclog.Logger) *Webhook {
+	return &Webhook{
+		URL:          url,
+		Secret:       secret,
+		MaxAttempts:  5,
+		Backoff:      time.Second,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		logger:       logger,
+		shutdownCh:   make(chan struct{}),
+		shutdownDone: make(chan struct{}),
+	}
+}
+
+// Start delivers the events published on the bus from now on.
+func (w *Webhook) Start(bus *Bus) {
+	eventCh, cancel := bus.Subscribe()
+	go func() {
+		defer close(w.shutdownDone)
+		defer cancel()
+		for {
+			select {
+			case e := <-eventCh:
+				w.deliver(e)
+			case <-w.shutdownCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the delivery, giving up on retries of the current event.
+func (w *Webhook) Stop() {
+	close(w.shutdownCh)
+	<-w.shutdownDone
+}
+
+func (w *Webhook) deliver(e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		w.logger.Error("error encoding event", "id", e.ID, "error", err)
+		return
+	}
+
+	backoff := w.Backoff
+	for attempt := 1; ; attempt++ {
+		err := w.post(e, body)
+		if err == nil {
+			return
+		}
+		if attempt >= w.MaxAttempts {
+			w.logger.Error("giving up delivering event", "url", w.URL, "id", e.ID, "type", e.Type, "attempts", attempt, "error", err)
+			return
+		}
+		w.logger.Warn("error delivering event, retrying", "url", w.URL, "id", e.ID, "attempt", attempt, "backoff", backoff.String(), "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-w.shutdownCh:
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func (w *Webhook) post(e Event, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, e.Type)
+	req.Header.Set(DeliveryHeader, strconv.FormatUint(e.ID, 10))
+	if w.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(w.Secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the value of the signature header for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
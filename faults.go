@@ -0,0 +1,18 @@
+//go:build faults
+
+package main
+
+import (
+	"dpasswd/transport"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// injectFaults wraps the raft transport of a group, so that faults can be
+// injected through /admin/faults. Only built with the faults tag, for chaos
+// testing.
+func injectFaults(trans raft.Transport) (raft.Transport, *transport.FaultyTransport) {
+	faulty := transport.NewFaultyTransport(trans, time.Now().UnixNano())
+	return faulty, faulty
+}
@@ -0,0 +1,156 @@
+package fsm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// digestHistory is the number of applied indexes whose digests are kept.
+const digestHistory = 10000
+
+// Digest is the digest of the state at a raft index.
+type Digest struct {
+	Index  uint64 `json:"index"`
+	Digest string `json:"digest"`
+}
+
+// Digests keeps a rolling digest of the state of the FSM: the XOR of the
+// SHA-256 hashes of every key with its stored value. It is updated with every
+// write, and nodes holding the same keys and values have the same digest no
+// matter how they got there. The digests of the last applied indexes are kept
+// so that nodes can be compared at the same index.
+//
+// The index of a state loaded at startup or restored from a snapshot is only
+// known with the next applied entry. Raft replays the log after a start
+// without a snapshot onto the stored state, the digests of the replayed
+// indexes are only right from the last index applied before the start on.
+type Digests struct {
+	mu      sync.Mutex
+	current [sha256.Size]byte
+	// pending is true while the index of the current state is unknown
+	pending bool
+	history []Digest
+}
+
+func newDigests() *Digests {
+	return &Digests{pending: true}
+}
+
+func (d *Digests) toggle(key, value []byte) {
+	h := sha256.New()
+	_, _ = h.Write(key)
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write(value)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range d.current {
+		d.current[i] ^= sum[i]
+	}
+}
+
+// update replaces the old value of key, nil if it had none, with the new one,
+// nil if it was deleted.
+func (d *Digests) update(key, old, new []byte) {
+	if old != nil {
+		d.toggle(key, old)
+	}
+	if new != nil {
+		d.toggle(key, new)
+	}
+}
+
+// reset forgets the state and its history, before it is loaded anew.
+func (d *Digests) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.current = [sha256.Size]byte{}
+	d.pending = true
+	d.history = nil
+}
+
+// load adds every key of db to the digest.
+func (d *Digests) load(db *badger.DB) error {
+	return db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			err := item.Value(func(value []byte) error {
+				d.toggle(item.Key(), value)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// applying is called before the command at index is applied. The first
+// command after the state was loaded records the loaded state as the one of
+// the entry before, as only commands reach the FSM and nothing changed the
+// state up to it.
+func (d *Digests) applying(index uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if n := len(d.history); n > 0 && d.history[n-1].Index >= index {
+		// Keep the history ordered should an index come again
+		d.history = nil
+	}
+	if d.pending && index > 0 {
+		d.history = append(d.history, Digest{Index: index - 1, Digest: hex.EncodeToString(d.current[:])})
+	}
+	d.pending = false
+}
+
+// applied records the current digest as the one of index.
+func (d *Digests) applied(index uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.history = append(d.history, Digest{Index: index, Digest: hex.EncodeToString(d.current[:])})
+	if len(d.history) > digestHistory {
+		d.history = append([]Digest(nil), d.history[len(d.history)-digestHistory:]...)
+	}
+}
+
+// Latest returns the digest of the last applied command.
+func (d *Digests) Latest() (Digest, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.history) == 0 {
+		return Digest{}, false
+	}
+	return d.history[len(d.history)-1], true
+}
+
+// At returns the digest of the state at index. It is not known for indexes
+// after the last applied command or before the kept history.
+func (d *Digests) At(index uint64) (Digest, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := len(d.history)
+	if n == 0 || index < d.history[0].Index || index > d.history[n-1].Index {
+		return Digest{}, false
+	}
+	// The newest digest at or before index
+	i := sort.Search(n, func(i int) bool { return d.history[i].Index > index }) - 1
+	return Digest{Index: index, Digest: d.history[i].Digest}, true
+}
+
+// Range returns the indexes the digests are known for.
+func (d *Digests) Range() (uint64, uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.history) == 0 {
+		return 0, 0
+	}
+	return d.history[0].Index, d.history[len(d.history)-1].Index
+}
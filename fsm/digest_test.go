@@ -0,0 +1,142 @@
+package fsm
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+func openTestFSM(t *testing.T) RaftFSM {
+	t.Helper()
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return NewRaftFSM(db, hclog.NewNullLogger())
+}
+
+func apply(t *testing.T, f raft.FSM, index uint64, op, key string, value interface{}) {
+	t.Helper()
+	data, err := json.Marshal(CommandPayload{Operation: op, Key: key, Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, ok := f.Apply(&raft.Log{Index: index, Type: raft.LogCommand, Data: data}).(*ApplyResponse); !ok || resp.Error != nil {
+		t.Fatalf("error applying %s %s: %+v", op, key, resp)
+	}
+}
+
+func latest(t *testing.T, f RaftFSM) Digest {
+	t.Helper()
+	d, ok := f.Digests().Latest()
+	if !ok {
+		t.Fatal("no digest known")
+	}
+	return d
+}
+
+func TestDigestIndependentOfHistory(t *testing.T) {
+	a := openTestFSM(t)
+	apply(t, a, 1, "SET", "x", 1)
+	apply(t, a, 2, "SET", "y", "two")
+	apply(t, a, 3, "SET", "x", 3)
+
+	// Other writes in another order reaching the same state
+	b := openTestFSM(t)
+	apply(t, b, 1, "SET", "y", "two")
+	apply(t, b, 2, "SET", "z", true)
+	apply(t, b, 3, "SET", "x", 3)
+	apply(t, b, 4, "DELETE", "z", nil)
+	if latest(t, a).Digest != latest(t, b).Digest {
+		t.Fatalf("expected equal states to have the same digest, got %s and %s", latest(t, a).Digest, latest(t, b).Digest)
+	}
+
+	apply(t, b, 5, "SET", "x", 4)
+	if latest(t, a).Digest == latest(t, b).Digest {
+		t.Fatal("expected a changed value to change the digest")
+	}
+
+	empty := openTestFSM(t)
+	apply(t, empty, 1, "SET", "x", 1)
+	apply(t, empty, 2, "DELETE", "x", nil)
+	d, _ := empty.Digests().At(0)
+	if latest(t, empty).Digest != d.Digest {
+		t.Fatal("expected deleting every key to return to the digest of the empty state")
+	}
+}
+
+func TestDigestHistory(t *testing.T) {
+	f := openTestFSM(t)
+	if _, ok := f.Digests().Latest(); ok {
+		t.Fatal("expected no digest before the first command")
+	}
+
+	// Entries 3 and 4 are no commands, e.g. barriers
+	apply(t, f, 2, "SET", "x", 1)
+	apply(t, f, 5, "SET", "y", 2)
+	at2, _ := f.Digests().At(2)
+
+	if first, last := f.Digests().Range(); first != 1 || last != 5 {
+		t.Fatalf("expected digests of 1 to 5, got %d to %d", first, last)
+	}
+	for _, index := range []uint64{3, 4} {
+		if d, ok := f.Digests().At(index); !ok || d.Index != index || d.Digest != at2.Digest {
+			t.Fatalf("expected the digest of index 2 at %d, got %+v", index, d)
+		}
+	}
+	for _, index := range []uint64{0, 6} {
+		if d, ok := f.Digests().At(index); ok {
+			t.Fatalf("expected no digest at %d, got %+v", index, d)
+		}
+	}
+	if latest(t, f).Index != 5 {
+		t.Fatalf("expected the latest digest at 5, got %+v", latest(t, f))
+	}
+}
+
+func TestDigestAfterRestore(t *testing.T) {
+	source := openTestFSM(t)
+	apply(t, source, 1, "SET", "x", 1)
+	apply(t, source, 2, "SET", "y", map[string]interface{}{"nested": []interface{}{"a", 1.5}})
+
+	snap, err := source.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := raft.NewInmemSnapshotStore()
+	sink, err := store.Create(raft.SnapshotVersionMax, 2, 1, raft.Configuration{}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+
+	target := openTestFSM(t)
+	apply(t, target, 1, "SET", "other", 1)
+	_, rc, err := store.Open(sink.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Restore(rc); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := target.Digests().Latest(); ok {
+		t.Fatal("expected the index of the restored state to be unknown")
+	}
+
+	// The next command tells the index of the restored state
+	apply(t, source, 3, "SET", "z", 3)
+	apply(t, target, 3, "SET", "z", 3)
+	for _, index := range []uint64{2, 3} {
+		want, _ := source.Digests().At(index)
+		if got, ok := target.Digests().At(index); !ok || got != want {
+			t.Fatalf("expected digest %+v after the restore, got %+v", want, got)
+		}
+	}
+}
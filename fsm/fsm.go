@@ -1,24 +1,123 @@
 package fsm
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
-	"os"
 	"strings"
+	"time"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
 )
 
-type snapshotNoop struct{}
+// badgerSnapshot writes the key space as seen by a read transaction, which
+// Badger keeps consistent while new commands are applied, as a JSON array of
+// SET payloads.
+type badgerSnapshot struct {
+	txn *badger.Txn
+}
+
+func (s *badgerSnapshot) Persist(sink raft.SnapshotSink) error {
+	w := &countingWriter{w: sink}
+	if err := s.write(w); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	metrics.SetGauge([]string{"fsm", "snapshot", "size_bytes"}, float32(w.n))
+	return sink.Close()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (s *badgerSnapshot) write(w io.Writer) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+
+	it := s.txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	encoder := json.NewEncoder(w)
+	first := true
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		if err := encoder.Encode(CommandPayload{
+			Operation: "SET",
+			Key:       string(item.KeyCopy(nil)),
+			Value:     json.RawMessage(value),
+		}); err != nil {
+			return err
+		}
+	}
 
-func (s snapshotNoop) Persist(_ raft.SnapshotSink) error { return nil }
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+func (s *badgerSnapshot) Release() {
+	s.txn.Discard()
+}
+
+// Cluster metadata is replicated through the FSM like any other key. Its keys
+// start with a NUL byte so they cannot clash with the keys of clients.
+const metaPrefix = "\x00meta/"
+
+// NodeHTTPAddressKey is the key holding the HTTP address of a node.
+func NodeHTTPAddressKey(nodeID string) string {
+	return metaPrefix + "http_address/" + nodeID
+}
+
+// ShardMapKey is the key holding the shard map in raft group 0.
+func ShardMapKey() string {
+	return metaPrefix + "shard_map"
+}
+
+// ReplicationRoleKey is the key holding whether the cluster is a standby
+// replica or a primary.
+func ReplicationRoleKey() string {
+	return metaPrefix + "replication/role"
+}
+
+// ReplicationCheckpointKey is the key holding the raft index of the primary
+// a standby has applied up to.
+func ReplicationCheckpointKey() string {
+	return metaPrefix + "replication/checkpoint"
+}
 
-func (s snapshotNoop) Release() {}
+// PendingVoterKey is the key marking a node that joined as nonvoter to be
+// promoted by the autopilot once it is stable.
+func PendingVoterKey(nodeID string) string {
+	return metaPrefix + "pending_voter/" + nodeID
+}
 
-func newSnapshotNoop() (raft.FSMSnapshot, error) {
-	return &snapshotNoop{}, nil
+// IsMetaKey reports whether key is reserved for cluster metadata.
+func IsMetaKey(key string) bool {
+	return strings.HasPrefix(key, metaPrefix)
 }
 
 type CommandPayload struct {
@@ -32,6 +131,60 @@ type ApplyResponse struct {
 	Data  interface{}
 }
 
+// applyTimeout bounds how long applying a command waits to be enqueued.
+const applyTimeout = 5 * time.Second
+
+// ApplyCommand replicates a command and returns the error of applying it to
+// the FSM.
+func ApplyCommand(r *raft.Raft, payload CommandPayload) error {
+	return ApplyCommands(r, []CommandPayload{payload})
+}
+
+// ApplyCommands replicates commands in order without waiting for each one
+// before sending the next, and returns the first error.
+func ApplyCommands(r *raft.Raft, payloads []CommandPayload) error {
+	futures := make([]raft.ApplyFuture, 0, len(payloads))
+	for _, payload := range payloads {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		futures = append(futures, r.Apply(data, applyTimeout))
+	}
+
+	for _, f := range futures {
+		if err := f.Error(); err != nil {
+			return err
+		}
+		resp, ok := f.Response().(*ApplyResponse)
+		if !ok {
+			return fmt.Errorf("error response is not match apply response")
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+	}
+	return nil
+}
+
+// ReadMeta decodes the value stored under key into v, leaving v untouched
+// when the key does not exist.
+func ReadMeta(db *badger.DB, key string, v interface{}) error {
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, v)
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	return err
+}
+
 func (b badgerFSM) get(key string) (interface{}, error) {
 	var keyByte = []byte(key)
 	var data interface{}
@@ -81,37 +234,71 @@ func (b badgerFSM) set(key string, value interface{}) error {
 	}
 
 	txn := b.db.NewTransaction(true)
+	old, err := valueOf(txn, []byte(key))
+	if err != nil {
+		txn.Discard()
+		return err
+	}
 	err = txn.Set([]byte(key), data)
 	if err != nil {
 		txn.Discard()
 		return err
 	}
 
-	return txn.Commit()
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	b.digests.update([]byte(key), old, data)
+	return nil
 }
 
 func (b badgerFSM) delete(key string) error {
 	var keyByte = []byte(key)
 
 	txn := b.db.NewTransaction(true)
-	err := txn.Delete(keyByte)
+	old, err := valueOf(txn, keyByte)
+	if err != nil {
+		txn.Discard()
+		return err
+	}
+	err = txn.Delete(keyByte)
 	if err != nil {
 		return err
 	}
 
-	return txn.Commit()
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	b.digests.update(keyByte, old, nil)
+	return nil
+}
+
+// valueOf returns the stored value of key, nil if there is none.
+func valueOf(txn *badger.Txn, key []byte) ([]byte, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
 }
 
 func (b badgerFSM) Apply(log *raft.Log) interface{} {
 	switch log.Type {
 	case raft.LogCommand:
+		b.digests.applying(log.Index)
+		defer b.digests.applied(log.Index)
+
 		var payload = CommandPayload{}
 		if err := json.Unmarshal(log.Data, &payload); err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "error marshalling store payload %s\n", err.Error())
+			b.logger.Error("error unmarshalling store payload", "index", log.Index, "error", err)
 			return nil
 		}
 
 		op := strings.ToUpper(strings.TrimSpace(payload.Operation))
+		defer metrics.MeasureSinceWithLabels([]string{"fsm", "apply"}, time.Now(), []metrics.Label{{Name: "op", Value: op}})
 		switch op {
 		case "SET":
 			return &ApplyResponse{
@@ -133,35 +320,57 @@ func (b badgerFSM) Apply(log *raft.Log) interface{} {
 		}
 	}
 
-	_, _ = fmt.Fprintf(os.Stderr, "not raft log command type\n")
+	b.logger.Warn("not raft log command type", "index", log.Index)
 	return nil
 }
 
 func (b badgerFSM) Snapshot() (raft.FSMSnapshot, error) {
-	return newSnapshotNoop()
+	return &badgerSnapshot{txn: b.db.NewTransaction(false)}, nil
 }
 
 func (b badgerFSM) Restore(rClose io.ReadCloser) error {
 	defer func() {
 		if err := rClose.Close(); err != nil {
-			_, _ = fmt.Fprintf(os.Stdout, "[FINALLY RESTORE] close error %s\n", err.Error())
+			b.logger.Error("error closing snapshot", "error", err)
 		}
 	}()
 
-	_, _ = fmt.Fprintf(os.Stdout, "[START RESTORE] read all message from snapshot\n")
+	b.logger.Info("restoring snapshot")
 	var totalRestored int
 
-	decoder := json.NewDecoder(rClose)
+	// Snapshots of versions before they held the state are empty, the state
+	// of such a node is in its Badger directory only
+	r := bufio.NewReader(rClose)
+	if _, err := r.Peek(1); err == io.EOF {
+		b.logger.Warn("snapshot is empty, keeping the local state")
+		return nil
+	}
+
+	// The snapshot replaces the whole state
+	if err := b.db.DropAll(); err != nil {
+		b.logger.Error("error dropping current data", "error", err)
+		return err
+	}
+	b.digests.reset()
+
+	decoder := json.NewDecoder(r)
+
+	// read opening bracket
+	if _, err := decoder.Token(); err != nil {
+		b.logger.Error("error reading snapshot", "error", err)
+		return err
+	}
+
 	for decoder.More() {
 		var data = &CommandPayload{}
 		err := decoder.Decode(data)
 		if err != nil {
-			_, _ = fmt.Fprintf(os.Stdout, "[END RESTORE] error decode data %s\n", err.Error())
+			b.logger.Error("error decoding snapshot entry", "error", err)
 			return err
 		}
 
 		if err := b.set(data.Key, data.Value); err != nil {
-			_, _ = fmt.Fprintf(os.Stdout, "[END RESTORE] error persist data %s\n", err.Error())
+			b.logger.Error("error persisting snapshot entry", "key", data.Key, "error", err)
 			return err
 		}
 
@@ -171,21 +380,41 @@ func (b badgerFSM) Restore(rClose io.ReadCloser) error {
 	// read closing bracket
 	_, err := decoder.Token()
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stdout, "[END RESTORE] error %s\n", err.Error())
+		b.logger.Error("error reading snapshot", "error", err)
 		return err
 	}
 
-	_, _ = fmt.Fprintf(os.Stdout, "[END RESTORE] success restore %d messages in snapshot\n", totalRestored)
+	b.logger.Info("restored snapshot", "keys", totalRestored)
 	return nil
 }
 
+// RaftFSM is the raft.FSM of the store, which also keeps the rolling digests
+// of its state.
+type RaftFSM interface {
+	raft.FSM
+	Digests() *Digests
+}
+
 // raft.FSM implementation using badgerDB
 type badgerFSM struct {
-	db *badger.DB
+	db      *badger.DB
+	digests *Digests
+	logger  hclog.Logger
 }
 
-func NewRaftFSM(badgerDB *badger.DB) raft.FSM {
+func NewRaftFSM(badgerDB *badger.DB, logger hclog.Logger) RaftFSM {
+	digests := newDigests()
+	if err := digests.load(badgerDB); err != nil {
+		logger.Error("error computing state digest", "error", err)
+	}
 	return &badgerFSM{
-		db: badgerDB,
+		db:      badgerDB,
+		digests: digests,
+		logger:  logger,
 	}
 }
+
+// Digests returns the rolling digests of the state.
+func (b badgerFSM) Digests() *Digests {
+	return b.digests
+}
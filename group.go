@@ -0,0 +1,254 @@
+package main
+
+import (
+	"dpasswd/autopilot"
+	"dpasswd/backup"
+	"dpasswd/digest"
+	"dpasswd/events"
+	"dpasswd/fsm"
+	"dpasswd/logging"
+	"dpasswd/transport"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+// group is a raft group hosted by this node together with the stores it owns.
+// Group 0 keeps its data directly in the data directory, so that a node
+// without sharding keeps the layout it always had.
+type group struct {
+	id       int
+	dir      string
+	raft     *raft.Raft
+	db       *badger.DB
+	logDB    *raftboltdb.BoltStore
+	ssDB     raft.SnapshotStore
+	tracker  *transport.Tracker
+	tlsLayer *transport.TLSStreamLayer
+	faults   *transport.FaultyTransport
+	pilot    *autopilot.Autopilot
+	backups  *backup.Scheduler
+	digests  *fsm.Digests
+	checker  *digest.Checker
+	// closeServer stops the HTTP server of a group served through group 0
+	closeServer func()
+	logger      hclog.Logger
+}
+
+// openGroup starts raft group id, listening for raft RPCs on the raft port
+// plus id. Divergences found by comparing the state digests are published on
+// bus.
+func openGroup(id int, ipAddr string, bootstrap bool, bus *events.Bus) (*group, error) {
+	groupDir := dataDir
+	if id != 0 {
+		groupDir = path.Join(dataDir, fmt.Sprintf("group-%d", id))
+	}
+	groupLogger := func(subsystem string) hclog.Logger {
+		if id == 0 {
+			return loggers.Logger(subsystem)
+		}
+		return loggers.Logger(subsystem).With("group", id)
+	}
+
+	// Whatever is opened is closed again when a later step fails
+	var opened []io.Closer
+	fail := func(err error) (*group, error) {
+		for i := len(opened) - 1; i >= 0; i-- {
+			_ = opened[i].Close()
+		}
+		return nil, err
+	}
+
+	// Setup key-value database using badgerDB to be used as the FSM
+	badgerOpts := badger.DefaultOptions(groupDir).WithLogger(logging.BadgerLogger(groupLogger("badger")))
+	badgerDB, err := badger.Open(badgerOpts)
+	if err != nil {
+		return nil, err
+	}
+	opened = append(opened, badgerDB)
+	kvFSM := fsm.NewRaftFSM(badgerDB, groupLogger("fsm"))
+
+	// Setup raft server
+	logDB, err := raftboltdb.NewBoltStore(path.Join(groupDir, "log"))
+	if err != nil {
+		return fail(err)
+	}
+	opened = append(opened, logDB)
+
+	var raftLogCacheSize = 256
+	cacheDB, err := raft.NewLogCache(raftLogCacheSize, logDB)
+	if err != nil {
+		return fail(err)
+	}
+
+	var raftSnapShotRetain = 2
+	ssDB, err := raft.NewFileSnapshotStoreWithLogger(groupDir, raftSnapShotRetain, groupLogger("snapshot"))
+	if err != nil {
+		return fail(err)
+	}
+
+	var raftBindAddr = fmt.Sprintf("%s:%d", ipAddr, raftPort+id)
+	tcpAddr, err := net.ResolveTCPAddr("tcp", raftBindAddr)
+	if err != nil {
+		return fail(err)
+	}
+
+	var raftMaxPool = 5
+	var raftTcpTimeout = 5 * time.Second
+	var netTransport *raft.NetworkTransport
+	var tlsLayer *transport.TLSStreamLayer
+	if raftTLS.CAFile != "" || raftTLS.CertFile != "" || raftTLS.KeyFile != "" {
+		tlsCfg := raftTLS
+		tlsCfg.Logger = groupLogger("transport")
+		tlsLayer, err = transport.NewTLSStreamLayer(raftBindAddr, tcpAddr, tlsCfg)
+		if err != nil {
+			return fail(err)
+		}
+		netTransport = raft.NewNetworkTransportWithLogger(tlsLayer, raftMaxPool, raftTcpTimeout, groupLogger("transport"))
+	} else {
+		netTransport, err = raft.NewTCPTransportWithLogger(raftBindAddr, tcpAddr, raftMaxPool, raftTcpTimeout, groupLogger("transport"))
+		if err != nil {
+			return fail(err)
+		}
+	}
+	opened = append(opened, netTransport)
+
+	// Track replication progress of the peers for the stats endpoint
+	trans, faults := injectFaults(netTransport)
+	tracker := transport.NewTracker(trans)
+
+	// Every group needs its own copy, raft keeps a reference to it
+	groupCfg := *raftCfg
+	groupCfg.Logger = groupLogger("raft")
+	r, err := raft.NewRaft(&groupCfg, kvFSM, cacheDB, logDB, ssDB, tracker)
+	if err != nil {
+		return fail(err)
+	}
+
+	if tlsLayer != nil {
+		tlsLayer.SetPeers(func() []raft.Server {
+			return r.GetConfiguration().Configuration().Servers
+		})
+	}
+
+	// Start the raft server
+	if bootstrap {
+		r.BootstrapCluster(raft.Configuration{
+			Servers: []raft.Server{
+				{
+					ID:      raft.ServerID(nodeID),
+					Address: tracker.LocalAddr(),
+				},
+			},
+		})
+	}
+
+	var pilot *autopilot.Autopilot
+	if autopilotEnabled {
+		pilot = autopilot.New(r, badgerDB, tracker, autopilotCfg, groupLogger("autopilot"))
+		pilot.Start()
+	}
+
+	var backups *backup.Scheduler
+	if backupTarget != nil {
+		prefix := ""
+		if id != 0 {
+			prefix = fmt.Sprintf("group-%d-", id)
+		}
+		backups = backup.NewScheduler(r, ssDB, backup.SchedulerConfig{
+			Interval:    backupInterval,
+			Target:      backupTarget,
+			Retention:   backupRetention,
+			Key:         backupKey,
+			Prefix:      prefix,
+			NodeID:      nodeID,
+			Log:         logDB,
+			LogInterval: backupLogInterval,
+			Bus:         bus,
+			Group:       id,
+		}, groupLogger("backup"))
+		backups.Start()
+	}
+
+	var checker *digest.Checker
+	if digestCheckInterval > 0 {
+		checker = digest.NewChecker(r, badgerDB, kvFSM.Digests(), raft.ServerID(nodeID), bus, digest.Config{
+			Interval: digestCheckInterval,
+			Timeout:  10 * time.Second,
+			Group:    id,
+		}, groupLogger("digest"))
+		checker.Start()
+	}
+
+	return &group{
+		id:       id,
+		dir:      groupDir,
+		raft:     r,
+		db:       badgerDB,
+		logDB:    logDB,
+		ssDB:     ssDB,
+		tracker:  tracker,
+		tlsLayer: tlsLayer,
+		faults:   faults,
+		pilot:    pilot,
+		backups:  backups,
+		digests:  kvFSM.Digests(),
+		checker:  checker,
+		logger:   groupLogger("main"),
+	}, nil
+}
+
+// close hands the group over to the other nodes and closes its stores.
+func (g *group) close() {
+	r := g.raft
+	if leaveOnTerminate {
+		leaveCluster(g)
+	} else if r.State() == raft.Leader && r.Stats()["num_peers"] != "0" {
+		if err := r.LeadershipTransfer().Error(); err != nil {
+			g.logger.Error("error transferring leadership", "error", err)
+		}
+	}
+	g.shutdown()
+}
+
+// remove shuts the group down and deletes its data, for a group that no
+// other node knows about, like the new group of a failed split.
+func (g *group) remove() error {
+	g.shutdown()
+	return os.RemoveAll(g.dir)
+}
+
+func (g *group) shutdown() {
+	if g.closeServer != nil {
+		g.closeServer()
+	}
+	if g.pilot != nil {
+		g.pilot.Stop()
+	}
+	if g.backups != nil {
+		g.backups.Stop()
+	}
+	if g.checker != nil {
+		g.checker.Stop()
+	}
+
+	// Shutting down raft also closes the transport. The file snapshot store
+	// holds no open resources between snapshots.
+	if err := g.raft.Shutdown().Error(); err != nil {
+		g.logger.Error("error shutting down raft", "error", err)
+	}
+	if err := g.logDB.Close(); err != nil {
+		g.logger.Error("error closing raft log store", "error", err)
+	}
+	if err := g.db.Close(); err != nil {
+		g.logger.Error("error closing badgerDB", "error", err)
+	}
+}
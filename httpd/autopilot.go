@@ -0,0 +1,38 @@
+package httpd
+
+import (
+	"dpasswd/autopilot"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type autopilotHandler struct {
+	autopilot *autopilot.Autopilot
+}
+
+func NewAutopilotHandler(pilot *autopilot.Autopilot) *autopilotHandler {
+	return &autopilotHandler{
+		autopilot: pilot,
+	}
+}
+
+// Health reports the health of every server as the autopilot of the leader
+// last saw it, answering 503 while any server is unhealthy.
+func (ah autopilotHandler) Health(eCtx echo.Context) error {
+	state, err := ah.autopilot.State()
+	if err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+
+	status := http.StatusOK
+	if !state.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	return eCtx.JSON(status, map[string]interface{}{
+		"message": "autopilot server health",
+		"data":    state,
+	})
+}
@@ -0,0 +1,224 @@
+package httpd
+
+import (
+	"dpasswd/backup"
+	"dpasswd/fsm"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/labstack/echo/v4"
+)
+
+// restoreTimeout bounds how long a restore waits for raft to take it up.
+const restoreTimeout = time.Minute
+
+// backupHandler streams backups of the store and restores them.
+type backupHandler struct {
+	raft      *raft.Raft
+	db        *badger.DB
+	snapshots raft.SnapshotStore
+	nodeID    raft.ServerID
+	// key decrypts encrypted backups
+	key       []byte
+	scheduler *backup.Scheduler
+	logger    hclog.Logger
+}
+
+func NewBackupHandler(r *raft.Raft, db *badger.DB, snapshots raft.SnapshotStore, nodeID raft.ServerID, key []byte, scheduler *backup.Scheduler, logger hclog.Logger) *backupHandler {
+	return &backupHandler{
+		raft:      r,
+		db:        db,
+		snapshots: snapshots,
+		nodeID:    nodeID,
+		key:       key,
+		scheduler: scheduler,
+		logger:    logger,
+	}
+}
+
+// Backup takes a snapshot of the node and streams it as a backup. The
+// checksum of the snapshot is sent as trailer, as it is only known at the
+// end.
+func (bh backupHandler) Backup(eCtx echo.Context) error {
+	meta, snapshot, err := backup.Snapshot(bh.raft, bh.snapshots)
+	if err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error taking snapshot: %s", err.Error()),
+		})
+	}
+	defer func() {
+		if err := snapshot.Close(); err != nil {
+			bh.logger.Error("error closing snapshot", "id", meta.ID, "error", err)
+		}
+	}()
+
+	resp := eCtx.Response()
+	resp.Header().Set(echo.HeaderContentType, "application/gzip")
+	resp.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="dpasswd-backup-%d.tar.gz"`, meta.Index))
+	resp.Header().Set("X-Backup-Index", strconv.FormatUint(meta.Index, 10))
+	resp.Header().Set("X-Backup-Term", strconv.FormatUint(meta.Term, 10))
+	resp.Header().Set("Trailer", "X-Backup-Sha256")
+	resp.WriteHeader(http.StatusOK)
+
+	manifest, err := backup.Write(resp, string(bh.nodeID), meta, snapshot)
+	if err != nil {
+		// The status is sent already, the client sees a truncated archive
+		bh.logger.Error("error writing backup", "snapshot", meta.ID, "error", err)
+		return nil
+	}
+	resp.Header().Set("X-Backup-Sha256", manifest.SHA256)
+	bh.logger.Info("backup written", "snapshot", meta.ID, "index", meta.Index, "bytes", meta.Size)
+	return nil
+}
+
+// Restore replaces the state of the cluster with a backup. The leader takes
+// on the snapshot and sends it to every follower. As that overwrites the
+// data of the cluster, it is refused while client keys exist unless
+// "force=true" is given.
+func (bh backupHandler) Restore(eCtx echo.Context) error {
+	if bh.raft.State() != raft.Leader {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": "not the leader",
+		})
+	}
+
+	if force, _ := strconv.ParseBool(eCtx.QueryParam("force")); !force {
+		keys, err := countClientKeys(bh.db)
+		if err != nil {
+			return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"error": fmt.Sprintf("error listing keys: %s", err.Error()),
+			})
+		}
+		if keys > 0 {
+			return eCtx.JSON(http.StatusConflict, map[string]interface{}{
+				"error": fmt.Sprintf("the cluster holds %d keys, restore into a fresh cluster or pass force=true to replace them", keys),
+			})
+		}
+	}
+
+	b, err := backup.Read(eCtx.Request().Body, bh.key)
+	if err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("invalid backup: %s", err.Error()),
+		})
+	}
+	defer func() {
+		if err := b.Close(); err != nil {
+			bh.logger.Error("error removing restored snapshot", "error", err)
+		}
+	}()
+
+	// The metadata of the cluster describes its nodes, not the ones of the
+	// cluster the backup was taken from
+	meta, err := metaEntries(bh.db)
+	if err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error reading cluster metadata: %s", err.Error()),
+		})
+	}
+
+	data, err := b.Open()
+	if err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error reading backup: %s", err.Error()),
+		})
+	}
+	if err := bh.raft.Restore(b.Meta(), data, restoreTimeout); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error restoring backup: %s", err.Error()),
+		})
+	}
+	bh.logger.Info("backup restored", "snapshot", b.Manifest.SnapshotID, "index", b.Manifest.Index, "node", b.Manifest.NodeID)
+
+	if err := restoreMeta(bh.raft, bh.db, meta); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("backup restored, but restoring the cluster metadata failed: %s", err.Error()),
+			"data":  b.Manifest,
+		})
+	}
+
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("restored backup of index %d", b.Manifest.Index),
+		"data":    b.Manifest,
+	})
+}
+
+// Status reports the outcome of the scheduled backups. It answers 503 when
+// the last attempt failed.
+func (bh backupHandler) Status(eCtx echo.Context) error {
+	status := bh.scheduler.Status()
+	if !status.OK() {
+		return eCtx.JSON(http.StatusServiceUnavailable, map[string]interface{}{
+			"error": fmt.Sprintf("last backup failed: %s", status.LastError),
+			"data":  status,
+		})
+	}
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": "backups are healthy",
+		"data":    status,
+	})
+}
+
+func countClientKeys(db *badger.DB) (int, error) {
+	n := 0
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if !fsm.IsMetaKey(string(it.Item().Key())) {
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+func metaEntries(db *badger.DB) (map[string]json.RawMessage, error) {
+	entries := make(map[string]json.RawMessage)
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := string(it.Item().Key())
+			if !fsm.IsMetaKey(key) {
+				continue
+			}
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			entries[key] = value
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// restoreMeta puts back the metadata the cluster had before a restore and
+// deletes the metadata that came with the backup.
+func restoreMeta(r *raft.Raft, db *badger.DB, meta map[string]json.RawMessage) error {
+	restored, err := metaEntries(db)
+	if err != nil {
+		return err
+	}
+
+	var payloads []fsm.CommandPayload
+	for key := range restored {
+		if _, ok := meta[key]; !ok {
+			payloads = append(payloads, fsm.CommandPayload{Operation: "DELETE", Key: key})
+		}
+	}
+	for key, value := range meta {
+		payloads = append(payloads, fsm.CommandPayload{Operation: "SET", Key: key, Value: value})
+	}
+	return fsm.ApplyCommands(r, payloads)
+}
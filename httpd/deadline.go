@@ -0,0 +1,48 @@
+package httpd
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// ReadTimeout and WriteTimeout bound how long the server reads a request
+	// and takes to answer it, unless the route sets its own deadline.
+	ReadTimeout  = 5 * time.Second
+	WriteTimeout = 5 * time.Second
+)
+
+// connKey is the context key of the connection a request came in on.
+type connKey struct{}
+
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// extendDeadline lets the request read and write on its connection until d
+// from now instead of the server timeouts, without any deadline if d is 0.
+// The server sets the timeouts again for the next request on the connection.
+func extendDeadline(eCtx echo.Context, d time.Duration) {
+	conn, ok := eCtx.Request().Context().Value(connKey{}).(net.Conn)
+	if !ok {
+		return
+	}
+	var deadline time.Time
+	if d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	_ = conn.SetDeadline(deadline)
+}
+
+// withoutDeadline lifts the server timeouts for routes that stream bodies of
+// any size, like backups. It comes before the forwarding middleware, so that
+// proxied requests are not cut off either.
+func withoutDeadline(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(eCtx echo.Context) error {
+		extendDeadline(eCtx, 0)
+		return next(eCtx)
+	}
+}
@@ -0,0 +1,72 @@
+package httpd
+
+import (
+	"dpasswd/digest"
+	"dpasswd/fsm"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+type digestHandler struct {
+	digests *fsm.Digests
+	checker *digest.Checker
+}
+
+func NewDigestHandler(digests *fsm.Digests, checker *digest.Checker) *digestHandler {
+	return &digestHandler{
+		digests: digests,
+		checker: checker,
+	}
+}
+
+// Digest returns the digest of the state of this node at the index given by
+// "index", or at the last applied command. It answers 404 while the index is
+// not applied yet and 410 once it is older than the kept digests. Without an
+// index the leader adds the outcome of the last comparison with the other
+// members.
+func (dh digestHandler) Digest(eCtx echo.Context) error {
+	if eCtx.QueryParam("index") == "" {
+		latest, ok := dh.digests.Latest()
+		if !ok {
+			return eCtx.JSON(http.StatusNotFound, map[string]interface{}{
+				"error": "no command applied since the state was loaded",
+			})
+		}
+		resp := map[string]interface{}{
+			"message": fmt.Sprintf("state digest at index %d", latest.Index),
+			"data":    latest,
+		}
+		if dh.checker != nil {
+			if last := dh.checker.Last(); last != nil {
+				resp["last_check"] = last
+			}
+		}
+		return eCtx.JSON(http.StatusOK, resp)
+	}
+
+	index, err := strconv.ParseUint(eCtx.QueryParam("index"), 10, 64)
+	if err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("invalid index %s", eCtx.QueryParam("index")),
+		})
+	}
+	d, ok := dh.digests.At(index)
+	if !ok {
+		first, last := dh.digests.Range()
+		if last == 0 || index > last {
+			return eCtx.JSON(http.StatusNotFound, map[string]interface{}{
+				"error": fmt.Sprintf("index %d is not applied yet, the last applied command is at %d", index, last),
+			})
+		}
+		return eCtx.JSON(http.StatusGone, map[string]interface{}{
+			"error": fmt.Sprintf("digest of index %d is no longer kept, the oldest is of index %d", index, first),
+		})
+	}
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("state digest at index %d", d.Index),
+		"data":    d,
+	})
+}
@@ -0,0 +1,76 @@
+package httpd
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// drainer keeps track of the client requests in flight and, once draining,
+// rejects new ones so the node can be shut down without losing writes.
+type drainer struct {
+	mu       sync.Mutex
+	draining bool
+	inFlight int
+}
+
+func newDrainer() *drainer {
+	return &drainer{}
+}
+
+func (d *drainer) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(eCtx echo.Context) error {
+		d.mu.Lock()
+		if d.draining {
+			d.mu.Unlock()
+			return eCtx.JSON(http.StatusServiceUnavailable, map[string]interface{}{
+				"error": "node is draining",
+			})
+		}
+		d.inFlight++
+		d.mu.Unlock()
+
+		defer func() {
+			d.mu.Lock()
+			d.inFlight--
+			d.mu.Unlock()
+		}()
+
+		return next(eCtx)
+	}
+}
+
+func (d *drainer) start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.draining = true
+}
+
+func (d *drainer) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.draining = false
+}
+
+func (d *drainer) status() (draining bool, inFlight int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining, d.inFlight
+}
+
+// wait blocks until all requests in flight have finished or the timeout
+// expires, and reports whether there are none left.
+func (d *drainer) wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, inFlight := d.status(); inFlight == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
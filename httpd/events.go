@@ -0,0 +1,108 @@
+package httpd
+
+import (
+	"dpasswd/events"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type eventsHandler struct {
+	bus *events.Bus
+}
+
+func NewEventsHandler(bus *events.Bus) *eventsHandler {
+	return &eventsHandler{
+		bus: bus,
+	}
+}
+
+// Stream sends the events of this node as newline delimited JSON until the
+// client disconnects. "type" and "group" filter the events. The connection is
+// taken over from the HTTP server, whose write timeout would end the stream.
+func (eh eventsHandler) Stream(eCtx echo.Context) error {
+	types := make(map[string]bool)
+	for _, t := range strings.Split(eCtx.QueryParam("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	group := -1
+	if s := eCtx.QueryParam("group"); s != "" {
+		var err error
+		if group, err = strconv.Atoi(s); err != nil {
+			return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"error": fmt.Sprintf("invalid group %s", s),
+			})
+		}
+	}
+
+	eventCh, cancel := eh.bus.Subscribe()
+	defer cancel()
+
+	conn, rw, err := eCtx.Response().Hijack()
+	if err != nil {
+		return eCtx.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"error": fmt.Sprintf("error streaming events: %s", err.Error()),
+		})
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Time{})
+	eCtx.Response().Committed = true
+	eCtx.Response().Status = http.StatusOK
+
+	// The client sends nothing more, a read only returns once it is gone
+	closedCh := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, rw)
+		close(closedCh)
+	}()
+
+	header := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: application/x-ndjson\r\n" +
+		"Cache-Control: no-cache\r\n" +
+		"Transfer-Encoding: chunked\r\n" +
+		"Connection: close\r\n\r\n"
+	if _, err := rw.WriteString(header); err != nil {
+		return nil
+	}
+	if err := rw.Flush(); err != nil {
+		return nil
+	}
+
+	chunked := httputil.NewChunkedWriter(rw)
+	encoder := json.NewEncoder(chunked)
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e := <-eventCh:
+			if (len(types) > 0 && !types[e.Type]) || (group >= 0 && e.Group != group) {
+				continue
+			}
+			if err := encoder.Encode(e); err != nil {
+				return nil
+			}
+		case <-keepAlive.C:
+			// An empty line lets proxies and clients see the stream is alive
+			if _, err := chunked.Write([]byte("\n")); err != nil {
+				return nil
+			}
+		case <-closedCh:
+			return nil
+		}
+		if err := rw.Flush(); err != nil {
+			return nil
+		}
+	}
+}
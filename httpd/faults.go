@@ -0,0 +1,146 @@
+package httpd
+
+import (
+	"dpasswd/transport"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/labstack/echo/v4"
+)
+
+type faultsHandler struct {
+	faults *transport.FaultyTransport
+}
+type faultRequest struct {
+	Peer          string  `json:"peer"`
+	Drop          float64 `json:"drop"`
+	Delay         string  `json:"delay"`
+	Jitter        string  `json:"jitter"`
+	Duplicate     float64 `json:"duplicate"`
+	Reorder       float64 `json:"reorder"`
+	ReorderWindow string  `json:"reorder_window"`
+}
+type peerFaults struct {
+	Peer          string  `json:"peer"`
+	Drop          float64 `json:"drop"`
+	Delay         string  `json:"delay"`
+	Jitter        string  `json:"jitter"`
+	Duplicate     float64 `json:"duplicate"`
+	Reorder       float64 `json:"reorder"`
+	ReorderWindow string  `json:"reorder_window"`
+	Sent          uint64  `json:"sent"`
+	Dropped       uint64  `json:"dropped"`
+	Delayed       uint64  `json:"delayed"`
+	Duplicated    uint64  `json:"duplicated"`
+	Reordered     uint64  `json:"reordered"`
+}
+
+func NewFaultsHandler(faults *transport.FaultyTransport) *faultsHandler {
+	return &faultsHandler{
+		faults: faults,
+	}
+}
+
+// List shows the faults of the RPCs this node sends to each peer together
+// with what was done to them so far.
+func (fh faultsHandler) List(eCtx echo.Context) error {
+	faults, stats := fh.faults.Faults(), fh.faults.Stats()
+	peers := make([]peerFaults, 0)
+	for _, peer := range fh.faults.Peers() {
+		f, s := faults[peer], stats[peer]
+		peers = append(peers, peerFaults{
+			Peer:          string(peer),
+			Drop:          f.Drop,
+			Delay:         f.Delay.String(),
+			Jitter:        f.Jitter.String(),
+			Duplicate:     f.Duplicate,
+			Reorder:       f.Reorder,
+			ReorderWindow: f.ReorderWindow.String(),
+			Sent:          s.Sent,
+			Dropped:       s.Dropped,
+			Delayed:       s.Delayed,
+			Duplicated:    s.Duplicated,
+			Reordered:     s.Reordered,
+		})
+	}
+
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": "injected raft transport faults",
+		"data":    peers,
+	})
+}
+
+// Set replaces the fault of the RPCs this node sends to a peer.
+func (fh faultsHandler) Set(eCtx echo.Context) error {
+	var req = faultRequest{}
+	if err := eCtx.Bind(&req); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error binding: %s", err.Error()),
+		})
+	}
+
+	peer := strings.TrimSpace(req.Peer)
+	if peer == "" {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": "peer is empty",
+		})
+	}
+	for _, p := range []float64{req.Drop, req.Duplicate, req.Reorder} {
+		if p < 0 || p > 1 {
+			return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"error": fmt.Sprintf("invalid probability %v, must be between 0 and 1", p),
+			})
+		}
+	}
+
+	fault := transport.Fault{
+		Drop:      req.Drop,
+		Duplicate: req.Duplicate,
+		Reorder:   req.Reorder,
+	}
+	durations := []struct {
+		value string
+		into  *time.Duration
+	}{
+		{req.Delay, &fault.Delay},
+		{req.Jitter, &fault.Jitter},
+		{req.ReorderWindow, &fault.ReorderWindow},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil || parsed < 0 {
+			return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"error": fmt.Sprintf("invalid duration %s", d.value),
+			})
+		}
+		*d.into = parsed
+	}
+
+	fh.faults.SetFault(raft.ServerID(peer), fault)
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("fault of RPCs to %s set successfully", peer),
+	})
+}
+
+// Clear removes the fault of the peer given as query parameter, or of every
+// peer without one.
+func (fh faultsHandler) Clear(eCtx echo.Context) error {
+	peer := strings.TrimSpace(eCtx.QueryParam("peer"))
+	if peer == "" {
+		fh.faults.ClearAll()
+		return eCtx.JSON(http.StatusOK, map[string]interface{}{
+			"message": "all faults cleared successfully",
+		})
+	}
+
+	fh.faults.ClearFault(raft.ServerID(peer))
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("fault of RPCs to %s cleared successfully", peer),
+	})
+}
@@ -0,0 +1,171 @@
+package httpd
+
+import (
+	"dpasswd/fsm"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/labstack/echo/v4"
+)
+
+// ForwardMode selects what a follower does with requests only the leader can
+// serve.
+type ForwardMode string
+
+const (
+	// ForwardNone rejects the request with "not the leader"
+	ForwardNone ForwardMode = "none"
+	// ForwardProxy proxies the request to the leader
+	ForwardProxy ForwardMode = "proxy"
+	// ForwardRedirect answers with a 307 redirect to the leader
+	ForwardRedirect ForwardMode = "redirect"
+)
+
+func ParseForwardMode(mode string) (ForwardMode, error) {
+	switch m := ForwardMode(strings.ToLower(strings.TrimSpace(mode))); m {
+	case ForwardNone, ForwardProxy, ForwardRedirect:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown forward mode %s", mode)
+}
+
+// forwardedHeader marks proxied requests, so that a node which lost its
+// leadership in the meantime does not forward them again.
+const forwardedHeader = "X-Forwarded-By"
+
+type forwarder struct {
+	mode ForwardMode
+	raft *raft.Raft
+	db   *badger.DB
+}
+
+func newForwarder(mode ForwardMode, r *raft.Raft, db *badger.DB) *forwarder {
+	if mode == "" {
+		mode = ForwardNone
+	}
+	return &forwarder{
+		mode: mode,
+		raft: r,
+		db:   db,
+	}
+}
+
+// middleware forwards the requests of routes only the leader can serve. When
+// the request is not forwarded the handler rejects it as before.
+func (f *forwarder) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(eCtx echo.Context) error {
+		if f.mode == ForwardNone || f.raft.State() == raft.Leader || eCtx.Request().Header.Get(forwardedHeader) != "" {
+			return next(eCtx)
+		}
+
+		leaderAddr, err := leaderHTTPAddress(f.raft, f.db)
+		if err != nil || leaderAddr == "" {
+			return next(eCtx)
+		}
+
+		if f.mode == ForwardRedirect {
+			return eCtx.Redirect(http.StatusTemporaryRedirect, "http://"+leaderAddr+eCtx.Request().RequestURI)
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: leaderAddr})
+		proxy.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+			_ = eCtx.JSON(http.StatusBadGateway, map[string]interface{}{
+				"error": fmt.Sprintf("error forwarding request to leader at %s: %s", leaderAddr, err.Error()),
+			})
+		}
+		eCtx.Request().Header.Set(forwardedHeader, eCtx.Request().Host)
+		proxy.ServeHTTP(eCtx.Response(), eCtx.Request())
+		return nil
+	}
+}
+
+// readMiddleware forwards reads whose consistency level requires the leader.
+func (f *forwarder) readMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	forward := f.middleware(next)
+	return func(eCtx echo.Context) error {
+		switch strings.ToLower(strings.TrimSpace(eCtx.QueryParam("consistency"))) {
+		case "leader", "strong":
+			return forward(eCtx)
+		}
+		return next(eCtx)
+	}
+}
+
+// leaderHTTPAddress looks up the HTTP address the current leader registered
+// in the replicated metadata. It is empty when the leader is unknown.
+func leaderHTTPAddress(r *raft.Raft, db *badger.DB) (string, error) {
+	_, leaderID := r.LeaderWithID()
+	if leaderID == "" {
+		return "", nil
+	}
+	return nodeHTTPAddress(db, string(leaderID))
+}
+
+func nodeHTTPAddress(db *badger.DB, nodeID string) (string, error) {
+	var addr string
+	err := fsm.ReadMeta(db, fsm.NodeHTTPAddressKey(nodeID), &addr)
+	return addr, err
+}
+
+// registerHTTPAddress stores the HTTP address of this node in the replicated
+// metadata whenever it becomes the leader, as the first node of a cluster
+// never joins through /raft/join. It returns a func that stops it.
+func registerHTTPAddress(r *raft.Raft, db *badger.DB, nodeID raft.ServerID, httpAddr string, logger hclog.Logger) func() {
+	register := func() {
+		if current, err := nodeHTTPAddress(db, string(nodeID)); err == nil && current == httpAddr {
+			return
+		}
+		if err := fsm.ApplyCommand(r, fsm.CommandPayload{
+			Operation: "SET",
+			Key:       fsm.NodeHTTPAddressKey(string(nodeID)),
+			Value:     httpAddr,
+		}); err != nil {
+			logger.Error("error registering HTTP address", "node", nodeID, "error", err)
+		}
+	}
+
+	return whenLeader(r, register)
+}
+
+// whenLeader runs fn in the background now if this node is the leader, and
+// every time it becomes the leader, until the returned func is called.
+func whenLeader(r *raft.Raft, fn func()) func() {
+	obsCh := make(chan raft.Observation, 1)
+	observer := raft.NewObserver(obsCh, false, func(o *raft.Observation) bool {
+		_, ok := o.Data.(raft.LeaderObservation)
+		return ok
+	})
+	r.RegisterObserver(observer)
+
+	stopCh := make(chan struct{})
+	go func() {
+		if r.State() == raft.Leader {
+			fn()
+		}
+		for {
+			select {
+			case <-obsCh:
+				if r.State() == raft.Leader {
+					fn()
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.DeregisterObserver(observer)
+			close(stopCh)
+		})
+	}
+}
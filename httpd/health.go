@@ -0,0 +1,124 @@
+package httpd
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/raft"
+	"github.com/labstack/echo/v4"
+)
+
+// defaultReadyMaxLag is how many committed entries a node may not have applied
+// yet and still be ready.
+const defaultReadyMaxLag = 100
+
+// healthHandler answers the probes of load balancers and orchestrators.
+type healthHandler struct {
+	raft   *raft.Raft
+	db     *badger.DB
+	nodeID raft.ServerID
+	drain  *drainer
+}
+
+type healthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func NewHealthHandler(r *raft.Raft, db *badger.DB, nodeID raft.ServerID, drain *drainer) *healthHandler {
+	return &healthHandler{
+		raft:   r,
+		db:     db,
+		nodeID: nodeID,
+		drain:  drain,
+	}
+}
+
+// Healthz reports whether the process can serve at all: raft is running and
+// Badger is open.
+func (hh healthHandler) Healthz(eCtx echo.Context) error {
+	checks := []healthCheck{
+		check("raft", hh.raft.State() != raft.Shutdown, "raft is shut down"),
+		check("badger", !hh.db.IsClosed(), "badger is closed"),
+	}
+	return respondChecks(eCtx, "node is healthy", checks)
+}
+
+// Readyz reports whether the node should receive client traffic: it is part
+// of the cluster, knows the leader and has applied what was committed. With
+// "leader=true" it is only ready while it is the leader, for routing writes.
+// "max_lag" overrides how many committed entries may be left to apply.
+func (hh healthHandler) Readyz(eCtx echo.Context) error {
+	maxLag := uint64(defaultReadyMaxLag)
+	if s := strings.TrimSpace(eCtx.QueryParam("max_lag")); s != "" {
+		var err error
+		if maxLag, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"error": fmt.Sprintf("invalid max_lag: %s", s),
+			})
+		}
+	}
+
+	draining, _ := hh.drain.status()
+	checks := []healthCheck{
+		check("badger", !hh.db.IsClosed(), "badger is closed"),
+		check("draining", !draining, "node is draining"),
+		hh.checkMember(),
+	}
+
+	_, leaderID := hh.raft.LeaderWithID()
+	checks = append(checks, check("leader", leaderID != "", "no leader is known"))
+
+	commitIndex, _ := strconv.ParseUint(hh.raft.Stats()["commit_index"], 10, 64)
+	appliedIndex := hh.raft.AppliedIndex()
+	var lag uint64
+	if commitIndex > appliedIndex {
+		lag = commitIndex - appliedIndex
+	}
+	checks = append(checks, check("applied", lag <= maxLag,
+		fmt.Sprintf("applied index %d is %d entries behind commit index %d", appliedIndex, lag, commitIndex)))
+
+	if leaderOnly, _ := strconv.ParseBool(eCtx.QueryParam("leader")); leaderOnly {
+		checks = append(checks, check("is_leader", hh.raft.State() == raft.Leader, "not the leader"))
+	}
+
+	return respondChecks(eCtx, "node is ready", checks)
+}
+
+func (hh healthHandler) checkMember() healthCheck {
+	for _, srv := range hh.raft.GetConfiguration().Configuration().Servers {
+		if srv.ID == hh.nodeID {
+			return check("member", true, "")
+		}
+	}
+	return check("member", false, fmt.Sprintf("node %s is not in the raft configuration", hh.nodeID))
+}
+
+func check(name string, ok bool, reason string) healthCheck {
+	c := healthCheck{Name: name, OK: ok}
+	if !ok {
+		c.Reason = reason
+	}
+	return c
+}
+
+// respondChecks answers 503 with the reason of the first failing check, all
+// checks are listed in "data".
+func respondChecks(eCtx echo.Context, message string, checks []healthCheck) error {
+	for _, c := range checks {
+		if !c.OK {
+			return eCtx.JSON(http.StatusServiceUnavailable, map[string]interface{}{
+				"error": c.Reason,
+				"data":  checks,
+			})
+		}
+	}
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": message,
+		"data":    checks,
+	})
+}
@@ -1,33 +1,79 @@
 package httpd
 
 import (
+	"context"
+	"dpasswd/autopilot"
+	"dpasswd/backup"
+	"dpasswd/digest"
+	"dpasswd/events"
 	"dpasswd/fsm"
+	"dpasswd/logging"
+	"dpasswd/metrics"
+	"dpasswd/replication"
+	"dpasswd/transport"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/raft"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
 type raftHandler struct {
-	raft *raft.Raft
+	raft    *raft.Raft
+	config  *raft.Config
+	db      *badger.DB
+	tracker *transport.Tracker
+	drain   *drainer
+	// pilot promotes servers joining as voters once they are stable
+	pilot *autopilot.Autopilot
 }
 type raftJoinRequest struct {
 	NodeID      string `json:"node_id"`
 	RaftAddress string `json:"raft_address"`
+	HTTPAddress string `json:"http_address"`
 }
 type raftRemoveRequest struct {
 	NodeID string `json:"node_id"`
 }
+type raftSuffrageRequest struct {
+	NodeID string `json:"node_id"`
+}
+type raftLeadershipTransferRequest struct {
+	NodeID string `json:"node_id"`
+}
+type raftDrainStatus struct {
+	Draining         bool   `json:"draining"`
+	InFlight         int    `json:"in_flight"`
+	State            string `json:"state"`
+	ReadyForShutdown bool   `json:"ready_for_shutdown"`
+}
+type raftMember struct {
+	ID          string     `json:"id"`
+	RaftAddress string     `json:"raft_address"`
+	HTTPAddress string     `json:"http_address,omitempty"`
+	Suffrage    string     `json:"suffrage"`
+	Leader      bool       `json:"leader"`
+	LastContact *time.Time `json:"last_contact,omitempty"`
+	MatchIndex  *uint64    `json:"match_index,omitempty"`
+	CommitLag   *uint64    `json:"commit_lag,omitempty"`
+	Lag         *uint64    `json:"replication_lag,omitempty"`
+}
 
-func NewRaftHandler(raft *raft.Raft) *raftHandler {
+func NewRaftHandler(raft *raft.Raft, config *raft.Config, db *badger.DB, tracker *transport.Tracker, drain *drainer, pilot *autopilot.Autopilot) *raftHandler {
 	return &raftHandler{
-		raft: raft,
+		raft:    raft,
+		config:  config,
+		db:      db,
+		tracker: tracker,
+		drain:   drain,
+		pilot:   pilot,
 	}
 }
 
@@ -52,13 +98,57 @@ func (rh raftHandler) Join(eCtx echo.Context) error {
 		})
 	}
 
-	f := rh.raft.AddVoter(raft.ServerID(req.NodeID), raft.ServerAddress(req.RaftAddress), 0, 0)
+	var f raft.IndexFuture
+	pendingVoter := false
+	switch suffrage := strings.ToLower(strings.TrimSpace(eCtx.QueryParam("suffrage"))); suffrage {
+	case "", "voter":
+		if rh.pilot != nil {
+			// The autopilot promotes the server once it has caught up and
+			// stayed healthy, so it cannot weaken the quorum before
+			pendingVoter = true
+			f = rh.raft.AddNonvoter(raft.ServerID(req.NodeID), raft.ServerAddress(req.RaftAddress), 0, 0)
+			break
+		}
+		f = rh.raft.AddVoter(raft.ServerID(req.NodeID), raft.ServerAddress(req.RaftAddress), 0, 0)
+	case "nonvoter":
+		f = rh.raft.AddNonvoter(raft.ServerID(req.NodeID), raft.ServerAddress(req.RaftAddress), 0, 0)
+	default:
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("unknown suffrage %s", suffrage),
+		})
+	}
 	if f.Error() != nil {
 		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
-			"error": fmt.Sprintf("error add voter: %s", f.Error().Error()),
+			"error": fmt.Sprintf("error add server: %s", f.Error().Error()),
 		})
 	}
 
+	if pendingVoter {
+		err := fsm.ApplyCommand(rh.raft, fsm.CommandPayload{
+			Operation: "SET",
+			Key:       fsm.PendingVoterKey(req.NodeID),
+			Value:     true,
+		})
+		if err != nil {
+			return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"error": fmt.Sprintf("error marking node %s as pending voter: %s", req.NodeID, err.Error()),
+			})
+		}
+	}
+
+	if req.HTTPAddress != "" {
+		err := fsm.ApplyCommand(rh.raft, fsm.CommandPayload{
+			Operation: "SET",
+			Key:       fsm.NodeHTTPAddressKey(req.NodeID),
+			Value:     req.HTTPAddress,
+		})
+		if err != nil {
+			return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"error": fmt.Sprintf("error storing HTTP address of node %s: %s", req.NodeID, err.Error()),
+			})
+		}
+	}
+
 	return eCtx.JSON(http.StatusOK, map[string]interface{}{
 		"message": fmt.Sprintf("node %s at %s joined successfully", req.NodeID, req.RaftAddress),
 		"data":    rh.raft.Stats(),
@@ -91,32 +181,360 @@ func (rh raftHandler) Remove(eCtx echo.Context) error {
 			"error": fmt.Sprintf("error removing existing node %s: %s", req.NodeID, err.Error()),
 		})
 	}
+	if rh.tracker != nil {
+		rh.tracker.Forget(raft.ServerID(req.NodeID))
+	}
+	if rh.pilot != nil {
+		if err := fsm.ApplyCommand(rh.raft, fsm.CommandPayload{Operation: "DELETE", Key: fsm.PendingVoterKey(req.NodeID)}); err != nil {
+			return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"error": fmt.Sprintf("error clearing pending voter %s: %s", req.NodeID, err.Error()),
+			})
+		}
+	}
+
+	err := fsm.ApplyCommand(rh.raft, fsm.CommandPayload{
+		Operation: "DELETE",
+		Key:       fsm.NodeHTTPAddressKey(req.NodeID),
+	})
+	if err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error removing HTTP address of node %s: %s", req.NodeID, err.Error()),
+		})
+	}
 
 	return eCtx.JSON(http.StatusOK, map[string]interface{}{
 		"message": fmt.Sprintf("node %s removed successfully", req.NodeID),
 		"data":    rh.raft.Stats(),
 	})
 }
+func (rh raftHandler) Promote(eCtx echo.Context) error {
+	var req = raftSuffrageRequest{}
+	if err := eCtx.Bind(&req); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error binding: %s", err.Error()),
+		})
+	}
+
+	if rh.raft.State() != raft.Leader {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": "not the leader",
+		})
+	}
+
+	configFuture := rh.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("failed to get raft configuration: %s", err.Error()),
+		})
+	}
+
+	var server *raft.Server
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == raft.ServerID(req.NodeID) {
+			server = &srv
+			break
+		}
+	}
+	if server == nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("node %s is not a member of the cluster", req.NodeID),
+		})
+	}
+	if server.Suffrage == raft.Voter {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("node %s is already a voter", req.NodeID),
+		})
+	}
+
+	// AddVoter on an existing nonvoter promotes it once it has caught up
+	f := rh.raft.AddVoter(server.ID, server.Address, 0, 0)
+	if err := f.Error(); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error promoting node %s: %s", req.NodeID, err.Error()),
+		})
+	}
+
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("node %s promoted to voter successfully", req.NodeID),
+		"data":    rh.raft.Stats(),
+	})
+}
+func (rh raftHandler) Demote(eCtx echo.Context) error {
+	var req = raftSuffrageRequest{}
+	if err := eCtx.Bind(&req); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error binding: %s", err.Error()),
+		})
+	}
+
+	if rh.raft.State() != raft.Leader {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": "not the leader",
+		})
+	}
+
+	f := rh.raft.DemoteVoter(raft.ServerID(req.NodeID), 0, 0)
+	if err := f.Error(); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error demoting node %s: %s", req.NodeID, err.Error()),
+		})
+	}
+
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("node %s demoted to nonvoter successfully", req.NodeID),
+		"data":    rh.raft.Stats(),
+	})
+}
+func (rh raftHandler) LeadershipTransfer(eCtx echo.Context) error {
+	var req = raftLeadershipTransferRequest{}
+	if err := eCtx.Bind(&req); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error binding: %s", err.Error()),
+		})
+	}
+
+	if rh.raft.State() != raft.Leader {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": "not the leader",
+		})
+	}
+
+	if err := rh.transferLeadership(req.NodeID); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error transferring leadership: %s", err.Error()),
+		})
+	}
+
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": "leadership transferred successfully",
+		"data":    rh.raft.Stats(),
+	})
+}
+
+// transferLeadership hands leadership over to the given voter, or to the most
+// up to date voter when nodeID is empty.
+func (rh raftHandler) transferLeadership(nodeID string) error {
+	if nodeID == "" {
+		return rh.raft.LeadershipTransfer().Error()
+	}
+
+	configFuture := rh.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return fmt.Errorf("failed to get raft configuration: %s", err.Error())
+	}
+
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID != raft.ServerID(nodeID) {
+			continue
+		}
+		if srv.Suffrage != raft.Voter {
+			return fmt.Errorf("node %s is not a voter", nodeID)
+		}
+		return rh.raft.LeadershipTransferToServer(srv.ID, srv.Address).Error()
+	}
+
+	return fmt.Errorf("node %s is not a member of the cluster", nodeID)
+}
+
+// Drain stops accepting client requests, moves leadership away from this node
+// and waits for the requests in flight to finish, so the node can be stopped.
+func (rh raftHandler) Drain(eCtx echo.Context) error {
+	var timeout = 30 * time.Second
+	if t := strings.TrimSpace(eCtx.QueryParam("timeout")); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"error": fmt.Sprintf("invalid timeout: %s", err.Error()),
+			})
+		}
+		timeout = d
+	}
+	// The response is sent once the wait is over, past the write timeout
+	extendDeadline(eCtx, timeout+WriteTimeout)
+
+	deadline := time.Now().Add(timeout)
+	rh.drain.start()
+
+	if rh.raft.State() == raft.Leader {
+		if err := rh.transferLeadership(""); err != nil {
+			return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"error": fmt.Sprintf("error transferring leadership: %s", err.Error()),
+				"data":  rh.drainStatus(),
+			})
+		}
+
+		// The transfer completes before this node has noticed the new term
+		for rh.raft.State() == raft.Leader && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	if !rh.drain.wait(time.Until(deadline)) || !rh.drainStatus().ReadyForShutdown {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": "timed out waiting for the node to drain",
+			"data":  rh.drainStatus(),
+		})
+	}
+
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": "node drained successfully",
+		"data":    rh.drainStatus(),
+	})
+}
+func (rh raftHandler) DrainStatus(eCtx echo.Context) error {
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": "drain status",
+		"data":    rh.drainStatus(),
+	})
+}
+func (rh raftHandler) Undrain(eCtx echo.Context) error {
+	rh.drain.stop()
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": "node accepts requests again",
+		"data":    rh.drainStatus(),
+	})
+}
+
+func (rh raftHandler) drainStatus() raftDrainStatus {
+	draining, inFlight := rh.drain.status()
+	state := rh.raft.State()
+	return raftDrainStatus{
+		Draining:         draining,
+		InFlight:         inFlight,
+		State:            state.String(),
+		ReadyForShutdown: draining && inFlight == 0 && state != raft.Leader,
+	}
+}
 func (rh raftHandler) Stats(eCtx echo.Context) error {
+	configFuture := rh.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("failed to get raft configuration: %s", err.Error()),
+		})
+	}
+
 	return eCtx.JSON(http.StatusOK, map[string]interface{}{
 		"message": "raft cluster status",
 		"data":    rh.raft.Stats(),
+		"servers": rh.members(configFuture.Configuration()),
+		"config":  rh.effectiveConfig(),
 	})
 }
 
+// effectiveConfig reports the timing parameters the node runs with. The
+// reloadable ones are read back from raft.
+func (rh raftHandler) effectiveConfig() map[string]interface{} {
+	if rh.config == nil {
+		return nil
+	}
+
+	reloadable := rh.raft.ReloadableConfig()
+	return map[string]interface{}{
+		"heartbeat_timeout":    rh.config.HeartbeatTimeout.String(),
+		"election_timeout":     rh.config.ElectionTimeout.String(),
+		"commit_timeout":       rh.config.CommitTimeout.String(),
+		"leader_lease_timeout": rh.config.LeaderLeaseTimeout.String(),
+		"max_append_entries":   rh.config.MaxAppendEntries,
+		"snapshot_interval":    reloadable.SnapshotInterval.String(),
+		"snapshot_threshold":   reloadable.SnapshotThreshold,
+		"trailing_logs":        reloadable.TrailingLogs,
+	}
+}
+
+func (rh raftHandler) Members(eCtx echo.Context) error {
+	configFuture := rh.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("failed to get raft configuration: %s", err.Error()),
+		})
+	}
+
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": "raft cluster members",
+		"data":    rh.members(configFuture.Configuration()),
+	})
+}
+
+// members describes every server in the configuration. The replication
+// progress of the other servers is only known while we are the leader, a
+// follower only knows when it last heard from the leader.
+func (rh raftHandler) members(cfg raft.Configuration) []raftMember {
+	_, leaderID := rh.raft.LeaderWithID()
+	isLeader := rh.raft.State() == raft.Leader
+	lastIndex := rh.raft.LastIndex()
+	commitIndex, _ := strconv.ParseUint(rh.raft.Stats()["commit_index"], 10, 64)
+
+	lag := func(index, matchIndex uint64) *uint64 {
+		var lag uint64
+		if index > matchIndex {
+			lag = index - matchIndex
+		}
+		return &lag
+	}
+
+	members := make([]raftMember, 0, len(cfg.Servers))
+	for _, srv := range cfg.Servers {
+		member := raftMember{
+			ID:          string(srv.ID),
+			RaftAddress: string(srv.Address),
+			Suffrage:    srv.Suffrage.String(),
+			Leader:      srv.ID == leaderID,
+		}
+		if httpAddr, err := nodeHTTPAddress(rh.db, string(srv.ID)); err == nil {
+			member.HTTPAddress = httpAddr
+		}
+
+		switch {
+		case isLeader && srv.ID == leaderID:
+			matchIndex := lastIndex
+			member.MatchIndex = &matchIndex
+			member.CommitLag = lag(commitIndex, matchIndex)
+			member.Lag = lag(lastIndex, matchIndex)
+		case isLeader && rh.tracker != nil:
+			if p, ok := rh.tracker.Progress(srv.ID); ok {
+				matchIndex, lastContact := p.MatchIndex, p.LastContact
+				member.MatchIndex = &matchIndex
+				member.CommitLag = lag(commitIndex, matchIndex)
+				member.Lag = lag(lastIndex, matchIndex)
+				member.LastContact = &lastContact
+			}
+		case !isLeader && srv.ID == leaderID:
+			if lastContact := rh.raft.LastContact(); !lastContact.IsZero() {
+				member.LastContact = &lastContact
+			}
+		}
+
+		members = append(members, member)
+	}
+
+	return members
+}
+
+// consistencyTokenHeader carries the raft index of a write in its response,
+// and in a read the index the serving node has to have applied first.
+const consistencyTokenHeader = "X-Consistency-Token"
+
+// defaultConsistencyTokenTimeout leaves a read that waited in vain the time to
+// send its error within the write timeout.
+const defaultConsistencyTokenTimeout = 2 * time.Second
+
 type fsmHandler struct {
-	raft *raft.Raft
-	db   *badger.DB
+	raft         *raft.Raft
+	db           *badger.DB
+	digests      *fsm.Digests
+	tokenTimeout time.Duration
 }
 type fsmSetRequest struct {
 	Key   string      `json:"key"`
 	Value interface{} `json:"value"`
 }
 
-func NewFSMHandler(raft *raft.Raft, db *badger.DB) *fsmHandler {
+func NewFSMHandler(raft *raft.Raft, db *badger.DB, digests *fsm.Digests, tokenTimeout time.Duration) *fsmHandler {
 	return &fsmHandler{
-		raft: raft,
-		db:   db,
+		raft:         raft,
+		db:           db,
+		digests:      digests,
+		tokenTimeout: tokenTimeout,
 	}
 }
 
@@ -134,6 +552,11 @@ func (fh fsmHandler) Set(eCtx echo.Context) error {
 			"error": "key is empty",
 		})
 	}
+	if fsm.IsMetaKey(req.Key) {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": "key is reserved",
+		})
+	}
 
 	if fh.raft.State() != raft.Leader {
 		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
@@ -168,9 +591,11 @@ func (fh fsmHandler) Set(eCtx echo.Context) error {
 		})
 	}
 
+	eCtx.Response().Header().Set(consistencyTokenHeader, strconv.FormatUint(applyFuture.Index(), 10))
 	return eCtx.JSON(http.StatusOK, map[string]interface{}{
-		"message": "data stored successfully",
-		"data":    req,
+		"message":           "data stored successfully",
+		"data":              req,
+		"consistency_token": applyFuture.Index(),
 	})
 }
 func (fh fsmHandler) Get(eCtx echo.Context) error {
@@ -180,6 +605,22 @@ func (fh fsmHandler) Get(eCtx echo.Context) error {
 			"error": "key is empty",
 		})
 	}
+	if fsm.IsMetaKey(key) {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": "key is reserved",
+		})
+	}
+
+	if err := fh.checkConsistency(eCtx); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	if err := fh.waitForToken(eCtx); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
 
 	var keyByte = []byte(key)
 
@@ -226,6 +667,101 @@ func (fh fsmHandler) Get(eCtx echo.Context) error {
 		},
 	})
 }
+
+// checkConsistency verifies that this node may serve a read at the consistency
+// level selected by the "consistency" query parameter:
+//   - stale (default): any node, including nonvoters, serves from its local
+//     state; "max_stale" bounds how long ago a follower heard from the leader
+//   - leader: only the node that believes it is the leader serves the read
+//   - strong: the leader first confirms with a quorum that it still leads
+func (fh fsmHandler) checkConsistency(eCtx echo.Context) error {
+	switch level := strings.ToLower(strings.TrimSpace(eCtx.QueryParam("consistency"))); level {
+	case "", "stale":
+		maxStale := strings.TrimSpace(eCtx.QueryParam("max_stale"))
+		if maxStale == "" || fh.raft.State() == raft.Leader {
+			return nil
+		}
+		d, err := time.ParseDuration(maxStale)
+		if err != nil {
+			return fmt.Errorf("invalid max_stale: %s", err.Error())
+		}
+		if last := fh.raft.LastContact(); last.IsZero() || time.Since(last) > d {
+			return fmt.Errorf("node is more than %s stale", d)
+		}
+		return nil
+	case "leader":
+		if fh.raft.State() != raft.Leader {
+			return fmt.Errorf("not the leader")
+		}
+		return nil
+	case "strong":
+		if fh.raft.State() != raft.Leader {
+			return fmt.Errorf("not the leader")
+		}
+		if err := fh.raft.VerifyLeader().Error(); err != nil {
+			return fmt.Errorf("error verifying leadership: %s", err.Error())
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown consistency level %s", level)
+	}
+}
+
+// waitForToken holds a read carrying a consistency token until this node has
+// applied the write the token was returned for, so that a client reads its
+// own writes from any node. It gives up after the token timeout.
+func (fh fsmHandler) waitForToken(eCtx echo.Context) error {
+	header := strings.TrimSpace(eCtx.Request().Header.Get(consistencyTokenHeader))
+	if header == "" {
+		return nil
+	}
+	token, err := strconv.ParseUint(header, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid consistency token %s", header)
+	}
+	if fh.applied(token) {
+		return nil
+	}
+
+	timeout := fh.tokenTimeout
+	if timeout <= 0 {
+		timeout = defaultConsistencyTokenTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for !fh.applied(token) {
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			return fmt.Errorf("node has applied index %d, not reaching consistency token %d within %s", fh.raft.AppliedIndex(), token, timeout)
+		case <-eCtx.Request().Context().Done():
+			return eCtx.Request().Context().Err()
+		}
+	}
+	return nil
+}
+
+// applied reports whether the FSM applied the command at index. Raft counts
+// an entry as applied once it is handed to the FSM, so the last command the
+// FSM applied is checked as well. Until the FSM applies a command after the
+// state was loaded or restored, only the commands of the last snapshot are
+// known to be applied.
+func (fh fsmHandler) applied(index uint64) bool {
+	if fh.raft.AppliedIndex() < index {
+		return false
+	}
+	if fh.digests == nil {
+		return true
+	}
+	if latest, ok := fh.digests.Latest(); ok {
+		return latest.Index >= index
+	}
+	snapshotIndex, _ := strconv.ParseUint(fh.raft.Stats()["last_snapshot_index"], 10, 64)
+	return snapshotIndex >= index
+}
+
 func (fh fsmHandler) Delete(eCtx echo.Context) error {
 	var key = strings.TrimSpace(eCtx.Param("key"))
 	if key == "" {
@@ -233,6 +769,11 @@ func (fh fsmHandler) Delete(eCtx echo.Context) error {
 			"error": "key is empty",
 		})
 	}
+	if fsm.IsMetaKey(key) {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": "key is reserved",
+		})
+	}
 
 	if fh.raft.State() != raft.Leader {
 		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
@@ -267,12 +808,14 @@ func (fh fsmHandler) Delete(eCtx echo.Context) error {
 		})
 	}
 
+	eCtx.Response().Header().Set(consistencyTokenHeader, strconv.FormatUint(applyFuture.Index(), 10))
 	return eCtx.JSON(http.StatusOK, map[string]interface{}{
 		"message": "data removed successfully",
 		"data": map[string]interface{}{
 			"key":   key,
 			"value": nil,
 		},
+		"consistency_token": applyFuture.Index(),
 	})
 }
 
@@ -280,35 +823,338 @@ type httpServer struct {
 	listenAddress string
 	raft          *raft.Raft
 	echo          *echo.Echo
+	server        *http.Server
+	// stops ends the background work started for the server
+	stops []func()
+}
+
+// Router hands requests owned by another raft group hosted by this node to the
+// handler of that group, and serves the /shard admin endpoints.
+type Router interface {
+	http.Handler
+	// Route returns the handler of the owning group, or nil when this server
+	// owns the request. A non-nil error is answered with the given status,
+	// otherwise done is called once the request is served.
+	Route(req *http.Request) (handler http.Handler, done func(), status int, err error)
+}
+
+type serverOptions struct {
+	router       Router
+	raftConfig   *raft.Config
+	tracker      *transport.Tracker
+	forwardMode  ForwardMode
+	nodeID       raft.ServerID
+	httpAddr     string
+	source       *replication.Source
+	standby      bool
+	metrics      *metrics.Registry
+	loggers      *logging.Loggers
+	events       *events.Bus
+	autopilot    *autopilot.Autopilot
+	faults       *transport.FaultyTransport
+	snapshots    raft.SnapshotStore
+	backupKey    []byte
+	scheduler    *backup.Scheduler
+	digests      *fsm.Digests
+	checker      *digest.Checker
+	tokenTimeout time.Duration
+}
+
+// Option configures optional dependencies of the HTTP server.
+type Option func(*serverOptions)
+
+// WithTracker lets the stats endpoint report the replication lag of peers.
+func WithTracker(t *transport.Tracker) Option {
+	return func(o *serverOptions) {
+		o.tracker = t
+	}
 }
 
-func NewHTTPServer(listenAddr string, r *raft.Raft, db *badger.DB) *httpServer {
+// WithRouter makes the server the entry point of all raft groups of the node.
+func WithRouter(router Router) Option {
+	return func(o *serverOptions) {
+		o.router = router
+	}
+}
+
+// WithRaftConfig lets the stats endpoint report the effective raft timing.
+func WithRaftConfig(cfg *raft.Config) Option {
+	return func(o *serverOptions) {
+		o.raftConfig = cfg
+	}
+}
+
+// WithForwarding sets how a follower handles requests only the leader can
+// serve.
+func WithForwarding(mode ForwardMode) Option {
+	return func(o *serverOptions) {
+		o.forwardMode = mode
+	}
+}
+
+// WithAdvertise registers the HTTP address other nodes reach this node at
+// whenever it becomes the leader.
+func WithAdvertise(nodeID raft.ServerID, httpAddr string) Option {
+	return func(o *serverOptions) {
+		o.nodeID = nodeID
+		o.httpAddr = httpAddr
+	}
+}
+
+// WithReplicationSource lets the replication status endpoint report how far
+// the standby cluster is behind.
+func WithReplicationSource(source *replication.Source) Option {
+	return func(o *serverOptions) {
+		o.source = source
+	}
+}
+
+// WithStandby makes a new cluster a standby replica of another cluster. A
+// cluster that was promoted stays a primary.
+func WithStandby() Option {
+	return func(o *serverOptions) {
+		o.standby = true
+	}
+}
+
+// WithMetrics serves the registry at /metrics and records the requests of the
+// server in it.
+func WithMetrics(registry *metrics.Registry) Option {
+	return func(o *serverOptions) {
+		o.metrics = registry
+	}
+}
+
+// WithLogging logs through the "http" logger of loggers, including one line
+// per request, and serves the admin endpoint for changing log levels.
+func WithLogging(loggers *logging.Loggers) Option {
+	return func(o *serverOptions) {
+		o.loggers = loggers
+	}
+}
+
+// WithEvents streams the events of the bus at /raft/events.
+func WithEvents(bus *events.Bus) Option {
+	return func(o *serverOptions) {
+		o.events = bus
+	}
+}
+
+// WithAutopilot adds servers joining as voters as nonvoters the autopilot
+// promotes, and reports its view of the server health.
+func WithAutopilot(pilot *autopilot.Autopilot) Option {
+	return func(o *serverOptions) {
+		o.autopilot = pilot
+	}
+}
+
+// WithFaults lets the RPCs of the raft transport be dropped, delayed,
+// duplicated or reordered through /admin/faults. Only for testing.
+func WithFaults(faults *transport.FaultyTransport) Option {
+	return func(o *serverOptions) {
+		o.faults = faults
+	}
+}
+
+// WithSnapshotStore lists the retained snapshots at /admin/snapshots and lets
+// backups fall back to the latest snapshot when nothing was applied since it
+// was taken.
+func WithSnapshotStore(store raft.SnapshotStore) Option {
+	return func(o *serverOptions) {
+		o.snapshots = store
+	}
+}
+
+// WithBackupKey lets restores decrypt backups encrypted with key.
+func WithBackupKey(key []byte) Option {
+	return func(o *serverOptions) {
+		o.backupKey = key
+	}
+}
+
+// WithBackupScheduler reports the outcome of the scheduled backups at
+// /admin/backup/status.
+func WithBackupScheduler(scheduler *backup.Scheduler) Option {
+	return func(o *serverOptions) {
+		o.scheduler = scheduler
+	}
+}
+
+// WithDigests serves the state digests of the FSM at /admin/digest. Reads
+// carrying a consistency token also wait for the FSM to apply its index.
+func WithDigests(digests *fsm.Digests) Option {
+	return func(o *serverOptions) {
+		o.digests = digests
+	}
+}
+
+// WithDigestChecker adds the outcome of the last comparison of the state
+// digests of the members to /admin/digest.
+func WithDigestChecker(checker *digest.Checker) Option {
+	return func(o *serverOptions) {
+		o.checker = checker
+	}
+}
+
+// WithConsistencyTokenTimeout bounds how long a read waits for this node to
+// apply the index of its consistency token.
+func WithConsistencyTokenTimeout(timeout time.Duration) Option {
+	return func(o *serverOptions) {
+		o.tokenTimeout = timeout
+	}
+}
+
+func NewHTTPServer(listenAddr string, r *raft.Raft, db *badger.DB, opts ...Option) *httpServer {
+	var o serverOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	e := echo.New()
 	e.HideBanner = true
 	e.HidePort = true
 	e.Pre(middleware.RemoveTrailingSlash())
+	logger := o.loggers.Logger("http")
+	e.Use(requestLogger(logger))
 	e.GET("/debug/pprof/*", echo.WrapHandler(http.DefaultServeMux))
+	if o.loggers != nil {
+		loggingHandler := NewLoggingHandler(o.loggers)
+		e.GET("/admin/log-level", loggingHandler.Levels)
+		e.PUT("/admin/log-level", loggingHandler.SetLevel)
+	}
+	if o.metrics != nil {
+		e.Use(requestMetrics)
+		e.GET("/metrics", NewMetricsHandler(o.metrics).Metrics)
+	}
+
+	drain := newDrainer()
+	fwd := newForwarder(o.forwardMode, r, db)
+	var stops []func()
+	if o.httpAddr != "" {
+		stops = append(stops, registerHTTPAddress(r, db, o.nodeID, o.httpAddr, logger))
+	}
+	if o.standby {
+		stops = append(stops, markStandby(r, db, logger))
+	}
+
+	route := func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	if o.router != nil {
+		route = routeMiddleware(o.router)
+		e.Any("/shard/*", echo.WrapHandler(o.router))
+	}
+
+	nodeID := o.nodeID
+	if nodeID == "" && o.raftConfig != nil {
+		nodeID = o.raftConfig.LocalID
+	}
+	healthHandler := NewHealthHandler(r, db, nodeID, drain)
+	e.GET("/healthz", healthHandler.Healthz)
+	e.GET("/readyz", healthHandler.Readyz, route)
+
+	raftHandler := NewRaftHandler(r, o.raftConfig, db, o.tracker, drain, o.autopilot)
+	e.POST("/raft/join", raftHandler.Join, route, fwd.middleware)
+	e.POST("/raft/remove", raftHandler.Remove, route, fwd.middleware)
+	e.POST("/raft/promote", raftHandler.Promote, route, fwd.middleware)
+	e.POST("/raft/demote", raftHandler.Demote, route, fwd.middleware)
+	e.GET("/raft/stats", raftHandler.Stats, route)
+	e.GET("/raft/members", raftHandler.Members, route)
+	e.POST("/raft/leadership-transfer", raftHandler.LeadershipTransfer, route, fwd.middleware)
+	e.POST("/raft/drain", raftHandler.Drain, route)
+	e.GET("/raft/drain", raftHandler.DrainStatus, route)
+	e.DELETE("/raft/drain", raftHandler.Undrain, route)
+	if o.autopilot != nil {
+		e.GET("/autopilot/health", NewAutopilotHandler(o.autopilot).Health, route, fwd.middleware)
+	}
+	if o.faults != nil {
+		faultsHandler := NewFaultsHandler(o.faults)
+		e.GET("/admin/faults", faultsHandler.List, route)
+		e.PUT("/admin/faults", faultsHandler.Set, route)
+		e.DELETE("/admin/faults", faultsHandler.Clear, route)
+	}
+	backupHandler := NewBackupHandler(r, db, o.snapshots, nodeID, o.backupKey, o.scheduler, logger)
+	e.GET("/admin/backup", backupHandler.Backup, withoutDeadline, route)
+	e.POST("/admin/restore", backupHandler.Restore, withoutDeadline, route, fwd.middleware)
+	if o.scheduler != nil {
+		e.GET("/admin/backup/status", backupHandler.Status, route, fwd.middleware)
+	}
+	if o.digests != nil {
+		e.GET("/admin/digest", NewDigestHandler(o.digests, o.checker).Digest, route)
+	}
+	snapshotHandler := NewSnapshotHandler(r, o.snapshots, logger)
+	e.POST("/admin/snapshot", snapshotHandler.Snapshot, withoutDeadline, route)
+	if o.snapshots != nil {
+		e.GET("/admin/snapshots", snapshotHandler.List, route)
+	}
+	if o.events != nil {
+		e.GET("/raft/events", NewEventsHandler(o.events).Stream)
+	}
 
-	raftHandler := NewRaftHandler(r)
-	e.POST("/raft/join", raftHandler.Join)
-	e.POST("/raft/remove", raftHandler.Remove)
-	e.GET("/raft/stats", raftHandler.Stats)
+	replicationHandler := NewReplicationHandler(r, db, o.source)
+	e.GET("/replication/status", replicationHandler.Status)
+	e.POST("/replication/apply", replicationHandler.Apply, fwd.middleware)
+	e.POST("/replication/snapshot", replicationHandler.Snapshot, withoutDeadline, fwd.middleware)
+	e.POST("/replication/promote", replicationHandler.Promote, fwd.middleware)
 
-	fsmHandler := NewFSMHandler(r, db)
-	e.POST("/db", fsmHandler.Set)
-	e.GET("/db/:key", fsmHandler.Get)
-	e.DELETE("/db/:key", fsmHandler.Delete)
+	fsmHandler := NewFSMHandler(r, db, o.digests, o.tokenTimeout)
+	e.POST("/db", fsmHandler.Set, drain.middleware, route, fwd.middleware, replicationHandler.writeMiddleware)
+	e.GET("/db/:key", fsmHandler.Get, drain.middleware, route, fwd.readMiddleware)
+	e.DELETE("/db/:key", fsmHandler.Delete, drain.middleware, route, fwd.middleware, replicationHandler.writeMiddleware)
 
 	return &httpServer{
 		listenAddress: listenAddr,
 		echo:          e,
 		raft:          r,
+		stops:         stops,
+		server: &http.Server{
+			Addr:         listenAddr,
+			ReadTimeout:  ReadTimeout,
+			WriteTimeout: WriteTimeout,
+			ConnContext:  connContext,
+			ErrorLog:     logger.StandardLogger(&hclog.StandardLoggerOptions{InferLevels: true}),
+		},
+	}
+}
+
+// routeMiddleware passes requests owned by another raft group on to it.
+func routeMiddleware(router Router) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(eCtx echo.Context) error {
+			handler, done, status, err := router.Route(eCtx.Request())
+			if err != nil {
+				return eCtx.JSON(status, map[string]interface{}{
+					"error": err.Error(),
+				})
+			}
+			defer done()
+			if handler == nil {
+				return next(eCtx)
+			}
+			handler.ServeHTTP(eCtx.Response(), eCtx.Request())
+			return nil
+		}
 	}
 }
+
+// Handler returns the handler of the server, for serving it without Start.
+func (s httpServer) Handler() http.Handler {
+	return s.echo
+}
 func (s httpServer) Start() error {
-	return s.echo.StartServer(&http.Server{
-		Addr:         s.listenAddress,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 5 * time.Second,
-	})
+	return s.echo.StartServer(s.server)
+}
+
+// Shutdown stops accepting connections and waits for the active requests to
+// finish until the context expires.
+func (s httpServer) Shutdown(ctx context.Context) error {
+	defer s.Close()
+	return s.server.Shutdown(ctx)
+}
+
+// Close stops the background work of the server, like registering its HTTP
+// address with every new leader. A server only used through Handler has to be
+// closed before its raft node is shut down.
+func (s httpServer) Close() {
+	for _, stop := range s.stops {
+		stop()
+	}
 }
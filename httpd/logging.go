@@ -0,0 +1,114 @@
+package httpd
+
+import (
+	"context"
+	"crypto/rand"
+	"dpasswd/logging"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/labstack/echo/v4"
+)
+
+type loggingHandler struct {
+	loggers *logging.Loggers
+}
+type logLevelRequest struct {
+	Subsystem string `json:"subsystem"`
+	Level     string `json:"level"`
+}
+
+func NewLoggingHandler(loggers *logging.Loggers) *loggingHandler {
+	return &loggingHandler{
+		loggers: loggers,
+	}
+}
+
+func (lh loggingHandler) Levels(eCtx echo.Context) error {
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": "log levels",
+		"data":    lh.loggers.Levels(),
+	})
+}
+
+// SetLevel changes the level of a subsystem at runtime, or the default level
+// when no subsystem is given.
+func (lh loggingHandler) SetLevel(eCtx echo.Context) error {
+	var req = logLevelRequest{}
+	if err := eCtx.Bind(&req); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error binding: %s", err.Error()),
+		})
+	}
+
+	subsystem := strings.TrimSpace(req.Subsystem)
+	if subsystem == "default" {
+		subsystem = ""
+	}
+	if err := lh.loggers.SetLevel(subsystem, req.Level); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": "log level changed successfully",
+		"data":    lh.loggers.Levels(),
+	})
+}
+
+type requestLoggedKey struct{}
+
+// requestLogger tags every request with an ID, taken from the X-Request-Id
+// header if the client or a forwarding node set one, and logs it once it is
+// answered. Requests another server of this node hands over, e.g. to the
+// raft group owning a key, are only logged by the first one.
+func requestLogger(logger hclog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(eCtx echo.Context) error {
+			req := eCtx.Request()
+			if req.Context().Value(requestLoggedKey{}) != nil {
+				return next(eCtx)
+			}
+
+			id := req.Header.Get(echo.HeaderXRequestID)
+			if id == "" {
+				id = newRequestID()
+				req.Header.Set(echo.HeaderXRequestID, id)
+			}
+			eCtx.SetRequest(req.WithContext(context.WithValue(req.Context(), requestLoggedKey{}, id)))
+			eCtx.Response().Header().Set(echo.HeaderXRequestID, id)
+
+			start := time.Now()
+			if err := next(eCtx); err != nil {
+				eCtx.Error(err)
+			}
+
+			status := eCtx.Response().Status
+			args := []interface{}{
+				"request_id", id,
+				"method", req.Method,
+				"uri", req.RequestURI,
+				"status", status,
+				"duration", time.Since(start).String(),
+				"remote", eCtx.RealIP(),
+			}
+			if status >= http.StatusInternalServerError {
+				logger.Warn("request", args...)
+			} else {
+				logger.Info("request", args...)
+			}
+			return nil
+		}
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,51 @@
+package httpd
+
+import (
+	"dpasswd/metrics"
+	"net/http"
+	"strconv"
+	"time"
+
+	gometrics "github.com/armon/go-metrics"
+	"github.com/labstack/echo/v4"
+)
+
+type metricsHandler struct {
+	registry *metrics.Registry
+}
+
+func NewMetricsHandler(registry *metrics.Registry) *metricsHandler {
+	return &metricsHandler{
+		registry: registry,
+	}
+}
+
+// Metrics serves all metrics in the Prometheus text format.
+func (mh metricsHandler) Metrics(eCtx echo.Context) error {
+	eCtx.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	eCtx.Response().WriteHeader(http.StatusOK)
+	_, err := mh.registry.WriteTo(eCtx.Response())
+	return err
+}
+
+// requestMetrics records the count and latency of requests per route, method
+// and status.
+func requestMetrics(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(eCtx echo.Context) error {
+		start := time.Now()
+		if err := next(eCtx); err != nil {
+			eCtx.Error(err)
+		}
+
+		route := eCtx.Path()
+		if route == "" {
+			route = "unknown"
+		}
+		gometrics.MeasureSinceWithLabels([]string{"http", "request"}, start, []gometrics.Label{
+			{Name: "route", Value: route},
+			{Name: "method", Value: eCtx.Request().Method},
+			{Name: "status", Value: strconv.Itoa(eCtx.Response().Status)},
+		})
+		return nil
+	}
+}
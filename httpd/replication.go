@@ -0,0 +1,358 @@
+package httpd
+
+import (
+	"dpasswd/fsm"
+	"dpasswd/replication"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/labstack/echo/v4"
+)
+
+// replicationHandler serves both sides of the replication to a standby
+// cluster: the status of the source running on this node, and the endpoints
+// through which a standby applies the mutations of its primary.
+type replicationHandler struct {
+	raft   *raft.Raft
+	db     *badger.DB
+	source *replication.Source
+	sink   *sinkState
+}
+
+// sinkState serializes the batches applied by a standby and remembers how far
+// the primary was when it last sent one.
+type sinkState struct {
+	applyMu sync.Mutex
+
+	mu          sync.Mutex
+	sourceIndex uint64
+	lastContact time.Time
+}
+
+func (s *sinkState) contact(sourceIndex uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sourceIndex > 0 {
+		s.sourceIndex = sourceIndex
+	}
+	s.lastContact = time.Now()
+}
+
+func (s *sinkState) last() (uint64, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sourceIndex, s.lastContact
+}
+
+type replicationStatus struct {
+	replication.SinkStatus
+	Source *replication.SourceStatus `json:"source,omitempty"`
+}
+
+func NewReplicationHandler(r *raft.Raft, db *badger.DB, source *replication.Source) *replicationHandler {
+	return &replicationHandler{
+		raft:   r,
+		db:     db,
+		source: source,
+		sink:   &sinkState{},
+	}
+}
+
+func (rh replicationHandler) Status(eCtx echo.Context) error {
+	sinkStatus, err := rh.sinkStatus()
+	if err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error reading replication state: %s", err.Error()),
+		})
+	}
+
+	status := replicationStatus{SinkStatus: sinkStatus}
+	if rh.source != nil {
+		sourceStatus := rh.source.Status()
+		status.Source = &sourceStatus
+	}
+
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": "replication status",
+		"data":    status,
+	})
+}
+
+// Apply applies a batch of mutations of the primary. Batches must continue
+// from the stored checkpoint, otherwise they are rejected with the checkpoint
+// so the primary can resume from there.
+func (rh replicationHandler) Apply(eCtx echo.Context) error {
+	var batch = replication.Batch{}
+	if err := eCtx.Bind(&batch); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error binding: %s", err.Error()),
+		})
+	}
+	if batch.Index <= batch.After {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": "batch index must be greater than the index it continues from",
+		})
+	}
+
+	rh.sink.applyMu.Lock()
+	defer rh.sink.applyMu.Unlock()
+
+	status, code, err := rh.checkSink()
+	if err != nil {
+		return eCtx.JSON(code, map[string]interface{}{
+			"error": err.Error(),
+			"data":  status,
+		})
+	}
+	if batch.After != status.Checkpoint {
+		return eCtx.JSON(http.StatusConflict, map[string]interface{}{
+			"error": fmt.Sprintf("batch continues from index %d, checkpoint is %d", batch.After, status.Checkpoint),
+			"data":  status,
+		})
+	}
+
+	payloads := make([]fsm.CommandPayload, 0, len(batch.Entries)+1)
+	for _, entry := range batch.Entries {
+		payloads = append(payloads, fsm.CommandPayload{
+			Operation: entry.Operation,
+			Key:       entry.Key,
+			Value:     entry.Value,
+		})
+	}
+	payloads = append(payloads, fsm.CommandPayload{
+		Operation: "SET",
+		Key:       fsm.ReplicationCheckpointKey(),
+		Value:     batch.Index,
+	})
+	if err := fsm.ApplyCommands(rh.raft, payloads); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error applying batch: %s", err.Error()),
+		})
+	}
+
+	rh.sink.contact(batch.SourceIndex)
+	return rh.respondSinkStatus(eCtx, fmt.Sprintf("applied %d entries up to index %d", len(batch.Entries), batch.Index))
+}
+
+// Snapshot replaces the client data with a snapshot of the primary taken at
+// the index given as query parameter. Reads see a mix of old and new data
+// until it has been applied.
+func (rh replicationHandler) Snapshot(eCtx echo.Context) error {
+	index, err := strconv.ParseUint(eCtx.QueryParam("index"), 10, 64)
+	if err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("invalid index: %s", eCtx.QueryParam("index")),
+		})
+	}
+
+	rh.sink.applyMu.Lock()
+	defer rh.sink.applyMu.Unlock()
+
+	if status, code, err := rh.checkSink(); err != nil {
+		return eCtx.JSON(code, map[string]interface{}{
+			"error": err.Error(),
+			"data":  status,
+		})
+	}
+
+	// Remember the current keys, those missing in the snapshot are deleted
+	stale := make(map[string]bool)
+	err = rh.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if key := string(it.Item().Key()); !fsm.IsMetaKey(key) {
+				stale[key] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error listing keys: %s", err.Error()),
+		})
+	}
+
+	decoder := json.NewDecoder(eCtx.Request().Body)
+	if _, err := decoder.Token(); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error reading snapshot: %s", err.Error()),
+		})
+	}
+
+	var payloads []fsm.CommandPayload
+	restored := 0
+	for decoder.More() {
+		var payload struct {
+			Operation string
+			Key       string
+			Value     json.RawMessage
+		}
+		if err := decoder.Decode(&payload); err != nil {
+			return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"error": fmt.Sprintf("error reading snapshot: %s", err.Error()),
+			})
+		}
+		if fsm.IsMetaKey(payload.Key) {
+			continue
+		}
+
+		delete(stale, payload.Key)
+		payloads = append(payloads, fsm.CommandPayload{Operation: "SET", Key: payload.Key, Value: payload.Value})
+		restored++
+		if len(payloads) == 512 {
+			if err := fsm.ApplyCommands(rh.raft, payloads); err != nil {
+				return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+					"error": fmt.Sprintf("error applying snapshot: %s", err.Error()),
+				})
+			}
+			payloads = payloads[:0]
+		}
+	}
+
+	for key := range stale {
+		payloads = append(payloads, fsm.CommandPayload{Operation: "DELETE", Key: key})
+	}
+	payloads = append(payloads, fsm.CommandPayload{
+		Operation: "SET",
+		Key:       fsm.ReplicationCheckpointKey(),
+		Value:     index,
+	})
+	if err := fsm.ApplyCommands(rh.raft, payloads); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error applying snapshot: %s", err.Error()),
+		})
+	}
+
+	rh.sink.contact(0)
+	return rh.respondSinkStatus(eCtx, fmt.Sprintf("restored %d keys and removed %d keys from snapshot at index %d", restored, len(stale), index))
+}
+
+// Promote turns a standby into a primary accepting client writes. Batches of
+// the old primary are rejected from then on.
+func (rh replicationHandler) Promote(eCtx echo.Context) error {
+	if rh.raft.State() != raft.Leader {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": "not the leader",
+		})
+	}
+
+	rh.sink.applyMu.Lock()
+	defer rh.sink.applyMu.Unlock()
+
+	err := fsm.ApplyCommand(rh.raft, fsm.CommandPayload{
+		Operation: "SET",
+		Key:       fsm.ReplicationRoleKey(),
+		Value:     replication.RolePrimary,
+	})
+	if err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error promoting cluster: %s", err.Error()),
+		})
+	}
+
+	return rh.respondSinkStatus(eCtx, "cluster promoted to primary")
+}
+
+// writeMiddleware rejects client writes while the cluster is a standby.
+func (rh replicationHandler) writeMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(eCtx echo.Context) error {
+		var role string
+		if err := fsm.ReadMeta(rh.db, fsm.ReplicationRoleKey(), &role); err != nil {
+			return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+				"error": fmt.Sprintf("error reading replication role: %s", err.Error()),
+			})
+		}
+		if role == replication.RoleStandby {
+			return eCtx.JSON(http.StatusForbidden, map[string]interface{}{
+				"error": "cluster is a standby replica, promote it to accept writes",
+			})
+		}
+		return next(eCtx)
+	}
+}
+
+// checkSink makes sure this node may apply the data of a primary. The barrier
+// lets a new leader catch up with the checkpoint of the previous one.
+func (rh replicationHandler) checkSink() (replication.SinkStatus, int, error) {
+	if rh.raft.State() != raft.Leader {
+		return replication.SinkStatus{}, http.StatusUnprocessableEntity, fmt.Errorf("not the leader")
+	}
+	if err := rh.raft.Barrier(5 * time.Second).Error(); err != nil {
+		return replication.SinkStatus{}, http.StatusUnprocessableEntity, fmt.Errorf("error waiting for the raft log to be applied: %s", err.Error())
+	}
+
+	status, err := rh.sinkStatus()
+	if err != nil {
+		return status, http.StatusUnprocessableEntity, fmt.Errorf("error reading replication state: %s", err.Error())
+	}
+	if status.Role != replication.RoleStandby {
+		return status, http.StatusConflict, fmt.Errorf("cluster is not a standby")
+	}
+	return status, http.StatusOK, nil
+}
+
+func (rh replicationHandler) respondSinkStatus(eCtx echo.Context, message string) error {
+	status, err := rh.sinkStatus()
+	if err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error reading replication state: %s", err.Error()),
+		})
+	}
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": message,
+		"data":    status,
+	})
+}
+
+func (rh replicationHandler) sinkStatus() (replication.SinkStatus, error) {
+	status := replication.SinkStatus{Role: replication.RolePrimary}
+	var role string
+	if err := fsm.ReadMeta(rh.db, fsm.ReplicationRoleKey(), &role); err != nil {
+		return status, err
+	}
+	if role != "" {
+		status.Role = role
+	}
+	if err := fsm.ReadMeta(rh.db, fsm.ReplicationCheckpointKey(), &status.Checkpoint); err != nil {
+		return status, err
+	}
+
+	// Only the leader applying the batches knows how far the primary is
+	if sourceIndex, lastContact := rh.sink.last(); !lastContact.IsZero() {
+		status.LastContact = &lastContact
+		status.SourceIndex = sourceIndex
+		if status.SourceIndex > status.Checkpoint {
+			status.Lag = status.SourceIndex - status.Checkpoint
+		}
+	}
+	return status, nil
+}
+
+// markStandby makes a new cluster a standby. The role is only stored once, so
+// a promoted cluster stays a primary when its nodes restart. It returns a func
+// that stops it.
+func markStandby(r *raft.Raft, db *badger.DB, logger hclog.Logger) func() {
+	return whenLeader(r, func() {
+		var role string
+		if err := fsm.ReadMeta(db, fsm.ReplicationRoleKey(), &role); err != nil || role != "" {
+			return
+		}
+		if err := fsm.ApplyCommand(r, fsm.CommandPayload{
+			Operation: "SET",
+			Key:       fsm.ReplicationRoleKey(),
+			Value:     replication.RoleStandby,
+		}); err != nil {
+			logger.Error("error marking cluster as standby", "error", err)
+		}
+	})
+}
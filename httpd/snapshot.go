@@ -0,0 +1,104 @@
+package httpd
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/labstack/echo/v4"
+)
+
+type snapshotHandler struct {
+	raft      *raft.Raft
+	snapshots raft.SnapshotStore
+	logger    hclog.Logger
+}
+
+type snapshotServer struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+}
+
+type snapshotInfo struct {
+	ID                 string           `json:"id"`
+	Index              uint64           `json:"index"`
+	Term               uint64           `json:"term"`
+	Size               int64            `json:"size"`
+	Version            int              `json:"version"`
+	Configuration      []snapshotServer `json:"configuration"`
+	ConfigurationIndex uint64           `json:"configuration_index"`
+}
+
+func NewSnapshotHandler(r *raft.Raft, snapshots raft.SnapshotStore, logger hclog.Logger) *snapshotHandler {
+	return &snapshotHandler{
+		raft:      r,
+		snapshots: snapshots,
+		logger:    logger,
+	}
+}
+
+func newSnapshotInfo(meta *raft.SnapshotMeta) snapshotInfo {
+	info := snapshotInfo{
+		ID:                 meta.ID,
+		Index:              meta.Index,
+		Term:               meta.Term,
+		Size:               meta.Size,
+		Version:            int(meta.Version),
+		Configuration:      make([]snapshotServer, 0, len(meta.Configuration.Servers)),
+		ConfigurationIndex: meta.ConfigurationIndex,
+	}
+	for _, srv := range meta.Configuration.Servers {
+		info.Configuration = append(info.Configuration, snapshotServer{
+			ID:       string(srv.ID),
+			Address:  string(srv.Address),
+			Suffrage: srv.Suffrage.String(),
+		})
+	}
+	return info
+}
+
+// Snapshot takes a snapshot of the FSM of this node, after which raft
+// compacts its log down to the trailing logs.
+func (sh snapshotHandler) Snapshot(eCtx echo.Context) error {
+	future := sh.raft.Snapshot()
+	if err := future.Error(); err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error taking snapshot: %s", err.Error()),
+		})
+	}
+	meta, data, err := future.Open()
+	if err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error opening snapshot: %s", err.Error()),
+		})
+	}
+	if err := data.Close(); err != nil {
+		sh.logger.Error("error closing snapshot", "id", meta.ID, "error", err)
+	}
+	sh.logger.Info("snapshot taken on request", "id", meta.ID, "index", meta.Index, "bytes", meta.Size)
+
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": fmt.Sprintf("snapshot of index %d taken", meta.Index),
+		"data":    newSnapshotInfo(meta),
+	})
+}
+
+// List shows the snapshots retained by the snapshot store, newest first.
+func (sh snapshotHandler) List(eCtx echo.Context) error {
+	snapshots, err := sh.snapshots.List()
+	if err != nil {
+		return eCtx.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"error": fmt.Sprintf("error listing snapshots: %s", err.Error()),
+		})
+	}
+	infos := make([]snapshotInfo, 0, len(snapshots))
+	for _, meta := range snapshots {
+		infos = append(infos, newSnapshotInfo(meta))
+	}
+	return eCtx.JSON(http.StatusOK, map[string]interface{}{
+		"message": "retained snapshots",
+		"data":    infos,
+	})
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"dpasswd/fsm"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+const inspectUsage = "inspect (log | snapshots | config | export) --datadir <dir> [options]"
+
+// runInspect prints what a data directory holds: the raft log, the snapshots,
+// the stored configuration or the keys of the store. The raft log and Badger
+// are opened read-only, so the node must be stopped while this runs.
+func runInspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	dataDir := fs.String("datadir", "data", "Data storage directory of the stopped node")
+	groupID := fs.Int("group", 0, "Raft group to inspect on a sharded node")
+	from := fs.Uint64("from", 0, "log: first index to print (default the first index of the log)")
+	to := fs.Uint64("to", 0, "log: last index to print (default the last index of the log)")
+	asJSON := fs.Bool("json", false, "log: print the entries as JSON lines")
+	out := fs.String("out", "", "export: file to write to (default stdout)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s\n", os.Args[0], inspectUsage)
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	view := args[0]
+	_ = fs.Parse(args[1:])
+
+	dir := *dataDir
+	if *groupID != 0 {
+		dir = path.Join(dir, fmt.Sprintf("group-%d", *groupID))
+	}
+	if _, err := os.Stat(dir); err != nil {
+		log.Fatal(err)
+	}
+
+	switch view {
+	case "log":
+		logDB := openLogReadOnly(dir)
+		defer closeLogStore(logDB)
+		if err := dumpLog(os.Stdout, logDB, *from, *to, *asJSON); err != nil {
+			log.Fatalf("error reading raft log: %s", err)
+		}
+	case "snapshots":
+		ssDB, err := raft.NewFileSnapshotStore(dir, 2, io.Discard)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := listSnapshots(ssDB); err != nil {
+			log.Fatalf("error listing snapshots: %s", err)
+		}
+	case "config":
+		logDB := openLogReadOnly(dir)
+		defer closeLogStore(logDB)
+		if err := printStoredState(dir, logDB); err != nil {
+			log.Fatalf("error reading stored configuration: %s", err)
+		}
+	case "export":
+		var w io.Writer = os.Stdout
+		if *out != "" {
+			f, err := os.Create(*out)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer func() {
+				if err := f.Close(); err != nil {
+					fmt.Fprintf(os.Stderr, "Error closing %s: %s\n", *out, err.Error())
+				}
+			}()
+			w = f
+		}
+		n, err := exportKeys(w, dir)
+		if err != nil {
+			log.Fatalf("error exporting keys: %s", err)
+		}
+		fmt.Fprintf(os.Stderr, "Exported %d keys\n", n)
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+}
+
+// openLogReadOnly opens the raft log without creating its buckets. Bolt waits
+// for the lock of a running node, so this gives up after a second.
+func openLogReadOnly(dir string) *raftboltdb.BoltStore {
+	logDB, err := raftboltdb.New(raftboltdb.Options{
+		Path:        path.Join(dir, "log"),
+		BoltOptions: &bolt.Options{ReadOnly: true, Timeout: time.Second},
+	})
+	if err != nil {
+		log.Fatalf("error opening raft log store, is the node still running? %s", err)
+	}
+	return logDB
+}
+
+func closeLogStore(logDB *raftboltdb.BoltStore) {
+	if err := logDB.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error closing raft log store: %s\n", err.Error())
+	}
+}
+
+// logEntry is a raft log entry with its data decoded.
+type logEntry struct {
+	Index      uint64              `json:"index"`
+	Term       uint64              `json:"term"`
+	Type       string              `json:"type"`
+	AppendedAt time.Time           `json:"appended_at,omitempty"`
+	Command    *fsm.CommandPayload `json:"command,omitempty"`
+	Servers    []raft.Server       `json:"servers,omitempty"`
+	// Data the entry carries that could not be decoded
+	Raw []byte `json:"raw,omitempty"`
+}
+
+func decodeLogEntry(l *raft.Log) logEntry {
+	entry := logEntry{Index: l.Index, Term: l.Term, Type: l.Type.String(), AppendedAt: l.AppendedAt}
+	switch l.Type {
+	case raft.LogCommand:
+		var payload fsm.CommandPayload
+		if err := json.Unmarshal(l.Data, &payload); err != nil {
+			entry.Raw = l.Data
+			break
+		}
+		entry.Command = &payload
+	case raft.LogConfiguration:
+		entry.Servers = raft.DecodeConfiguration(l.Data).Servers
+	default:
+		if len(l.Data) > 0 {
+			entry.Raw = l.Data
+		}
+	}
+	return entry
+}
+
+func dumpLog(w io.Writer, logDB *raftboltdb.BoltStore, from, to uint64, asJSON bool) error {
+	first, err := logDB.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := logDB.LastIndex()
+	if err != nil {
+		return err
+	}
+	if from < first {
+		from = first
+	}
+	if to == 0 || to > last {
+		to = last
+	}
+	if last == 0 {
+		fmt.Fprintf(os.Stderr, "The raft log is empty\n")
+		return nil
+	}
+
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	for index := from; index <= to; index++ {
+		var l raft.Log
+		if err := logDB.GetLog(index, &l); err != nil {
+			return fmt.Errorf("index %d: %w", index, err)
+		}
+		entry := decodeLogEntry(&l)
+		if asJSON {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+			continue
+		}
+
+		appended := "-"
+		if !entry.AppendedAt.IsZero() {
+			appended = entry.AppendedAt.Format(time.RFC3339Nano)
+		}
+		fmt.Fprintf(bw, "%d\t%d\t%s\t%s", entry.Index, entry.Term, appended, entry.Type)
+		switch {
+		case entry.Command != nil:
+			value, _ := json.Marshal(entry.Command.Value)
+			fmt.Fprintf(bw, "\t%s %q %s", entry.Command.Operation, entry.Command.Key, value)
+		case l.Type == raft.LogConfiguration:
+			for _, srv := range entry.Servers {
+				fmt.Fprintf(bw, "\t%s=%s(%s)", srv.ID, srv.Address, srv.Suffrage)
+			}
+		case entry.Raw != nil:
+			fmt.Fprintf(bw, "\t%d bytes: %q", len(entry.Raw), entry.Raw)
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+	return bw.Flush()
+}
+
+func listSnapshots(ssDB raft.SnapshotStore) error {
+	snapshots, err := ssDB.List()
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		fmt.Printf("No snapshots\n")
+		return nil
+	}
+	for _, meta := range snapshots {
+		fmt.Printf("%s\n", meta.ID)
+		fmt.Printf("  index %d, term %d, %d bytes, format version %d\n", meta.Index, meta.Term, meta.Size, meta.Version)
+		fmt.Printf("  configuration at index %d:\n", meta.ConfigurationIndex)
+		printConfiguration(meta.Configuration)
+	}
+	return nil
+}
+
+// printStoredState prints the configuration a node starting from dir would
+// use, together with its term and vote and the extent of its log.
+func printStoredState(dir string, logDB *raftboltdb.BoltStore) error {
+	ssDB, err := raft.NewFileSnapshotStore(dir, 2, io.Discard)
+	if err != nil {
+		return err
+	}
+
+	raftCfg := raft.DefaultConfig()
+	raftCfg.LocalID = "inspect"
+	raftCfg.LogLevel = "WARN"
+	_, trans := raft.NewInmemTransport("")
+
+	current, err := raft.GetConfiguration(raftCfg, discardFSM{}, logDB, readOnlyStable{logDB}, ssDB, trans)
+	if err != nil {
+		return err
+	}
+	term, _ := logDB.GetUint64([]byte("CurrentTerm"))
+	lastVoteTerm, _ := logDB.GetUint64([]byte("LastVoteTerm"))
+	lastVoteCand, _ := logDB.Get([]byte("LastVoteCand"))
+	firstIndex, _ := logDB.FirstIndex()
+	lastIndex, _ := logDB.LastIndex()
+
+	fmt.Printf("Current term:   %d\n", term)
+	if len(lastVoteCand) > 0 {
+		fmt.Printf("Last vote:      %s in term %d\n", lastVoteCand, lastVoteTerm)
+	}
+	fmt.Printf("Log indexes:    %d - %d\n", firstIndex, lastIndex)
+	fmt.Printf("Configuration:\n")
+	printConfiguration(current)
+	return nil
+}
+
+// readOnlyStable drops the writes raft makes while it loads the stored state
+// of a read-only store.
+type readOnlyStable struct {
+	raft.StableStore
+}
+
+func (readOnlyStable) Set([]byte, []byte) error { return nil }
+
+func (readOnlyStable) SetUint64([]byte, uint64) error { return nil }
+
+// exportedKey is one line of an export. Meta marks keys reserved for cluster
+// metadata.
+type exportedKey struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+	Meta  bool            `json:"meta,omitempty"`
+}
+
+// exportKeys writes every key of the Badger database in dir as a JSON line.
+func exportKeys(w io.Writer, dir string) (int, error) {
+	// Badger locks its directory, so this also fails while the node is running
+	badgerDB, err := badger.Open(badger.DefaultOptions(dir).WithReadOnly(true).WithLogger(nil))
+	if err != nil {
+		return 0, fmt.Errorf("error opening badgerDB, is the node still running? %w", err)
+	}
+	defer func() {
+		if err := badgerDB.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing badgerDB: %s\n", err.Error())
+		}
+	}()
+
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	n := 0
+	err = badgerDB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			key := string(item.KeyCopy(nil))
+			line := exportedKey{Key: key, Value: value, Meta: fsm.IsMetaKey(key)}
+			if !json.Valid(value) {
+				line.Value, _ = json.Marshal(string(value))
+			}
+			if err := encoder.Encode(line); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
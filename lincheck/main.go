@@ -0,0 +1,344 @@
+// lincheck runs concurrent clients against an in-process cluster while
+// injecting faults, and checks whether the recorded history of Set, Get and
+// Delete is linearizable. A counterexample is printed and written as HTML.
+package main
+
+import (
+	"dpasswd/linearizability"
+	"dpasswd/testcluster"
+	"dpasswd/transport"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+var nodes int
+var clients int
+var keys int
+var duration time.Duration
+var consistency string
+var readFrom string
+var faultInterval time.Duration
+var noFaults bool
+var seed int64
+var checkTimeout time.Duration
+var outFile string
+var historyFile string
+var verbose bool
+
+func init() {
+	flag.IntVar(&nodes, "nodes", 3, "Number of nodes of the cluster")
+	flag.IntVar(&clients, "clients", 5, "Number of concurrent clients")
+	flag.IntVar(&keys, "keys", 3, "Number of keys the clients work on")
+	flag.DurationVar(&duration, "duration", 10*time.Second, "How long the clients run")
+	flag.StringVar(&consistency, "consistency", "", "Consistency level of the reads: stale, leader or strong (default the server default)")
+	flag.StringVar(&readFrom, "read-from", "any", "Nodes reads are sent to: any or leader")
+	flag.DurationVar(&faultInterval, "fault-interval", time.Second, "How often the injected faults change")
+	flag.BoolVar(&noFaults, "no-faults", false, "Run without injecting faults")
+	flag.Int64Var(&seed, "seed", 0, "Seed of the clients and faults (default the current time)")
+	flag.DurationVar(&checkTimeout, "check-timeout", time.Minute, "Time the check of a single key may take")
+	flag.StringVar(&outFile, "out", "lincheck.html", "File the counterexample is written to")
+	flag.StringVar(&historyFile, "history", "", "File the history is written to as JSON lines")
+	flag.BoolVar(&verbose, "v", false, "Print the logs of the nodes")
+}
+
+func main() {
+	flag.Parse()
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	if readFrom != "any" && readFrom != "leader" {
+		log.Fatalf("unknown --read-from %s", readFrom)
+	}
+	// Partitioning a minority needs at least three nodes
+	if nodes < 3 {
+		log.Fatalf("--nodes has to be at least 3, got %d", nodes)
+	}
+	if keys < 1 {
+		log.Fatalf("--keys has to be at least 1, got %d", keys)
+	}
+	log.Printf("seed %d", seed)
+
+	tb := &runner{}
+	defer tb.cleanup()
+
+	logOutput := io.Discard
+	if verbose {
+		logOutput = os.Stderr
+	}
+	c := testcluster.New(tb, nodes, testcluster.WithSeed(seed), testcluster.WithLogs("warn", logOutput))
+	c.WaitForLeader(tb, 10*time.Second)
+
+	recorder := linearizability.NewRecorder()
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			runClient(c, recorder, id, rand.New(rand.NewSource(seed+int64(id))), stopCh)
+		}(i)
+	}
+	nemesisDone := make(chan struct{})
+	go func() {
+		defer close(nemesisDone)
+		if !noFaults {
+			runNemesis(c, rand.New(rand.NewSource(seed-1)), stopCh)
+		}
+	}()
+
+	time.Sleep(duration)
+	close(stopCh)
+	wg.Wait()
+	<-nemesisDone
+
+	history := recorder.History()
+	if historyFile != "" {
+		if err := writeHistory(historyFile, history); err != nil {
+			log.Fatalf("error writing history: %s", err)
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, op := range history {
+		kind := string(op.Kind)
+		if op.Unknown {
+			kind += " (unknown)"
+		}
+		counts[kind]++
+	}
+	log.Printf("recorded %d operations: %v", len(history), counts)
+
+	result := linearizability.Check(history, checkTimeout)
+	if result.OK {
+		log.Printf("history is linearizable")
+		return
+	}
+	for _, kr := range result.TimedOut() {
+		log.Printf("checking key %s timed out after %s", kr.Key, checkTimeout)
+	}
+
+	failed := result.Failed()
+	if len(failed) == 0 {
+		log.Printf("history is inconclusive, raise --check-timeout or lower --duration")
+		tb.cleanup()
+		os.Exit(2)
+	}
+	for _, kr := range failed {
+		fmt.Print(linearizability.Text(kr))
+	}
+	f, err := os.Create(outFile)
+	if err != nil {
+		log.Fatalf("error creating %s: %s", outFile, err)
+	}
+	if err := linearizability.HTML(f, failed); err != nil {
+		log.Fatalf("error writing %s: %s", outFile, err)
+	}
+	_ = f.Close()
+	log.Printf("history is not linearizable, counterexample written to %s", outFile)
+	tb.cleanup()
+	os.Exit(1)
+}
+
+// runClient sends random operations until stopCh is closed. Every set writes
+// a value no other set writes, which keeps the check fast.
+func runClient(c *testcluster.Cluster, recorder *linearizability.Recorder, id int, rnd *rand.Rand, stopCh <-chan struct{}) {
+	for seq := 0; ; seq++ {
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+
+		key := fmt.Sprintf("key%d", rnd.Intn(keys))
+		op := linearizability.Operation{Client: id, Key: key}
+		switch p := rnd.Float64(); {
+		case p < 0.5:
+			op.Kind = linearizability.Get
+		case p < 0.9:
+			op.Kind = linearizability.Set
+		default:
+			op.Kind = linearizability.Delete
+		}
+
+		running := c.Running()
+		node := running[rnd.Intn(len(running))]
+		if op.Kind != linearizability.Get || readFrom == "leader" {
+			if leader := currentLeader(c); leader != nil {
+				node = leader
+			}
+		}
+		op.Node = string(node.ID)
+
+		var err error
+		op.Call = recorder.Now()
+		switch op.Kind {
+		case linearizability.Get:
+			var value interface{}
+			value, err = c.Get(node, key, consistency)
+			if err == nil {
+				op.Found = true
+				op.Value = encode(value)
+			} else if strings.Contains(err.Error(), "Key not found") {
+				err = nil
+			}
+		case linearizability.Set:
+			value := id*1000000 + seq
+			op.Value = encode(value)
+			err = c.Set(node, key, value)
+		case linearizability.Delete:
+			err = c.Delete(node, key)
+		}
+		op.Return = recorder.Now()
+
+		if err != nil {
+			op.Error = err.Error()
+			// Failed reads have no effect, and a write rejected because
+			// the node is not the leader never reached the log
+			if op.Kind == linearizability.Get || strings.Contains(op.Error, "not the leader") {
+				continue
+			}
+			op.Unknown = true
+		}
+		recorder.Add(op)
+	}
+}
+
+// runNemesis changes the faults every fault interval: it cuts a random
+// minority off, injects random faults between random pairs of nodes, or heals
+// the cluster.
+func runNemesis(c *testcluster.Cluster, rnd *rand.Rand, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(faultInterval)
+	defer ticker.Stop()
+	defer func() {
+		c.Heal()
+		c.ClearFaults()
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stopCh:
+			return
+		}
+
+		c.Heal()
+		c.ClearFaults()
+		all := c.Running()
+		switch rnd.Intn(3) {
+		case 0:
+			rnd.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+			minority := all[:1+rnd.Intn((len(all)-1)/2)]
+			log.Printf("nemesis: partitioning %s", ids(minority))
+			c.Partition(minority...)
+		case 1:
+			fault := transport.Fault{
+				Drop:          0.2 * rnd.Float64(),
+				Delay:         time.Duration(rnd.Intn(20)) * time.Millisecond,
+				Jitter:        time.Duration(rnd.Intn(20)+1) * time.Millisecond,
+				Duplicate:     0.2 * rnd.Float64(),
+				Reorder:       0.2 * rnd.Float64(),
+				ReorderWindow: 50 * time.Millisecond,
+			}
+			pairs := 0
+			for _, a := range all {
+				for _, b := range all {
+					if a != b && rnd.Float64() < 0.5 {
+						c.SetFault(a, b, fault)
+						pairs++
+					}
+				}
+			}
+			log.Printf("nemesis: injecting faults between %d pairs of nodes", pairs)
+		default:
+			log.Printf("nemesis: healing")
+		}
+	}
+}
+
+func currentLeader(c *testcluster.Cluster) *testcluster.Node {
+	for _, n := range c.Running() {
+		if n.Raft.State() == raft.Leader {
+			return n
+		}
+	}
+	return nil
+}
+
+func ids(nodes []*testcluster.Node) string {
+	names := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		names = append(names, string(n.ID))
+	}
+	return strings.Join(names, ", ")
+}
+
+// encode gives values the form they have in the history, so that a number
+// written by a set compares equal to the same number read by a get.
+func encode(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+func writeHistory(path string, history []linearizability.Operation) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	for _, op := range history {
+		if err := encoder.Encode(op); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// runner lets the cluster run outside of go test.
+type runner struct {
+	mu       sync.Mutex
+	cleanups []func()
+}
+
+func (r *runner) Helper() {}
+
+func (r *runner) Log(args ...interface{}) {
+	if verbose {
+		log.Print(args...)
+	}
+}
+
+func (r *runner) Fatalf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+	r.cleanup()
+	os.Exit(1)
+}
+
+func (r *runner) Cleanup(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cleanups = append(r.cleanups, fn)
+}
+
+func (r *runner) cleanup() {
+	r.mu.Lock()
+	cleanups := r.cleanups
+	r.cleanups = nil
+	r.mu.Unlock()
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+}
@@ -0,0 +1,286 @@
+package linearizability
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"time"
+)
+
+// KeyResult is the outcome of checking the operations on one key. When the
+// check fails, Linearized is the longest order of operations found that
+// explains their results, and Stuck the operation that had to take effect
+// next but whose result no order explains.
+type KeyResult struct {
+	Key      string
+	OK       bool
+	TimedOut bool
+	Ops      []Operation
+	// Indices into Ops
+	Linearized []int
+	Stuck      int
+	// State of the register after the linearized operations
+	State string
+}
+
+// Result is the outcome of checking a whole history.
+type Result struct {
+	OK   bool
+	Keys []KeyResult
+}
+
+// Failed returns the results of the keys whose operations are not
+// linearizable.
+func (r Result) Failed() []KeyResult {
+	var failed []KeyResult
+	for _, k := range r.Keys {
+		if !k.OK && !k.TimedOut {
+			failed = append(failed, k)
+		}
+	}
+	return failed
+}
+
+// TimedOut returns the results of the keys whose check did not finish, their
+// operations may or may not be linearizable.
+func (r Result) TimedOut() []KeyResult {
+	var timedOut []KeyResult
+	for _, k := range r.Keys {
+		if k.TimedOut {
+			timedOut = append(timedOut, k)
+		}
+	}
+	return timedOut
+}
+
+// Check checks the operations of every key on its own, as a history is
+// linearizable exactly when the history of each key is. A key whose check
+// takes longer than timeout is not OK either, but has TimedOut set instead
+// of a counterexample.
+func Check(history []Operation, timeout time.Duration) Result {
+	byKey := make(map[string][]Operation)
+	for _, op := range history {
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := Result{OK: true}
+	for _, key := range keys {
+		kr := checkKey(key, byKey[key], timeout)
+		if !kr.OK {
+			result.OK = false
+		}
+		result.Keys = append(result.Keys, kr)
+	}
+	return result
+}
+
+// absent is the state of a register whose key does not exist.
+const absent = "\x00absent"
+
+// step applies op to the register state and reports whether the result the
+// client saw is possible in that state.
+func step(state string, op Operation) (bool, string) {
+	switch op.Kind {
+	case Set:
+		return true, op.Value
+	case Delete:
+		return true, absent
+	}
+	if !op.Found {
+		return state == absent, state
+	}
+	return state == op.Value, state
+}
+
+// entry is the call or the return of an operation in the doubly linked list
+// the search works on.
+type entry struct {
+	op       int
+	isReturn bool
+	time     int64
+	match    *entry
+	prev     *entry
+	next     *entry
+}
+
+func lift(e *entry) {
+	e.prev.next = e.next
+	if e.next != nil {
+		e.next.prev = e.prev
+	}
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+func unlift(e *entry) {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	if e.next != nil {
+		e.next.prev = e
+	}
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << uint(i%64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << uint(i%64) }
+
+func (b bitset) clone() bitset {
+	return append(bitset(nil), b...)
+}
+
+func (b bitset) equals(o bitset) bool {
+	for i := range b {
+		if b[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := fnv.New64a()
+	buf := make([]byte, 8)
+	for _, w := range b {
+		for i := 0; i < 8; i++ {
+			buf[i] = byte(w >> (8 * i))
+		}
+		_, _ = h.Write(buf)
+	}
+	return h.Sum64()
+}
+
+type cacheEntry struct {
+	linearized bitset
+	state      string
+}
+
+// checkKey searches for a linearization of the operations on one key with
+// the algorithm of Wing and Gong as improved by Lowe: operations are taken
+// in the order of their calls and backtracked once an operation returns
+// before it could be linearized, skipping combinations of linearized
+// operations and state that were tried before.
+func checkKey(key string, ops []Operation, timeout time.Duration) KeyResult {
+	result := KeyResult{Key: key, Ops: ops, Stuck: -1}
+
+	entries := make([]*entry, 0, 2*len(ops))
+	for i, op := range ops {
+		call := &entry{op: i, time: int64(op.Call)}
+		ret := &entry{op: i, isReturn: true, time: int64(op.Return)}
+		if op.Unknown {
+			// It may take effect any time after its call
+			ret.time = math.MaxInt64
+		}
+		call.match = ret
+		entries = append(entries, call, ret)
+	}
+	// Calls go before returns at the same time, which treats the
+	// operations as concurrent
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].time != entries[j].time {
+			return entries[i].time < entries[j].time
+		}
+		return !entries[i].isReturn && entries[j].isReturn
+	})
+	head := &entry{}
+	prev := head
+	for _, e := range entries {
+		prev.next = e
+		e.prev = prev
+		prev = e
+	}
+
+	type frame struct {
+		entry *entry
+		state string
+	}
+	var stack []frame
+	state := absent
+	linearized := newBitset(len(ops))
+	cache := make(map[uint64][]cacheEntry)
+	deadline := time.Now().Add(timeout)
+	var best []int
+	bestState := absent
+
+	e := head.next
+	for steps := 0; head.next != nil; steps++ {
+		if steps%1024 == 0 && time.Now().After(deadline) {
+			result.TimedOut = true
+			return result
+		}
+
+		if !e.isReturn {
+			ok, newState := step(state, ops[e.op])
+			if ok {
+				newLinearized := linearized.clone()
+				newLinearized.set(e.op)
+				h := newLinearized.hash()
+				seen := false
+				for _, c := range cache[h] {
+					if c.state == newState && c.linearized.equals(newLinearized) {
+						seen = true
+						break
+					}
+				}
+				if !seen {
+					cache[h] = append(cache[h], cacheEntry{linearized: newLinearized, state: newState})
+					stack = append(stack, frame{entry: e, state: state})
+					state = newState
+					linearized.set(e.op)
+					lift(e)
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+			continue
+		}
+
+		// An operation returned before it could be linearized
+		if len(stack) > len(best) || (len(stack) == len(best) && result.Stuck < 0) {
+			best = best[:0]
+			for _, f := range stack {
+				best = append(best, f.entry.op)
+			}
+			bestState = state
+			result.Stuck = e.op
+		}
+		if len(stack) == 0 {
+			result.Linearized = best
+			result.State = describeState(bestState)
+			return result
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		linearized.clear(top.entry.op)
+		unlift(top.entry)
+		e = top.entry.next
+	}
+
+	result.OK = true
+	return result
+}
+
+func describeState(state string) string {
+	if state == absent {
+		return "not found"
+	}
+	return state
+}
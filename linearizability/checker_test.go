@@ -0,0 +1,169 @@
+package linearizability
+
+import (
+	"testing"
+	"time"
+)
+
+func set(value string, call, ret time.Duration) Operation {
+	return Operation{Kind: Set, Key: "k", Value: value, Call: call, Return: ret}
+}
+
+func get(value string, call, ret time.Duration) Operation {
+	return Operation{Kind: Get, Key: "k", Value: value, Found: value != "", Call: call, Return: ret}
+}
+
+func del(call, ret time.Duration) Operation {
+	return Operation{Kind: Delete, Key: "k", Call: call, Return: ret}
+}
+
+func unknown(op Operation) Operation {
+	op.Unknown = true
+	return op
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		history []Operation
+		ok      bool
+		// stuck is the operation that no order explains when the check fails
+		stuck int
+	}{
+		{
+			name: "sequential",
+			history: []Operation{
+				get("", 0, 10),
+				set(`"1"`, 20, 30),
+				get(`"1"`, 40, 50),
+				del(60, 70),
+				get("", 80, 90),
+			},
+			ok: true,
+		},
+		{
+			name: "concurrent read of either value",
+			history: []Operation{
+				set(`"1"`, 0, 10),
+				set(`"2"`, 20, 60),
+				get(`"1"`, 30, 40),
+				get(`"2"`, 35, 50),
+			},
+			ok: true,
+		},
+		{
+			name: "stale read",
+			history: []Operation{
+				set(`"1"`, 0, 10),
+				set(`"2"`, 20, 30),
+				get(`"1"`, 40, 50),
+			},
+			ok:    false,
+			stuck: 2,
+		},
+		{
+			name: "read reverting to an older value",
+			history: []Operation{
+				set(`"1"`, 0, 10),
+				set(`"2"`, 20, 60),
+				get(`"2"`, 30, 40),
+				get(`"1"`, 45, 55),
+			},
+			ok:    false,
+			stuck: 3,
+		},
+		{
+			name: "unknown set taking effect",
+			history: []Operation{
+				set(`"1"`, 0, 10),
+				unknown(set(`"2"`, 20, 30)),
+				get(`"2"`, 100, 110),
+			},
+			ok: true,
+		},
+		{
+			name: "unknown set never taking effect",
+			history: []Operation{
+				set(`"1"`, 0, 10),
+				unknown(set(`"2"`, 20, 30)),
+				get(`"1"`, 100, 110),
+			},
+			ok: true,
+		},
+		{
+			name: "unknown delete taking effect after its return",
+			history: []Operation{
+				set(`"1"`, 0, 10),
+				unknown(del(20, 30)),
+				get(`"1"`, 40, 50),
+				get("", 60, 70),
+			},
+			ok: true,
+		},
+		{
+			name: "read of a value never written",
+			history: []Operation{
+				unknown(set(`"1"`, 0, 10)),
+				get(`"2"`, 20, 30),
+			},
+			ok:    false,
+			stuck: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := Check(tt.history, time.Second)
+			if result.OK != tt.ok {
+				t.Fatalf("expected ok %v, got %v: %+v", tt.ok, result.OK, result.Keys)
+			}
+			if tt.ok {
+				return
+			}
+
+			failed := result.Failed()
+			if len(failed) != 1 || failed[0].Key != "k" {
+				t.Fatalf("expected key k to fail, got %+v", failed)
+			}
+			if failed[0].Stuck != tt.stuck {
+				t.Errorf("expected %s to be stuck, got %d", tt.history[tt.stuck], failed[0].Stuck)
+			}
+		})
+	}
+}
+
+func TestCheckKeysSeparately(t *testing.T) {
+	history := []Operation{
+		set(`"1"`, 0, 10),
+		{Kind: Set, Key: "other", Value: `"1"`, Call: 20, Return: 30},
+		get(`"1"`, 40, 50),
+		{Kind: Get, Key: "other", Value: `"2"`, Found: true, Call: 40, Return: 50},
+	}
+
+	result := Check(history, time.Second)
+	if result.OK || len(result.Keys) != 2 {
+		t.Fatalf("expected one of two keys to fail, got %+v", result)
+	}
+	failed := result.Failed()
+	if len(failed) != 1 || failed[0].Key != "other" {
+		t.Fatalf("expected key other to fail, got %+v", failed)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	history := []Operation{
+		set(`"1"`, 0, 10),
+		get(`"1"`, 20, 30),
+	}
+
+	result := Check(history, 0)
+	if result.OK {
+		t.Fatalf("expected a check that timed out not to pass, got %+v", result)
+	}
+	if timedOut := result.TimedOut(); len(timedOut) != 1 || timedOut[0].Key != "k" {
+		t.Fatalf("expected key k to time out, got %+v", result.Keys)
+	}
+	if failed := result.Failed(); len(failed) != 0 {
+		t.Fatalf("expected no counterexample, got %+v", failed)
+	}
+}
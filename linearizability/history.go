@@ -0,0 +1,92 @@
+// Package linearizability checks whether a history of operations on the keys
+// of the store could have happened on a single register per key, each
+// operation taking effect at one instant between its call and its return.
+package linearizability
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type Kind string
+
+const (
+	Get    Kind = "get"
+	Set    Kind = "set"
+	Delete Kind = "delete"
+)
+
+// Operation is one request of a client. Call and Return are offsets from the
+// start of the history, so that they follow the monotonic clock.
+type Operation struct {
+	Client int    `json:"client"`
+	Node   string `json:"node"`
+	Kind   Kind   `json:"kind"`
+	Key    string `json:"key"`
+	// Value is what a set wrote or a get read, as JSON
+	Value string `json:"value,omitempty"`
+	// Found is false for a get of a key that did not exist
+	Found bool `json:"found"`
+	// Unknown marks a set or delete whose outcome the client could not
+	// learn, e.g. because the leader was lost while applying it. It may
+	// have taken effect at any time after its call, or never.
+	Unknown bool          `json:"unknown"`
+	Call    time.Duration `json:"call"`
+	Return  time.Duration `json:"return"`
+	Error   string        `json:"error,omitempty"`
+}
+
+func (op Operation) String() string {
+	switch op.Kind {
+	case Set:
+		s := "set(" + op.Key + ", " + op.Value + ")"
+		if op.Unknown {
+			s += "?"
+		}
+		return s
+	case Delete:
+		s := "delete(" + op.Key + ")"
+		if op.Unknown {
+			s += "?"
+		}
+		return s
+	}
+	if !op.Found {
+		return "get(" + op.Key + ") -> not found"
+	}
+	return "get(" + op.Key + ") -> " + op.Value
+}
+
+// Recorder collects the operations of concurrent clients.
+type Recorder struct {
+	start time.Time
+
+	mu  sync.Mutex
+	ops []Operation
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+// Now is the offset to use as call or return time.
+func (r *Recorder) Now() time.Duration {
+	return time.Since(r.start)
+}
+
+// Add records a finished operation.
+func (r *Recorder) Add(op Operation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ops = append(r.ops, op)
+}
+
+// History returns the recorded operations ordered by call time.
+func (r *Recorder) History() []Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ops := append([]Operation(nil), r.ops...)
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+	return ops
+}
@@ -0,0 +1,221 @@
+package linearizability
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// contextOps is how many operations of the linearized order before the one
+// that cannot follow are shown.
+const contextOps = 20
+
+// Text describes why the operations on a key are not linearizable: the end of
+// the longest order found, the state it leads to and the operation that
+// cannot follow.
+func Text(kr KeyResult) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "key %s is not linearizable\n", kr.Key)
+	fmt.Fprintf(&b, "longest linearizable order of %d out of %d operations:\n", len(kr.Linearized), len(kr.Ops))
+	first := 0
+	if len(kr.Linearized) > contextOps {
+		first = len(kr.Linearized) - contextOps
+		fmt.Fprintf(&b, "  ... %d earlier operations\n", first)
+	}
+	for i := first; i < len(kr.Linearized); i++ {
+		op := kr.Ops[kr.Linearized[i]]
+		fmt.Fprintf(&b, "  %3d. client %d on %s: %s [%s, %s]\n", i+1, op.Client, op.Node, op, op.Call, returnTime(op))
+	}
+	fmt.Fprintf(&b, "state afterwards: %s\n", kr.State)
+	if kr.Stuck >= 0 {
+		op := kr.Ops[kr.Stuck]
+		fmt.Fprintf(&b, "cannot linearize: client %d on %s: %s [%s, %s]\n", op.Client, op.Node, op, op.Call, returnTime(op))
+	}
+	return b.String()
+}
+
+func returnTime(op Operation) string {
+	if op.Unknown {
+		return "unknown"
+	}
+	return op.Return.String()
+}
+
+// focus returns the operations overlapping the stretch of time from the last
+// operations of the linearized order to the one that cannot follow.
+func focus(kr KeyResult) []int {
+	if kr.Stuck < 0 {
+		return nil
+	}
+	stuck := kr.Ops[kr.Stuck]
+	from, to := stuck.Call, stuck.Return
+	if stuck.Unknown {
+		to = stuck.Call
+	}
+	first := len(kr.Linearized) - contextOps
+	if first < 0 {
+		first = 0
+	}
+	for _, idx := range kr.Linearized[first:] {
+		if op := kr.Ops[idx]; op.Call < from {
+			from = op.Call
+		}
+	}
+
+	// Operations of unknown outcome called earlier could stretch the time
+	// shown over the whole history
+	var ops []int
+	for i, op := range kr.Ops {
+		if op.Call <= to && ((op.Unknown && op.Call >= from) || (!op.Unknown && op.Return >= from)) {
+			ops = append(ops, i)
+		}
+	}
+	return ops
+}
+
+// HTML renders the failed keys as timelines, one row per client, showing the
+// operations around the conflict. The operations of the longest linearizable
+// order are green and numbered in that order, the operation that cannot
+// follow is red.
+func HTML(w io.Writer, failed []KeyResult) error {
+	type bar struct {
+		X, Y, Width float64
+		Label       string
+		Title       string
+		Class       string
+	}
+	type timeline struct {
+		Key     string
+		Text    string
+		Width   float64
+		Height  float64
+		Clients []struct {
+			Y     float64
+			Label string
+		}
+		Bars []bar
+	}
+
+	const (
+		rowHeight  = 34.0
+		labelWidth = 90.0
+		plotWidth  = 1400.0
+	)
+
+	var timelines []timeline
+	for _, kr := range failed {
+		tl := timeline{Key: kr.Key, Text: Text(kr), Width: labelWidth + plotWidth + 20}
+
+		// Only the stretch of time around the conflict is interesting
+		shown := focus(kr)
+		var from, to time.Duration = -1, 0
+		for _, i := range shown {
+			op := kr.Ops[i]
+			if from < 0 || op.Call < from {
+				from = op.Call
+			}
+			if !op.Unknown && op.Return > to {
+				to = op.Return
+			}
+			if op.Call > to {
+				to = op.Call
+			}
+		}
+		span := float64(to - from)
+		if span <= 0 {
+			span = 1
+		}
+		x := func(t time.Duration) float64 {
+			return labelWidth + plotWidth*float64(t-from)/span
+		}
+
+		clients := make(map[int]int)
+		var ids []int
+		for _, i := range shown {
+			op := kr.Ops[i]
+			if _, ok := clients[op.Client]; !ok {
+				clients[op.Client] = 0
+				ids = append(ids, op.Client)
+			}
+		}
+		sort.Ints(ids)
+		for row, id := range ids {
+			clients[id] = row
+			tl.Clients = append(tl.Clients, struct {
+				Y     float64
+				Label string
+			}{Y: float64(row)*rowHeight + 22, Label: fmt.Sprintf("client %d", id)})
+		}
+		tl.Height = float64(len(ids))*rowHeight + 10
+
+		order := make(map[int]int)
+		for i, idx := range kr.Linearized {
+			order[idx] = i + 1
+		}
+		for _, i := range shown {
+			op := kr.Ops[i]
+			end := x(to)
+			if !op.Unknown {
+				end = x(op.Return)
+			}
+			b := bar{
+				X:     x(op.Call),
+				Y:     float64(clients[op.Client])*rowHeight + 6,
+				Width: end - x(op.Call),
+				Label: op.String(),
+				Title: fmt.Sprintf("%s on %s, %s - %s", op, op.Node, op.Call, returnTime(op)),
+				Class: "op",
+			}
+			if b.Width < 2 {
+				b.Width = 2
+			}
+			if n, ok := order[i]; ok {
+				b.Class = "linearized"
+				b.Label = fmt.Sprintf("%d: %s", n, b.Label)
+			}
+			if i == kr.Stuck {
+				b.Class = "stuck"
+			}
+			if op.Unknown {
+				b.Class += " unknown"
+			}
+			tl.Bars = append(tl.Bars, b)
+		}
+		timelines = append(timelines, tl)
+	}
+
+	return htmlTemplate.Execute(w, timelines)
+}
+
+var htmlTemplate = template.Must(template.New("history").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Linearizability counterexample</title>
+<style>
+body { font-family: sans-serif; margin: 20px; }
+pre { background: #f4f4f4; padding: 10px; }
+rect.op { fill: #d0d0d0; }
+rect.linearized { fill: #8fd18f; }
+rect.stuck { fill: #f08080; }
+rect.unknown { fill-opacity: 0.4; stroke: #666; stroke-dasharray: 4 2; }
+text { font-size: 11px; }
+</style>
+</head>
+<body>
+<h1>Linearizability counterexample</h1>
+<p>Every row is a client, every bar an operation from its call to its return. Green operations form the longest order that explains their results, numbered in that order; the red one cannot follow them. Dashed operations have an unknown outcome.</p>
+{{range .}}
+<h2>Key {{.Key}}</h2>
+<pre>{{.Text}}</pre>
+<svg width="{{.Width}}" height="{{.Height}}">
+{{range .Clients}}<text x="0" y="{{.Y}}">{{.Label}}</text>
+{{end}}{{range .Bars}}<g><title>{{.Title}}</title><rect class="{{.Class}}" x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="22"></rect><text x="{{.X}}" y="{{.Y}}" dx="3" dy="15">{{.Label}}</text></g>
+{{end}}</svg>
+{{end}}
+</body>
+</html>
+`))
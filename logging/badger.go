@@ -0,0 +1,38 @@
+package logging
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
+)
+
+type badgerLogger struct {
+	logger hclog.Logger
+}
+
+// BadgerLogger lets Badger write its messages through logger.
+func BadgerLogger(logger hclog.Logger) badger.Logger {
+	return badgerLogger{logger: logger}
+}
+
+func (b badgerLogger) Errorf(format string, args ...interface{}) {
+	b.logger.Error(message(format, args))
+}
+
+func (b badgerLogger) Warningf(format string, args ...interface{}) {
+	b.logger.Warn(message(format, args))
+}
+
+func (b badgerLogger) Infof(format string, args ...interface{}) {
+	b.logger.Info(message(format, args))
+}
+
+func (b badgerLogger) Debugf(format string, args ...interface{}) {
+	b.logger.Debug(message(format, args))
+}
+
+func message(format string, args []interface{}) string {
+	return strings.TrimSpace(fmt.Sprintf(format, args...))
+}
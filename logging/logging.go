@@ -0,0 +1,175 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Config selects the format and the levels of the loggers.
+type Config struct {
+	// Level of all subsystems without their own level
+	Level string
+	// Levels of single subsystems, e.g. "raft=warn,http=debug"
+	Levels string
+	// JSON writes one JSON object per line instead of text
+	JSON bool
+	// Output defaults to stderr
+	Output io.Writer
+}
+
+// Loggers hands out one logger per subsystem, e.g. raft, transport or http.
+// All of them write to the same output in the same format, but each has its
+// own level that can be changed at runtime.
+type Loggers struct {
+	output    io.Writer
+	outputMu  *sync.Mutex
+	json      bool
+	mu        sync.Mutex
+	level     hclog.Level
+	levels    map[string]hclog.Level
+	loggers   map[string]hclog.Logger
+	overrides map[string]bool
+}
+
+func New(cfg Config) (*Loggers, error) {
+	level, err := parseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Loggers{
+		output:    cfg.Output,
+		outputMu:  &sync.Mutex{},
+		json:      cfg.JSON,
+		level:     level,
+		levels:    make(map[string]hclog.Level),
+		loggers:   make(map[string]hclog.Logger),
+		overrides: make(map[string]bool),
+	}
+	if l.output == nil {
+		l.output = os.Stderr
+	}
+
+	for _, pair := range strings.Split(cfg.Levels, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid subsystem level %s, expected <subsystem>=<level>", pair)
+		}
+		subLevel, err := parseLevel(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSpace(parts[0])
+		l.levels[name] = subLevel
+		l.overrides[name] = true
+	}
+	return l, nil
+}
+
+// Logger returns the logger of a subsystem. On nil Loggers it returns a text
+// logger at info level, so components work without logging being set up.
+func (l *Loggers) Logger(subsystem string) hclog.Logger {
+	if l == nil {
+		return hclog.New(&hclog.LoggerOptions{Name: subsystem})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if logger, ok := l.loggers[subsystem]; ok {
+		return logger
+	}
+
+	level, ok := l.levels[subsystem]
+	if !ok {
+		level = l.level
+		l.levels[subsystem] = level
+	}
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:       subsystem,
+		Level:      level,
+		Output:     l.output,
+		Mutex:      l.outputMu,
+		JSONFormat: l.json,
+	})
+	l.loggers[subsystem] = logger
+	return logger
+}
+
+// SetLevel changes the level of a subsystem, or of all subsystems without
+// their own level when subsystem is empty.
+func (l *Loggers) SetLevel(subsystem, level string) error {
+	parsed, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if subsystem == "" {
+		l.level = parsed
+		for name, logger := range l.loggers {
+			if !l.overrides[name] {
+				l.levels[name] = parsed
+				logger.SetLevel(parsed)
+			}
+		}
+		return nil
+	}
+
+	l.levels[subsystem] = parsed
+	l.overrides[subsystem] = true
+	if logger, ok := l.loggers[subsystem]; ok {
+		logger.SetLevel(parsed)
+	}
+	return nil
+}
+
+// Levels returns the level of every subsystem in use, the default level is
+// listed under "default".
+func (l *Loggers) Levels() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	levels := map[string]string{"default": levelName(l.level)}
+	for name, level := range l.levels {
+		levels[name] = levelName(level)
+	}
+	return levels
+}
+
+func parseLevel(level string) (hclog.Level, error) {
+	if strings.TrimSpace(level) == "" {
+		return hclog.Info, nil
+	}
+	parsed := hclog.LevelFromString(strings.TrimSpace(level))
+	if parsed == hclog.NoLevel {
+		return hclog.NoLevel, fmt.Errorf("unknown log level %s", level)
+	}
+	return parsed, nil
+}
+
+func levelName(level hclog.Level) string {
+	switch level {
+	case hclog.Trace:
+		return "trace"
+	case hclog.Debug:
+		return "debug"
+	case hclog.Info:
+		return "info"
+	case hclog.Warn:
+		return "warn"
+	case hclog.Error:
+		return "error"
+	}
+	return "unknown"
+}
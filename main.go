@@ -1,125 +1,508 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"dpasswd/autopilot"
+	"dpasswd/backup"
+	"dpasswd/events"
 	"dpasswd/fsm"
 	"dpasswd/httpd"
+	"dpasswd/logging"
+	"dpasswd/metrics"
+	"dpasswd/replication"
+	"dpasswd/shard"
+	"dpasswd/transport"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
-	"path"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/dgraph-io/badger/v2"
+	gometrics "github.com/armon/go-metrics"
 	"github.com/hashicorp/raft"
-	raftboltdb "github.com/hashicorp/raft-boltdb"
 )
 
 var dataDir string
 var httpPort int
 var nodeID string
 var raftPort int
+var shutdownTimeout time.Duration
+var leaveOnTerminate bool
+var raftTLS transport.TLSConfig
+var httpAdvertise string
+var forwardMode string
+var raftCfg = raft.DefaultConfig()
+var shardMode string
+var shardGroups int
+var shardRanges string
+var replicateTo string
+var standby bool
+var eventWebhooks string
+var eventWebhookSecret string
+var eventLog string
+var autopilotEnabled bool
+var autopilotCfg = autopilot.DefaultConfig()
+var backupInterval time.Duration
+var backupDir string
+var backupS3 backup.S3Config
+var backupRetention backup.Retention
+var backupKeyFile string
+var backupLogInterval time.Duration
+var backupTarget backup.Target
+var backupKey []byte
+var digestCheckInterval time.Duration
+var consistencyTokenTimeout time.Duration
+var logCfg logging.Config
+var loggers *logging.Loggers
 
 func init() {
 	flag.StringVar(&dataDir, "datadir", "data", "Data storage directory")
 	flag.IntVar(&httpPort, "http-port", 3100, "HTTP server listen port")
 	flag.StringVar(&nodeID, "id", "", "Node ID")
 	flag.IntVar(&raftPort, "raft-port", 4200, "Raft RPC port")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "Deadline for finishing in-flight HTTP requests on shutdown")
+	flag.BoolVar(&leaveOnTerminate, "leave-on-terminate", false, "Remove this node from the cluster configuration on shutdown")
+	flag.StringVar(&httpAdvertise, "http-advertise", "", "HTTP address other nodes reach this node at (default <ip>:<http-port>)")
+	flag.StringVar(&forwardMode, "forward-mode", "none", "What followers do with leader-only requests: none, proxy or redirect")
+	flag.DurationVar(&raftCfg.HeartbeatTimeout, "raft-heartbeat-timeout", raftCfg.HeartbeatTimeout, "Time a follower waits without contact from the leader before becoming a candidate")
+	flag.DurationVar(&raftCfg.ElectionTimeout, "raft-election-timeout", raftCfg.ElectionTimeout, "Time a candidate waits without contact from the leader before starting an election")
+	flag.DurationVar(&raftCfg.CommitTimeout, "raft-commit-timeout", raftCfg.CommitTimeout, "Time without an Apply after which the leader sends a heartbeat to advance the commit index")
+	flag.DurationVar(&raftCfg.LeaderLeaseTimeout, "raft-leader-lease-timeout", raftCfg.LeaderLeaseTimeout, "Time a leader stays leader without contact from a quorum")
+	flag.IntVar(&raftCfg.MaxAppendEntries, "raft-max-append-entries", raftCfg.MaxAppendEntries, "Maximum number of log entries sent in one AppendEntries request")
+	flag.DurationVar(&raftCfg.SnapshotInterval, "raft-snapshot-interval", raftCfg.SnapshotInterval, "How often to check whether a snapshot should be taken")
+	flag.Uint64Var(&raftCfg.TrailingLogs, "raft-trailing-logs", raftCfg.TrailingLogs, "Number of log entries kept after a snapshot so slow followers can catch up")
+	flag.StringVar(&shardMode, "shard-mode", "", "Spread keys over multiple raft groups by hash or prefix (default one group)")
+	flag.IntVar(&shardGroups, "shard-groups", 1, "Number of raft groups of a new cluster in hash mode")
+	flag.StringVar(&shardRanges, "shard-ranges", "", "Comma separated key range boundaries of a new cluster in prefix mode")
+	flag.StringVar(&replicateTo, "replicate-to", "", "Comma separated HTTP addresses of a standby cluster to replicate to")
+	flag.BoolVar(&standby, "standby", false, "Start a new cluster as standby replica, rejecting client writes until promoted")
+	flag.BoolVar(&autopilotEnabled, "autopilot", false, "Remove dead servers and promote new voters once they are stable, run by the leader")
+	flag.BoolVar(&autopilotCfg.CleanupDeadServers, "autopilot-cleanup-dead-servers", autopilotCfg.CleanupDeadServers, "Remove servers that stayed unhealthy for the dead server timeout")
+	flag.DurationVar(&autopilotCfg.DeadServerTimeout, "autopilot-dead-server-timeout", autopilotCfg.DeadServerTimeout, "Time a server has to be unhealthy before it is removed")
+	flag.DurationVar(&autopilotCfg.LastContactThreshold, "autopilot-last-contact-threshold", autopilotCfg.LastContactThreshold, "Time without contact from a server after which it is unhealthy")
+	flag.Uint64Var(&autopilotCfg.MaxTrailingLogs, "autopilot-max-trailing-logs", autopilotCfg.MaxTrailingLogs, "Number of log entries a server may lag behind the leader and still be healthy")
+	flag.DurationVar(&autopilotCfg.ServerStabilizationTime, "autopilot-stabilization-time", autopilotCfg.ServerStabilizationTime, "Time a new server has to be healthy before it is promoted to voter")
+	flag.IntVar(&autopilotCfg.MinQuorum, "autopilot-min-quorum", autopilotCfg.MinQuorum, "Number of voters dead servers are never removed below")
+	flag.StringVar(&eventWebhooks, "event-webhooks", "", "Comma separated URLs cluster events are posted to")
+	flag.StringVar(&eventWebhookSecret, "event-webhook-secret", "", "Secret for signing the events posted to webhooks")
+	flag.StringVar(&eventLog, "event-log", "", "File cluster events are appended to as JSON lines")
+	flag.DurationVar(&backupInterval, "backup-interval", 0, "How often the leader writes a backup to the backup target (default no scheduled backups)")
+	flag.StringVar(&backupDir, "backup-dir", "", "Directory scheduled backups are written to")
+	flag.StringVar(&backupS3.Endpoint, "backup-s3-endpoint", "", "URL of an S3-compatible store scheduled backups are written to, credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	flag.StringVar(&backupS3.Bucket, "backup-s3-bucket", "", "Bucket of the S3 backup target")
+	flag.StringVar(&backupS3.Prefix, "backup-s3-prefix", "", "Prefix of the names of the backups in the S3 bucket")
+	flag.StringVar(&backupS3.Region, "backup-s3-region", "us-east-1", "Region of the S3 backup target")
+	flag.IntVar(&backupRetention.Hourly, "backup-retain-hourly", 24, "Number of hours the newest backup is kept for")
+	flag.IntVar(&backupRetention.Daily, "backup-retain-daily", 7, "Number of days the newest backup is kept for")
+	flag.IntVar(&backupRetention.Weekly, "backup-retain-weekly", 4, "Number of weeks the newest backup is kept for")
+	flag.DurationVar(&backupLogInterval, "backup-log-interval", time.Minute, "How often the leader archives the committed raft log next to the scheduled backups, for point-in-time recovery (0 disables)")
+	flag.StringVar(&backupKeyFile, "backup-encryption-key-file", "", "File holding a 32 byte key scheduled backups are encrypted with and restores decrypt with")
+	flag.DurationVar(&digestCheckInterval, "digest-check-interval", time.Minute, "How often the leader compares the state digests of the members to detect diverged replicas (0 disables)")
+	flag.DurationVar(&consistencyTokenTimeout, "consistency-token-timeout", 2*time.Second, "Time a read with an X-Consistency-Token header waits for this node to apply the index of the token, below the HTTP write timeout of 5s")
+	flag.StringVar(&logCfg.Level, "log-level", "info", "Log level of all subsystems: trace, debug, info, warn or error")
+	flag.StringVar(&logCfg.Levels, "log-levels", "", "Comma separated log levels of single subsystems, e.g. raft=warn,http=debug")
+	flag.BoolVar(&logCfg.JSON, "log-json", false, "Write logs as JSON")
+	flag.StringVar(&raftTLS.CAFile, "raft-tls-ca", "", "CA certificate for verifying raft peers (enables mutual TLS)")
+	flag.StringVar(&raftTLS.CertFile, "raft-tls-cert", "", "Certificate presented to raft peers")
+	flag.StringVar(&raftTLS.KeyFile, "raft-tls-key", "", "Private key of the raft certificate")
+	flag.BoolVar(&raftTLS.PinPeers, "raft-tls-pin-peers", false, "Require raft peer certificates to carry the peer's node ID as a DNS SAN")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s recover --datadir <dir> [--group <id>] (--peers <peers.json> | --dry-run)\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s promote --addr <http address of a standby node>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s %s\n", os.Args[0], inspectUsage)
+		fmt.Fprintf(os.Stderr, "       %s %s\n", os.Args[0], restoreUsage)
 		flag.PrintDefaults()
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "recover" {
+		runRecover(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "promote" {
+		runPromote(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		runInspect(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		runRestore(os.Args[2:])
+		return
+	}
+
 	// Parse command line arguments
 	flag.Parse()
 
-	// Setup key-value database using badgerDB to be used as the FSM
-	badgerOpts := badger.DefaultOptions(dataDir)
-	badgerDB, err := badger.Open(badgerOpts)
-	if err != nil {
+	var err error
+	if loggers, err = logging.New(logCfg); err != nil {
 		log.Fatal(err)
 	}
-	defer func() {
-		if err := badgerDB.Close(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error closing badgerDB: %s\n", err.Error())
-		}
-	}()
-	kvFSM := fsm.NewRaftFSM(badgerDB)
+	logger := loggers.Logger("main")
+
+	fwdMode, err := httpd.ParseForwardMode(forwardMode)
+	if err != nil {
+		fatal("invalid forward mode", err)
+	}
+
+	if consistencyTokenTimeout <= 0 || consistencyTokenTimeout >= httpd.WriteTimeout {
+		fatal("invalid consistency token timeout", fmt.Errorf("%s has to be above 0 and below the HTTP write timeout of %s", consistencyTokenTimeout, httpd.WriteTimeout))
+	}
 
-	// Setup raft server
-	raftCfg := raft.DefaultConfig()
 	raftCfg.LocalID = raft.ServerID(nodeID)
 	raftCfg.SnapshotThreshold = 1024
+	if err := validateRaftConfig(raftCfg); err != nil {
+		fatal("invalid raft configuration", err)
+	}
 
-	logDB, err := raftboltdb.NewBoltStore(path.Join(dataDir, "log"))
-	if err != nil {
-		log.Fatal(err)
+	ipAddr := getIP()
+	if httpAdvertise == "" {
+		httpAdvertise = fmt.Sprintf("%s:%d", ipAddr, httpPort)
 	}
 
-	var raftLogCacheSize = 256
-	cacheDB, err := raft.NewLogCache(raftLogCacheSize, logDB)
+	initialMap, err := initialShardMap()
 	if err != nil {
-		log.Fatal(err)
+		fatal("invalid sharding configuration", err)
+	}
+	if initialMap != nil && (replicateTo != "" || standby) {
+		fatal("invalid sharding configuration", fmt.Errorf("replication to a standby cluster does not support sharding"))
 	}
 
-	var raftSnapShotRetain = 2
-	ssDB, err := raft.NewFileSnapshotStore(dataDir, raftSnapShotRetain, os.Stdout)
+	if err := setupBackups(); err != nil {
+		fatal("invalid backup configuration", err)
+	}
+
+	// Raft reports its metrics to the global go-metrics sink, which has to
+	// be set up before the first group starts
+	registry, err := metrics.Setup("dpasswd")
 	if err != nil {
-		log.Fatal(err)
+		fatal("error setting up metrics", err)
 	}
 
-	ipAddr := getIP()
+	// Leader, peer and heartbeat changes of every group are published on the
+	// event bus
+	bus := events.NewBus(nodeID)
+	var webhooks []*events.Webhook
+	for _, url := range strings.Split(eventWebhooks, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			w := events.NewWebhook(url, eventWebhookSecret, loggers.Logger("events"))
+			w.Start(bus)
+			webhooks = append(webhooks, w)
+		}
+	}
+	var eventFile *events.FileLog
+	if eventLog != "" {
+		if eventFile, err = events.NewFileLog(eventLog, loggers.Logger("events")); err != nil {
+			fatal("error opening event log", err)
+		}
+		eventFile.Start(bus)
+	}
 
-	var raftBindAddr = fmt.Sprintf("%s:%d", ipAddr, raftPort)
-	tcpAddr, err := net.ResolveTCPAddr("tcp", raftBindAddr)
+	g0, err := openGroup(0, ipAddr, true, bus)
 	if err != nil {
-		log.Fatal(err)
+		fatal("error opening raft group", err)
 	}
+	events.Observe(g0.raft, 0, bus)
 
-	var raftMaxPool = 5
-	var raftTcpTimeout = 5 * time.Second
-	transport, err := raft.NewTCPTransport(raftBindAddr, tcpAddr, raftMaxPool, raftTcpTimeout, os.Stdout)
-	if err != nil {
-		log.Fatal(err)
+	var groupsMu sync.Mutex
+	groups := []*group{g0}
+	serverOpts := func(g *group) []httpd.Option {
+		opts := []httpd.Option{
+			httpd.WithTracker(g.tracker),
+			httpd.WithForwarding(fwdMode),
+			httpd.WithAdvertise(raft.ServerID(nodeID), httpAdvertise),
+			httpd.WithRaftConfig(raftCfg),
+			httpd.WithLogging(loggers),
+			httpd.WithSnapshotStore(g.ssDB),
+			httpd.WithDigests(g.digests),
+			httpd.WithConsistencyTokenTimeout(consistencyTokenTimeout),
+		}
+		if g.pilot != nil {
+			opts = append(opts, httpd.WithAutopilot(g.pilot))
+		}
+		if g.faults != nil {
+			opts = append(opts, httpd.WithFaults(g.faults))
+		}
+		if backupKey != nil {
+			opts = append(opts, httpd.WithBackupKey(backupKey))
+		}
+		if g.backups != nil {
+			opts = append(opts, httpd.WithBackupScheduler(g.backups))
+		}
+		if g.checker != nil {
+			opts = append(opts, httpd.WithDigestChecker(g.checker))
+		}
+		return opts
 	}
 
-	r, err := raft.NewRaft(raftCfg, kvFSM, cacheDB, logDB, ssDB, transport)
-	if err != nil {
-		log.Fatal(err)
+	// With sharding every further group is served through the HTTP server of
+	// group 0, which routes each request to the group owning it
+	var manager *shard.Manager
+	if initialMap != nil {
+		openFn := func(id int, bootstrap bool) (*shard.Group, error) {
+			g, err := openGroup(id, ipAddr, bootstrap, bus)
+			if err != nil {
+				return nil, err
+			}
+			events.Observe(g.raft, id, bus)
+			groupsMu.Lock()
+			groups = append(groups, g)
+			groupsMu.Unlock()
+
+			s := httpd.NewHTTPServer("", g.raft, g.db, serverOpts(g)...)
+			g.closeServer = s.Close
+			remove := func() error {
+				groupsMu.Lock()
+				for i := range groups {
+					if groups[i] == g {
+						groups = append(groups[:i], groups[i+1:]...)
+						break
+					}
+				}
+				groupsMu.Unlock()
+				return g.remove()
+			}
+			return &shard.Group{ID: id, Raft: g.raft, DB: g.db, Handler: s.Handler(), Remove: remove}, nil
+		}
+
+		manager, err = shard.NewManager(raft.ServerID(nodeID), &shard.Group{ID: 0, Raft: g0.raft, DB: g0.db}, initialMap, openFn, loggers.Logger("shard"))
+		if err != nil {
+			fatal("error starting shard manager", err)
+		}
 	}
 
-	// Start the raft server
-	r.BootstrapCluster(raft.Configuration{
-		Servers: []raft.Server{
-			{
-				ID:      raft.ServerID(nodeID),
-				Address: transport.LocalAddr(),
-			},
-		},
+	registry.Collect(func() {
+		groupsMu.Lock()
+		defer groupsMu.Unlock()
+		for _, g := range groups {
+			lsm, vlog := g.db.Size()
+			labels := []gometrics.Label{{Name: "group", Value: strconv.Itoa(g.id)}}
+			gometrics.SetGaugeWithLabels([]string{"badger", "lsm_size_bytes"}, float32(lsm), labels)
+			gometrics.SetGaugeWithLabels([]string{"badger", "vlog_size_bytes"}, float32(vlog), labels)
+		}
 	})
 
+	if raftTLS.CAFile != "" || raftTLS.CertFile != "" || raftTLS.KeyFile != "" {
+		// Certificates are also picked up when their files change, SIGHUP
+		// forces a reload
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		go func() {
+			for range hupCh {
+				groupsMu.Lock()
+				for _, g := range groups {
+					if err := g.tlsLayer.Reload(); err != nil {
+						g.logger.Error("error reloading raft TLS certificates", "error", err)
+					}
+				}
+				groupsMu.Unlock()
+			}
+		}()
+	}
+
 	// Setup and start the HTTP Server
 	var httpBindAddr = fmt.Sprintf(":%d", httpPort)
-	s := httpd.NewHTTPServer(httpBindAddr, r, badgerDB)
-	if err := s.Start(); err != nil {
-		log.Fatal(err)
+	opts := append(serverOpts(g0), httpd.WithMetrics(registry), httpd.WithEvents(bus))
+	if manager != nil {
+		opts = append(opts, httpd.WithRouter(manager))
+	}
+	var source *replication.Source
+	if replicateTo != "" {
+		source = replication.NewSource(strings.Split(replicateTo, ","), g0.raft, g0.logDB, g0.ssDB, loggers.Logger("replication"))
+		opts = append(opts, httpd.WithReplicationSource(source))
+	}
+	if standby {
+		opts = append(opts, httpd.WithStandby())
+	}
+	s := httpd.NewHTTPServer(httpBindAddr, g0.raft, g0.db, opts...)
+	go func() {
+		if err := s.Start(); err != nil && err != http.ErrServerClosed {
+			fatal("error starting HTTP server", err)
+		}
+	}()
+
+	// Wait for a termination signal and shut everything down in order
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	logger.Info("shutting down", "signal", sig.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Error("error shutting down HTTP server", "error", err)
+	}
+
+	if source != nil {
+		source.Stop()
+	}
+	if manager != nil {
+		manager.Stop()
+	}
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	for _, g := range groups {
+		g.close()
+	}
+
+	for _, w := range webhooks {
+		w.Stop()
+	}
+	if eventFile != nil {
+		eventFile.Stop()
 	}
 }
 
+// initialShardMap describes the groups of a new cluster from the command line.
+// It is nil without sharding.
+func initialShardMap() (*shard.Map, error) {
+	switch shardMode {
+	case "":
+		return nil, nil
+	case shard.ModeHash:
+		return shard.NewHashMap(shardGroups)
+	case shard.ModePrefix:
+		if shardRanges == "" {
+			return nil, fmt.Errorf("prefix sharding needs --shard-ranges")
+		}
+		return shard.NewPrefixMap(strings.Split(shardRanges, ","))
+	}
+	return nil, fmt.Errorf("unknown shard mode %s", shardMode)
+}
+
+// setupBackups loads the backup key and opens the target of scheduled backups
+// from the command line.
+func setupBackups() error {
+	if backupKeyFile != "" {
+		key, err := backup.LoadKey(backupKeyFile)
+		if err != nil {
+			return fmt.Errorf("error loading backup encryption key: %w", err)
+		}
+		backupKey = key
+	}
+	if backupInterval <= 0 {
+		return nil
+	}
+
+	var err error
+	switch {
+	case backupDir != "" && backupS3.Endpoint != "":
+		return fmt.Errorf("--backup-dir and --backup-s3-endpoint are mutually exclusive")
+	case backupDir != "":
+		backupTarget, err = backup.NewDirTarget(backupDir)
+	case backupS3.Endpoint != "":
+		backupS3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		backupS3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		backupTarget, err = backup.NewS3Target(backupS3)
+	default:
+		return fmt.Errorf("scheduled backups need --backup-dir or --backup-s3-endpoint")
+	}
+	return err
+}
+
+// validateRaftConfig checks the timing parameters against each other, on top
+// of the checks raft itself does.
+func validateRaftConfig(cfg *raft.Config) error {
+	if err := raft.ValidateConfig(cfg); err != nil {
+		return err
+	}
+	if cfg.CommitTimeout >= cfg.HeartbeatTimeout {
+		return fmt.Errorf("raft commit timeout (%s) must be lower than the heartbeat timeout (%s)", cfg.CommitTimeout, cfg.HeartbeatTimeout)
+	}
+	if cfg.SnapshotInterval < cfg.ElectionTimeout {
+		return fmt.Errorf("raft snapshot interval (%s) must not be lower than the election timeout (%s)", cfg.SnapshotInterval, cfg.ElectionTimeout)
+	}
+	if cfg.TrailingLogs == 0 {
+		return fmt.Errorf("raft trailing logs must be positive")
+	}
+	return nil
+}
+
+// leaveTimeout bounds how long a follower waits for the leader to remove it
+// from the cluster configuration.
+const leaveTimeout = 10 * time.Second
+
+// leaveCluster removes this node from the cluster configuration of a group.
+// Only the leader can change the configuration, so a follower asks the
+// leader to remove it through /raft/remove.
+func leaveCluster(g *group) {
+	r := g.raft
+	if r.State() != raft.Leader {
+		if err := leaveThroughLeader(g); err != nil {
+			g.logger.Error("error asking the leader to remove this node", "node", nodeID, "error", err)
+		}
+		return
+	}
+
+	// The leader steps down once the configuration without it is committed
+	if err := r.RemoveServer(raft.ServerID(nodeID), 0, 0).Error(); err != nil {
+		g.logger.Error("error removing node from the cluster", "node", nodeID, "error", err)
+	}
+}
+
+func leaveThroughLeader(g *group) error {
+	_, leaderID := g.raft.LeaderWithID()
+	if leaderID == "" {
+		return fmt.Errorf("no leader known")
+	}
+	var addr string
+	if err := fsm.ReadMeta(g.db, fsm.NodeHTTPAddressKey(string(leaderID)), &addr); err != nil {
+		return err
+	}
+	if addr == "" {
+		return fmt.Errorf("leader %s registered no HTTP address", leaderID)
+	}
+
+	u := fmt.Sprintf("http://%s/raft/remove", addr)
+	if g.id != 0 {
+		u += fmt.Sprintf("?group=%d", g.id)
+	}
+	body, err := json.Marshal(map[string]string{"node_id": nodeID})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: leaveTimeout}
+	resp, err := client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		var result struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return fmt.Errorf("%s: %s", resp.Status, result.Error)
+	}
+	g.logger.Info("removed from the cluster by the leader", "node", nodeID, "leader", leaderID)
+	return nil
+}
+
 func getIP() string {
 	ifA, err := net.InterfaceAddrs()
 	if err != nil {
-		log.Fatal(err)
+		fatal("error listing interface addresses", err)
 	}
 	var ipAddr string
 	for _, v := range ifA {
 		if v.String() != "127.0.0.1/8" {
 			ip, _, err := net.ParseCIDR(v.String())
 			if err != nil {
-				log.Fatal(err)
+				fatal("error parsing interface address", err)
 			}
 			ipAddr = ip.String()
 			break
@@ -127,3 +510,9 @@ func getIP() string {
 	}
 	return ipAddr
 }
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	loggers.Logger("main").Error(msg, "error", err)
+	os.Exit(1)
+}
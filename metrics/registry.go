@@ -0,0 +1,224 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	gometrics "github.com/armon/go-metrics"
+)
+
+// Registry is a go-metrics sink that keeps the current value of every metric
+// and writes them in the Prometheus text exposition format. Counters
+// accumulate, gauges keep their last value and samples, e.g. timings in
+// milliseconds, are exposed as summaries of their count and sum.
+type Registry struct {
+	mu         sync.Mutex
+	metrics    map[string]*metric
+	kinds      map[string]kind
+	collectors []func()
+}
+
+type kind int
+
+const (
+	kindCounter kind = iota
+	kindGauge
+	kindSummary
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindCounter:
+		return "counter"
+	case kindGauge:
+		return "gauge"
+	}
+	return "summary"
+}
+
+type metric struct {
+	name   string
+	labels string
+	kind   kind
+	value  float64
+	count  uint64
+}
+
+// Setup makes a new registry the global go-metrics sink, which raft and the
+// rest of the server report to. Metric names are prefixed with the service
+// name.
+func Setup(serviceName string) (*Registry, error) {
+	r := NewRegistry()
+	cfg := gometrics.DefaultConfig(serviceName)
+	cfg.EnableHostname = false
+	if _, err := gometrics.NewGlobal(cfg, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]*metric),
+		kinds:   make(map[string]kind),
+	}
+}
+
+// Collect registers fn to run before every scrape, for gauges that are cheaper
+// to read on demand than to keep up to date.
+func (r *Registry) Collect(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, fn)
+}
+
+func (r *Registry) SetGauge(key []string, val float32) {
+	r.SetGaugeWithLabels(key, val, nil)
+}
+
+func (r *Registry) SetGaugeWithLabels(key []string, val float32, labels []gometrics.Label) {
+	r.update(kindGauge, key, labels, func(m *metric) {
+		m.value = float64(val)
+	})
+}
+
+func (r *Registry) EmitKey(key []string, val float32) {
+	r.SetGauge(key, val)
+}
+
+func (r *Registry) IncrCounter(key []string, val float32) {
+	r.IncrCounterWithLabels(key, val, nil)
+}
+
+func (r *Registry) IncrCounterWithLabels(key []string, val float32, labels []gometrics.Label) {
+	r.update(kindCounter, key, labels, func(m *metric) {
+		m.value += float64(val)
+	})
+}
+
+func (r *Registry) AddSample(key []string, val float32) {
+	r.AddSampleWithLabels(key, val, nil)
+}
+
+func (r *Registry) AddSampleWithLabels(key []string, val float32, labels []gometrics.Label) {
+	r.update(kindSummary, key, labels, func(m *metric) {
+		m.value += float64(val)
+		m.count++
+	})
+}
+
+func (r *Registry) update(k kind, key []string, labels []gometrics.Label, fn func(*metric)) {
+	name := metricName(key)
+	labelStr := formatLabels(labels)
+	id := name + labelStr
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// A name keeps the kind it was first used with
+	if established, ok := r.kinds[name]; ok && established != k {
+		return
+	}
+	r.kinds[name] = k
+
+	m, ok := r.metrics[id]
+	if !ok {
+		m = &metric{name: name, labels: labelStr, kind: k}
+		r.metrics[id] = m
+	}
+	fn(m)
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]func(){}, r.collectors...)
+	r.mu.Unlock()
+	for _, fn := range collectors {
+		fn()
+	}
+
+	r.mu.Lock()
+	metrics := make([]metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, *m)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].name != metrics[j].name {
+			return metrics[i].name < metrics[j].name
+		}
+		return metrics[i].labels < metrics[j].labels
+	})
+
+	var b strings.Builder
+	for i, m := range metrics {
+		if i == 0 || metrics[i-1].name != m.name {
+			fmt.Fprintf(&b, "# TYPE %s %s\n", m.name, m.kind)
+		}
+
+		switch m.kind {
+		case kindSummary:
+			fmt.Fprintf(&b, "%s_sum%s %s\n", m.name, m.labels, formatValue(m.value))
+			fmt.Fprintf(&b, "%s_count%s %d\n", m.name, m.labels, m.count)
+		default:
+			fmt.Fprintf(&b, "%s%s %s\n", m.name, m.labels, formatValue(m.value))
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// metricName joins the parts of a go-metrics key into a valid Prometheus name.
+func metricName(key []string) string {
+	return sanitize(strings.Join(key, "_"))
+}
+
+func sanitize(s string) string {
+	var b strings.Builder
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+			b.WriteRune(c)
+		case c >= '0' && c <= '9' && i > 0:
+			b.WriteRune(c)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+func formatLabels(labels []gometrics.Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	sorted := append([]gometrics.Label(nil), labels...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	parts := make([]string, 0, len(sorted))
+	for _, l := range sorted {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(l.Value)
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, sanitize(l.Name), value))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return fmt.Sprintf("%g", v)
+}
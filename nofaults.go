@@ -0,0 +1,15 @@
+//go:build !faults
+
+package main
+
+import (
+	"dpasswd/transport"
+
+	"github.com/hashicorp/raft"
+)
+
+// injectFaults leaves the raft transport alone, faults can only be injected
+// into builds with the faults tag.
+func injectFaults(trans raft.Transport) (raft.Transport, *transport.FaultyTransport) {
+	return trans, nil
+}
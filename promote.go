@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// runPromote turns a standby cluster into a primary accepting client writes,
+// e.g. after the primary site was lost. Replication from the old primary is
+// rejected from then on.
+func runPromote(args []string) {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:3100", "HTTP address of a node of the standby cluster")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s promote --addr <http address of a standby node>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	target := *addr
+
+	// A follower names the leader in its member list
+	for attempt := 0; attempt < 2; attempt++ {
+		resp, err := client.Post(httpURL(target)+"/replication/promote", "application/json", nil)
+		if err != nil {
+			log.Fatalf("error promoting cluster: %s", err)
+		}
+
+		var body struct {
+			Error   string `json:"error"`
+			Message string `json:"message"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		_ = resp.Body.Close()
+		if err != nil {
+			log.Fatalf("error decoding response of %s: %s", target, err)
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			fmt.Printf("%s\n", body.Message)
+			return
+		}
+		if body.Error != "not the leader" || attempt > 0 {
+			log.Fatalf("error promoting cluster: %s", body.Error)
+		}
+
+		leader, err := leaderHTTPAddress(client, target)
+		if err != nil {
+			log.Fatalf("error looking up the leader: %s", err)
+		}
+		target = leader
+	}
+}
+
+func leaderHTTPAddress(client *http.Client, addr string) (string, error) {
+	resp, err := client.Get(httpURL(addr) + "/raft/members")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var body struct {
+		Data []struct {
+			ID          string `json:"id"`
+			HTTPAddress string `json:"http_address"`
+			Leader      bool   `json:"leader"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	for _, m := range body.Data {
+		if m.Leader {
+			if m.HTTPAddress == "" {
+				return "", fmt.Errorf("HTTP address of leader %s is unknown", m.ID)
+			}
+			return m.HTTPAddress, nil
+		}
+	}
+	return "", fmt.Errorf("no leader")
+}
+
+func httpURL(addr string) string {
+	if strings.Contains(addr, "://") {
+		return addr
+	}
+	return "http://" + addr
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"dpasswd/fsm"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+// runRecover rewrites the raft configuration stored in a data directory, so
+// that the surviving nodes of a cluster which lost its quorum can elect a
+// leader again. The node must be stopped while this runs.
+func runRecover(args []string) {
+	fs := flag.NewFlagSet("recover", flag.ExitOnError)
+	dataDir := fs.String("datadir", "data", "Data storage directory of the stopped node")
+	groupID := fs.Int("group", 0, "Raft group to recover on a sharded node")
+	peersFile := fs.String("peers", "", "peers.json listing the surviving servers")
+	dryRun := fs.Bool("dry-run", false, "Only print the stored configuration")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s recover --datadir <dir> [--group <id>] (--peers <peers.json> | --dry-run)\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	if *peersFile == "" && !*dryRun {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	dir := *dataDir
+	if *groupID != 0 {
+		dir = path.Join(dir, fmt.Sprintf("group-%d", *groupID))
+	}
+	if _, err := os.Stat(dir); err != nil {
+		log.Fatal(err)
+	}
+
+	// Badger locks its directory, so this also fails while the node is running
+	badgerDB, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		log.Fatalf("error opening badgerDB, is the node still running? %s", err)
+	}
+	defer func() {
+		if err := badgerDB.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing badgerDB: %s\n", err.Error())
+		}
+	}()
+
+	logDB, err := raftboltdb.NewBoltStore(path.Join(dir, "log"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		if err := logDB.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing raft log store: %s\n", err.Error())
+		}
+	}()
+
+	ssDB, err := raft.NewFileSnapshotStore(dir, 2, os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	raftCfg := raft.DefaultConfig()
+	raftCfg.LocalID = "recover"
+	raftCfg.LogLevel = "WARN"
+	_, trans := raft.NewInmemTransport("")
+
+	current, err := raft.GetConfiguration(raftCfg, discardFSM{}, logDB, logDB, ssDB, trans)
+	if err != nil {
+		log.Fatalf("error reading stored configuration: %s", err)
+	}
+	term, _ := logDB.GetUint64([]byte("CurrentTerm"))
+	lastIndex, _ := logDB.LastIndex()
+
+	fmt.Printf("Stored configuration in %s (term %d, last log index %d):\n", dir, term, lastIndex)
+	printConfiguration(current)
+	if *dryRun {
+		return
+	}
+
+	peers, err := raft.ReadConfigJSON(*peersFile)
+	if err != nil {
+		log.Fatalf("error reading %s: %s", *peersFile, err)
+	}
+	fmt.Printf("\nNew configuration from %s:\n", *peersFile)
+	printConfiguration(peers)
+
+	if !*yes {
+		fmt.Printf("\nWARNING: recovery commits every entry in the local raft log, including entries that were never committed by the cluster.\n")
+		fmt.Printf("All nodes of the cluster must be stopped, and every surviving node must be recovered with the same peers file.\n")
+		fmt.Printf("Servers left out of the new configuration must never be started again with their old data.\n")
+		fmt.Printf("Type 'yes' to rewrite the configuration: ")
+
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != "yes" {
+			fmt.Printf("Aborted\n")
+			return
+		}
+	}
+
+	if err := raft.RecoverCluster(raftCfg, fsm.NewRaftFSM(badgerDB, hclog.New(&hclog.LoggerOptions{Name: "fsm", Level: hclog.Warn})), logDB, logDB, ssDB, trans, peers); err != nil {
+		log.Fatalf("error recovering cluster: %s", err)
+	}
+	fmt.Printf("Configuration recovered, the node can be started again\n")
+}
+
+func printConfiguration(cfg raft.Configuration) {
+	if len(cfg.Servers) == 0 {
+		fmt.Printf("  (empty)\n")
+	}
+	for _, srv := range cfg.Servers {
+		fmt.Printf("  %s\t%s\t%s\n", srv.ID, srv.Address, srv.Suffrage)
+	}
+}
+
+// discardFSM lets raft read the stored configuration without restoring the
+// latest snapshot into Badger.
+type discardFSM struct{}
+
+func (discardFSM) Apply(*raft.Log) interface{} { return nil }
+
+func (discardFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return nil, errors.New("snapshots are not supported")
+}
+
+func (discardFSM) Restore(rc io.ReadCloser) error {
+	return rc.Close()
+}
@@ -0,0 +1,56 @@
+package replication
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Roles of a cluster, stored in its replicated metadata. A cluster without a
+// stored role is a primary.
+const (
+	// RoleStandby clusters reject client writes and accept the mutations of
+	// a primary through /replication/apply
+	RoleStandby = "standby"
+	// RolePrimary clusters accept client writes
+	RolePrimary = "primary"
+)
+
+// Entry is a committed mutation of the source cluster.
+type Entry struct {
+	Index     uint64          `json:"index"`
+	Operation string          `json:"operation"`
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value,omitempty"`
+}
+
+// Batch carries the mutations committed after the checkpoint After up to and
+// including Index. Index can be beyond the last entry, as log entries that do
+// not change client data are left out.
+type Batch struct {
+	After       uint64  `json:"after"`
+	Index       uint64  `json:"index"`
+	SourceIndex uint64  `json:"source_index"`
+	Entries     []Entry `json:"entries"`
+}
+
+// SinkStatus describes a cluster as the target of replication.
+type SinkStatus struct {
+	Role        string     `json:"role"`
+	Checkpoint  uint64     `json:"checkpoint"`
+	SourceIndex uint64     `json:"source_index,omitempty"`
+	Lag         uint64     `json:"lag"`
+	LastContact *time.Time `json:"last_contact,omitempty"`
+}
+
+// SourceStatus describes the replication of this node's cluster to a standby.
+type SourceStatus struct {
+	Target       string     `json:"target"`
+	Active       bool       `json:"active"`
+	Checkpoint   uint64     `json:"checkpoint"`
+	AppliedIndex uint64     `json:"applied_index"`
+	Lag          uint64     `json:"lag"`
+	LagSeconds   float64    `json:"lag_seconds"`
+	LastSync     *time.Time `json:"last_sync,omitempty"`
+	FullSyncs    int        `json:"full_syncs"`
+	LastError    string     `json:"last_error,omitempty"`
+}
@@ -0,0 +1,343 @@
+package replication
+
+import (
+	"bytes"
+	"dpasswd/fsm"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// maxBatch bounds the number of log entries read for one batch.
+const maxBatch = 512
+
+var errNotStandby = errors.New("target cluster is not a standby")
+
+// Source pushes the committed mutations of its raft group to a standby
+// cluster over HTTP while this node is the leader. The standby stores the
+// raft index it has applied up to, so a new leader or a restarted node resumes
+// where the last one stopped. When the entries after that checkpoint were
+// already compacted away, the latest snapshot is sent instead.
+type Source struct {
+	targets   []string
+	raft      *raft.Raft
+	logs      raft.LogStore
+	snapshots raft.SnapshotStore
+	client    *http.Client
+	interval  time.Duration
+	logger    hclog.Logger
+
+	mu           sync.Mutex
+	target       int
+	known        bool
+	checkpoint   uint64
+	behindSince  time.Time
+	lastSync     time.Time
+	fullSyncs    int
+	lastError    error
+	errorLogged  bool
+	shutdownCh   chan struct{}
+	stopOnce     sync.Once
+	shutdownDone chan struct{}
+}
+
+// NewSource starts replicating to the first reachable of the given HTTP
+// addresses of the standby cluster.
+func NewSource(targets []string, r *raft.Raft, logs raft.LogStore, snapshots raft.SnapshotStore, logger hclog.Logger) *Source {
+	for i, target := range targets {
+		if !strings.Contains(target, "://") {
+			targets[i] = "http://" + target
+		}
+	}
+
+	s := &Source{
+		targets:      targets,
+		raft:         r,
+		logs:         logs,
+		snapshots:    snapshots,
+		client:       &http.Client{Timeout: time.Minute},
+		interval:     500 * time.Millisecond,
+		logger:       logger,
+		shutdownCh:   make(chan struct{}),
+		shutdownDone: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Stop ends the replication and waits for a batch in flight.
+func (s *Source) Stop() {
+	s.stopOnce.Do(func() { close(s.shutdownCh) })
+	<-s.shutdownDone
+}
+
+// Status reports how far the standby is behind.
+func (s *Source) Status() SourceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := SourceStatus{
+		Target:       s.targets[s.target],
+		Active:       s.raft.State() == raft.Leader,
+		Checkpoint:   s.checkpoint,
+		AppliedIndex: s.raft.AppliedIndex(),
+		FullSyncs:    s.fullSyncs,
+	}
+	if status.AppliedIndex > s.checkpoint {
+		status.Lag = status.AppliedIndex - s.checkpoint
+	}
+	if !s.behindSince.IsZero() {
+		status.LagSeconds = time.Since(s.behindSince).Seconds()
+	}
+	if !s.lastSync.IsZero() {
+		lastSync := s.lastSync
+		status.LastSync = &lastSync
+	}
+	if s.lastError != nil {
+		status.LastError = s.lastError.Error()
+	}
+	return status
+}
+
+func (s *Source) run() {
+	defer close(s.shutdownDone)
+
+	for {
+		more, err := s.sync()
+		s.setError(err)
+
+		wait := s.interval
+		if more && err == nil {
+			wait = 0
+		}
+		select {
+		case <-time.After(wait):
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+func (s *Source) setError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil {
+		s.lastError, s.errorLogged = nil, false
+		return
+	}
+
+	if !s.errorLogged || s.lastError.Error() != err.Error() {
+		s.logger.Error("error replicating to standby", "target", s.targets[s.target], "error", err)
+		s.errorLogged = true
+	}
+	s.lastError = err
+
+	// The checkpoint is fetched again and the next address tried
+	s.known = false
+	if s.behindSince.IsZero() && s.raft.AppliedIndex() > s.checkpoint {
+		s.behindSince = time.Now()
+	}
+	s.target = (s.target + 1) % len(s.targets)
+}
+
+// sync sends the next batch and reports whether more entries are waiting.
+func (s *Source) sync() (bool, error) {
+	if s.raft.State() != raft.Leader {
+		s.mu.Lock()
+		s.known, s.behindSince = false, time.Time{}
+		s.mu.Unlock()
+		return false, nil
+	}
+
+	s.mu.Lock()
+	known, checkpoint, target := s.known, s.checkpoint, s.targets[s.target]
+	s.mu.Unlock()
+
+	if !known {
+		status, err := s.fetchStatus(target)
+		if err != nil {
+			return false, err
+		}
+		checkpoint = status.Checkpoint
+		s.updateCheckpoint(status.Checkpoint, false)
+	}
+
+	applied := s.raft.AppliedIndex()
+	if checkpoint >= applied {
+		s.caughtUp(true)
+		return false, nil
+	}
+	s.caughtUp(false)
+
+	first, err := s.logs.FirstIndex()
+	if err != nil {
+		return false, err
+	}
+	if checkpoint+1 < first {
+		return true, s.fullSync(target)
+	}
+
+	batch := Batch{After: checkpoint, SourceIndex: applied}
+	for i := checkpoint + 1; i <= applied && i <= checkpoint+maxBatch; i++ {
+		var l raft.Log
+		if err := s.logs.GetLog(i, &l); err != nil {
+			if err == raft.ErrLogNotFound {
+				// Compacted while reading
+				return true, s.fullSync(target)
+			}
+			return false, err
+		}
+		batch.Index = i
+
+		if entry, ok := decodeEntry(&l); ok {
+			batch.Entries = append(batch.Entries, entry)
+		}
+	}
+
+	var status SinkStatus
+	if err := s.post(target+"/replication/apply", "application/json", batch, &status); err != nil {
+		return false, err
+	}
+	s.updateCheckpoint(status.Checkpoint, true)
+	return status.Checkpoint < applied, nil
+}
+
+// decodeEntry returns the client data mutation of a log entry. Cluster
+// metadata like HTTP addresses differs between the clusters and is skipped.
+func decodeEntry(l *raft.Log) (Entry, bool) {
+	if l.Type != raft.LogCommand {
+		return Entry{}, false
+	}
+
+	var payload struct {
+		Operation string
+		Key       string
+		Value     json.RawMessage
+	}
+	if err := json.Unmarshal(l.Data, &payload); err != nil {
+		return Entry{}, false
+	}
+
+	op := strings.ToUpper(strings.TrimSpace(payload.Operation))
+	if (op != "SET" && op != "DELETE") || fsm.IsMetaKey(payload.Key) {
+		return Entry{}, false
+	}
+	return Entry{Index: l.Index, Operation: op, Key: payload.Key, Value: payload.Value}, true
+}
+
+// fullSync replaces the data of the standby with the latest snapshot.
+func (s *Source) fullSync(target string) error {
+	snapshots, err := s.snapshots.List()
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		return fmt.Errorf("log entries after the checkpoint were compacted and there is no snapshot")
+	}
+
+	meta, rc, err := s.snapshots.Open(snapshots[0].ID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rc.Close()
+	}()
+
+	var status SinkStatus
+	url := fmt.Sprintf("%s/replication/snapshot?index=%d", target, meta.Index)
+	if err := s.post(url, "application/json", rc, &status); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.fullSyncs++
+	s.mu.Unlock()
+	s.updateCheckpoint(status.Checkpoint, true)
+	return nil
+}
+
+func (s *Source) updateCheckpoint(checkpoint uint64, synced bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.known, s.checkpoint = true, checkpoint
+	if synced {
+		s.lastSync = time.Now()
+	}
+}
+
+func (s *Source) caughtUp(caughtUp bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if caughtUp {
+		s.behindSince = time.Time{}
+	} else if s.behindSince.IsZero() {
+		s.behindSince = time.Now()
+	}
+}
+
+func (s *Source) fetchStatus(target string) (SinkStatus, error) {
+	var status SinkStatus
+	resp, err := s.client.Get(target + "/replication/status")
+	if err != nil {
+		return status, err
+	}
+	if err := decodeResponse(resp, &status); err != nil {
+		return status, err
+	}
+	if status.Role != RoleStandby {
+		return status, errNotStandby
+	}
+	return status, nil
+}
+
+// post sends body, a reader or a value encoded as JSON, and decodes the sink
+// status of the response. A rejected batch still carries the checkpoint of
+// the standby, which is taken over so the next batch continues from there.
+func (s *Source) post(url, contentType string, body interface{}, status *SinkStatus) error {
+	reader, ok := body.(io.Reader)
+	if !ok {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	resp, err := s.client.Post(url, contentType, reader)
+	if err != nil {
+		return err
+	}
+	err = decodeResponse(resp, status)
+	if resp.StatusCode == http.StatusConflict && status.Role == RoleStandby {
+		return nil
+	}
+	return err
+}
+
+func decodeResponse(resp *http.Response, status *SinkStatus) error {
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var body struct {
+		Error string     `json:"error"`
+		Data  SinkStatus `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("error decoding response of %s: %s", resp.Request.URL, err.Error())
+	}
+	*status = body.Data
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d: %s", resp.Request.URL.Host, resp.StatusCode, body.Error)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"dpasswd/backup"
+	"dpasswd/fsm"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+const restoreUsage = "restore (--to-index <index> | --to-time <time>) (--backup-dir <dir> | --backup-s3-endpoint <url> --backup-s3-bucket <bucket>) --datadir <new dir> [options]"
+
+// runRestore rebuilds the state of a raft group at an earlier point from the
+// scheduled backups and the archived raft log: it restores the nearest backup
+// before the point into a new Badger directory and replays the archived
+// commands up to the point. The result can also be written as a backup, to be
+// restored into the cluster through /admin/restore.
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dataDir := fs.String("datadir", "", "New directory the Badger database is rebuilt in")
+	toIndex := fs.Uint64("to-index", 0, "Raft index to recover up to, including it")
+	toTime := fs.String("to-time", "", "Time to recover up to as RFC 3339, e.g. 2006-01-02T15:04:05Z, including the entries appended at it")
+	groupID := fs.Int("group", 0, "Raft group to recover on a sharded cluster")
+	dir := fs.String("backup-dir", "", "Directory the scheduled backups were written to")
+	var s3 backup.S3Config
+	fs.StringVar(&s3.Endpoint, "backup-s3-endpoint", "", "URL of the S3-compatible store the scheduled backups were written to, credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	fs.StringVar(&s3.Bucket, "backup-s3-bucket", "", "Bucket of the S3 backup target")
+	fs.StringVar(&s3.Prefix, "backup-s3-prefix", "", "Prefix of the names of the backups in the S3 bucket")
+	fs.StringVar(&s3.Region, "backup-s3-region", "us-east-1", "Region of the S3 backup target")
+	keyFile := fs.String("backup-encryption-key-file", "", "File holding the key the backups were encrypted with, the backup written to --out is encrypted with it as well")
+	out := fs.String("out", "", "File to write the recovered state to as a backup")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s\n", os.Args[0], restoreUsage)
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	var to backup.Point
+	switch {
+	case *dataDir == "" || (*toIndex == 0) == (*toTime == ""):
+		fs.Usage()
+		os.Exit(1)
+	case *toTime != "":
+		t, err := time.Parse(time.RFC3339, *toTime)
+		if err != nil {
+			log.Fatalf("invalid --to-time: %s", err)
+		}
+		to.Time = t
+	default:
+		to.Index = *toIndex
+	}
+
+	var target backup.Target
+	var err error
+	switch {
+	case *dir != "" && s3.Endpoint != "":
+		log.Fatalf("--backup-dir and --backup-s3-endpoint are mutually exclusive")
+	case *dir != "":
+		if _, err := os.Stat(*dir); err != nil {
+			log.Fatal(err)
+		}
+		target, err = backup.NewDirTarget(*dir)
+	case s3.Endpoint != "":
+		s3.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		s3.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		target, err = backup.NewS3Target(s3)
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatalf("invalid backup target: %s", err)
+	}
+
+	var key []byte
+	if *keyFile != "" {
+		if key, err = backup.LoadKey(*keyFile); err != nil {
+			log.Fatalf("error loading backup encryption key: %s", err)
+		}
+	}
+
+	// The FSM drops everything when it restores the backup, so this never
+	// runs on an existing directory
+	if entries, err := os.ReadDir(*dataDir); err == nil && len(entries) > 0 {
+		log.Fatalf("%s is not empty, restore rebuilds into a new directory", *dataDir)
+	}
+	badgerDB, err := badger.Open(badger.DefaultOptions(*dataDir).WithLogger(nil))
+	if err != nil {
+		log.Fatalf("error opening badgerDB: %s", err)
+	}
+	closeDB := func() {
+		if err := badgerDB.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing badgerDB: %s\n", err.Error())
+		}
+	}
+	defer closeDB()
+	kvFSM := fsm.NewRaftFSM(badgerDB, hclog.New(&hclog.LoggerOptions{Name: "fsm", Level: hclog.Warn}))
+
+	prefix := ""
+	if *groupID != 0 {
+		prefix = fmt.Sprintf("group-%d-", *groupID)
+	}
+	result, err := backup.Recover(target, prefix, key, to, kvFSM)
+	if err == nil && !result.Complete && to.Index > 0 {
+		err = fmt.Errorf("the log archive ends at index %d", result.Index)
+	}
+	if err != nil {
+		// A partly recovered state is of no use
+		closeDB()
+		_ = os.RemoveAll(*dataDir)
+		log.Fatalf("error recovering %s: %s", to, err)
+	}
+
+	if result.Backup != "" {
+		fmt.Printf("Restored %s (index %d) and replayed %d commands\n", result.Backup, result.BackupIndex, result.Commands)
+	} else {
+		fmt.Printf("Replayed %d commands from the start of the log\n", result.Commands)
+	}
+	fmt.Printf("Recovered state of index %d, term %d", result.Index, result.Term)
+	if !result.AppendedAt.IsZero() {
+		fmt.Printf(", appended at %s", result.AppendedAt.Format(time.RFC3339Nano))
+	}
+	fmt.Printf("\n")
+	if !result.Complete {
+		fmt.Fprintf(os.Stderr, "Warning: the log archive ends at index %d, entries up to %s may be missing\n", result.Index, to)
+	}
+
+	if *out != "" {
+		if err := writeRecoveredBackup(*out, kvFSM, result, key); err != nil {
+			log.Fatalf("error writing %s: %s", *out, err)
+		}
+		fmt.Printf("Wrote the recovered state to %s\n", *out)
+	}
+}
+
+// writeRecoveredBackup writes the state of f as a backup, going through a
+// temporary snapshot store to get the snapshot raft would take of it.
+func writeRecoveredBackup(path string, f raft.FSM, result *backup.Recovery, key []byte) error {
+	dir, err := os.MkdirTemp("", "dpasswd-restore-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	store, err := raft.NewFileSnapshotStore(dir, 1, io.Discard)
+	if err != nil {
+		return err
+	}
+	_, trans := raft.NewInmemTransport("")
+	sink, err := store.Create(raft.SnapshotVersionMax, result.Index, result.Term, result.Configuration, result.ConfigurationIndex, trans)
+	if err != nil {
+		return err
+	}
+	snapshot, err := f.Snapshot()
+	if err != nil {
+		return err
+	}
+	err = snapshot.Persist(sink)
+	snapshot.Release()
+	if err != nil {
+		return err
+	}
+	meta, data, err := store.Open(sink.ID())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = data.Close()
+	}()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = file
+	var enc io.WriteCloser
+	if key != nil {
+		if enc, err = backup.NewEncryptWriter(file, key); err != nil {
+			_ = file.Close()
+			return err
+		}
+		w = enc
+	}
+	_, err = backup.Write(w, "restore", meta, data)
+	if err == nil && enc != nil {
+		err = enc.Close()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
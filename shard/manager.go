@@ -0,0 +1,724 @@
+package shard
+
+import (
+	"bytes"
+	"dpasswd/fsm"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// Group is a raft group hosted by this node. Group 0 always exists and holds
+// the shard map, its requests are served by the HTTP server of the node
+// itself so it has no handler here.
+type Group struct {
+	ID      int
+	Raft    *raft.Raft
+	DB      *badger.DB
+	Handler http.Handler
+	// Remove shuts the group down and deletes its data, it undoes a split
+	// that failed before the shard map announced the new group
+	Remove func() error
+}
+
+// OpenFunc starts the given group on this node. Group g is expected to listen
+// for raft RPCs on the raft port of group 0 plus g. A bootstrapped group
+// starts with this node as its only voter.
+type OpenFunc func(id int, bootstrap bool) (*Group, error)
+
+var errNotLeader = errors.New("not the leader")
+
+// splitBatch is the number of keys copied or removed per raft round trip.
+const splitBatch = 512
+
+// Manager routes requests to the raft group owning their key, starts the
+// groups announced by the replicated shard map and splits key ranges into new
+// groups.
+type Manager struct {
+	nodeID raft.ServerID
+	open   OpenFunc
+	logger hclog.Logger
+
+	mu        sync.RWMutex
+	shardMap  *Map
+	groups    map[int]*Group
+	splitting *Range
+	// unannounced holds the new groups of splits that failed to store their
+	// map, with the version of the map they were split from
+	unannounced map[int]uint64
+	// writes is read locked per group by the /db writes routed to it until
+	// they are applied, a split write locks it to wait for them
+	writes map[int]*sync.RWMutex
+
+	// splitMu is held while a split runs or is finished
+	splitMu sync.Mutex
+
+	shutdownCh chan struct{}
+	stopOnce   sync.Once
+}
+
+// NewManager starts every group of the shard map. The map stored in group 0
+// takes precedence over the initial one, which only describes a new cluster.
+func NewManager(nodeID raft.ServerID, group0 *Group, initial *Map, open OpenFunc, logger hclog.Logger) (*Manager, error) {
+	m := &Manager{
+		nodeID:      nodeID,
+		open:        open,
+		logger:      logger,
+		shardMap:    initial,
+		groups:      map[int]*Group{0: group0},
+		unannounced: map[int]uint64{},
+		writes:      map[int]*sync.RWMutex{},
+		shutdownCh:  make(chan struct{}),
+	}
+
+	stored, err := readMap(group0.DB)
+	if err != nil {
+		return nil, err
+	}
+	if stored != nil {
+		if stored.Mode != initial.Mode {
+			m.logger.Warn("ignoring shard mode, the shard map is stored in another mode", "stored", stored.Mode, "ignored", initial.Mode)
+		}
+		m.shardMap = stored
+	}
+
+	if err := m.openMissing(m.shardMap); err != nil {
+		return nil, err
+	}
+
+	go m.watch()
+	return m, nil
+}
+
+// Groups returns the groups hosted by this node ordered by ID.
+func (m *Manager) Groups() []*Group {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	groups := make([]*Group, 0, len(m.groups))
+	for _, g := range m.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+	return groups
+}
+
+// Stop ends watching the shard map. The groups are shut down by their owner.
+func (m *Manager) Stop() {
+	m.stopOnce.Do(func() { close(m.shutdownCh) })
+}
+
+func (m *Manager) openMissing(shardMap *Map) error {
+	for _, id := range shardMap.Groups() {
+		m.mu.RLock()
+		_, ok := m.groups[id]
+		m.mu.RUnlock()
+		if ok {
+			continue
+		}
+
+		g, err := m.open(id, id < shardMap.InitialGroups)
+		if err != nil {
+			return fmt.Errorf("error opening raft group %d: %s", id, err.Error())
+		}
+		m.mu.Lock()
+		m.groups[id] = g
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+// watch follows the shard map replicated through group 0. The leader of group
+// 0 stores the initial map if there is none yet. A split that is committed but
+// not finished is resumed from here.
+func (m *Manager) watch() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.shutdownCh:
+			return
+		}
+
+		m.mu.RLock()
+		group0, current := m.groups[0], m.shardMap
+		m.mu.RUnlock()
+
+		stored, err := readMap(group0.DB)
+		if err != nil {
+			m.logger.Error("error reading shard map", "error", err)
+			continue
+		}
+
+		if stored == nil {
+			if group0.Raft.State() == raft.Leader {
+				if err := fsm.ApplyCommand(group0.Raft, fsm.CommandPayload{Operation: "SET", Key: fsm.ShardMapKey(), Value: current}); err != nil {
+					m.logger.Error("error storing shard map", "error", err)
+				}
+			}
+			continue
+		}
+
+		if stored.Version > current.Version {
+			m.mu.Lock()
+			m.shardMap = stored
+			m.mu.Unlock()
+			if err := m.openMissing(stored); err != nil {
+				m.logger.Error("error opening raft groups of the shard map", "version", stored.Version, "error", err)
+			}
+		}
+
+		if !m.splitMu.TryLock() {
+			continue
+		}
+		m.pruneUnannounced(stored, false)
+		if stored.Pending != nil {
+			if _, err := m.finishSplit(stored); err != nil {
+				m.logger.Error("error finishing split", "source", stored.Pending.Source, "target", stored.Pending.Target, "error", err)
+			}
+		}
+		m.splitMu.Unlock()
+	}
+}
+
+// Route returns the handler of the group owning the request, or nil when
+// group 0 owns it. Requests on /db are routed by their key, all others by the
+// "group" query parameter. done has to be called once the request is served.
+func (m *Manager) Route(req *http.Request) (http.Handler, func(), int, error) {
+	var id int
+	done := func() {}
+	switch {
+	case req.URL.Path == "/db" || strings.HasPrefix(req.URL.Path, "/db/"):
+		key, err := requestKey(req)
+		if err != nil {
+			return nil, done, http.StatusUnprocessableEntity, err
+		}
+
+		if req.Method == http.MethodGet {
+			m.mu.RLock()
+			id = m.shardMap.Lookup(key).Group
+			m.mu.RUnlock()
+			break
+		}
+		if id, done, err = m.startWrite(key); err != nil {
+			return nil, func() {}, http.StatusServiceUnavailable, err
+		}
+	default:
+		if group := req.URL.Query().Get("group"); group != "" {
+			var err error
+			if id, err = strconv.Atoi(group); err != nil {
+				return nil, done, http.StatusUnprocessableEntity, fmt.Errorf("invalid group %s", group)
+			}
+		}
+	}
+
+	if id == 0 {
+		return nil, done, 0, nil
+	}
+
+	m.mu.RLock()
+	g, ok := m.groups[id]
+	m.mu.RUnlock()
+	if !ok {
+		done()
+		return nil, func() {}, http.StatusUnprocessableEntity, fmt.Errorf("raft group %d is not hosted by this node", id)
+	}
+	return g.Handler, done, 0, nil
+}
+
+// startWrite returns the group owning key and keeps splits of it waiting
+// until done is called. The range lock and the owner are checked once the
+// write counts as in flight, so that a split either waits for the write or
+// the write sees the split.
+func (m *Manager) startWrite(key string) (int, func(), error) {
+	m.mu.RLock()
+	id := m.shardMap.Lookup(key).Group
+	m.mu.RUnlock()
+
+	for {
+		writes := m.writesOf(id)
+		writes.RLock()
+
+		m.mu.RLock()
+		shardMap, splitting := m.shardMap, m.splitting
+		m.mu.RUnlock()
+
+		routingKey := shardMap.RoutingKey(key)
+		if splitting != nil && splitting.contains(routingKey) {
+			writes.RUnlock()
+			return 0, nil, fmt.Errorf("key range is being split, retry later")
+		}
+		if owner := shardMap.lookupRoutingKey(routingKey).Group; owner != id {
+			// A split moved the key meanwhile
+			writes.RUnlock()
+			id = owner
+			continue
+		}
+		return id, writes.RUnlock, nil
+	}
+}
+
+func (m *Manager) writesOf(id int) *sync.RWMutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	writes, ok := m.writes[id]
+	if !ok {
+		writes = &sync.RWMutex{}
+		m.writes[id] = writes
+	}
+	return writes
+}
+
+// requestKey extracts the key of a /db request, restoring the body it reads.
+func requestKey(req *http.Request) (string, error) {
+	if req.URL.Path != "/db" {
+		return strings.TrimSpace(strings.TrimPrefix(req.URL.Path, "/db/")), nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading body: %s", err.Error())
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	var payload struct {
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return "", fmt.Errorf("error binding: %s", err.Error())
+	}
+	return strings.TrimSpace(payload.Key), nil
+}
+
+// ServeHTTP serves the shard admin endpoints.
+func (m *Manager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == "/shard/map":
+		m.mu.RLock()
+		shardMap := m.shardMap
+		m.mu.RUnlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"message": "shard map",
+			"data":    shardMap,
+		})
+	case req.Method == http.MethodPost && req.URL.Path == "/shard/split":
+		var splitReq struct {
+			At string `json:"at"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&splitReq); err != nil {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+				"error": fmt.Sprintf("error binding: %s", err.Error()),
+			})
+			return
+		}
+
+		shardMap, err := m.Split(splitReq.At)
+		if err != nil {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+				"error": fmt.Sprintf("error splitting at %s: %s", splitReq.At, err.Error()),
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"message": fmt.Sprintf("range split at %s successfully", splitReq.At),
+			"data":    shardMap,
+		})
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"error": "not found",
+		})
+	}
+}
+
+// Split moves the keys from at up to the end of their range into a new group.
+// It has to run on the leader of group 0, which stores the shard map, and of
+// the group owning the range, as the moved keys are read from its local state.
+// Writes to the range are rejected while it is copied. A split failing before
+// the map is stored removes the new group again, once the map is stored the
+// split is finished by the watch of every node if it fails here.
+func (m *Manager) Split(at string) (*Map, error) {
+	if !m.splitMu.TryLock() {
+		return nil, errors.New("another split is in progress")
+	}
+	defer m.splitMu.Unlock()
+
+	m.mu.RLock()
+	group0 := m.groups[0]
+	m.mu.RUnlock()
+	if group0.Raft.State() != raft.Leader {
+		return nil, fmt.Errorf("%w of group 0", errNotLeader)
+	}
+
+	// Wait until every map stored before is applied, so that the splits
+	// which failed to store theirs are known to be undone
+	if err := group0.Raft.Barrier(10 * time.Second).Error(); err != nil {
+		return nil, fmt.Errorf("error waiting for group 0 to apply pending writes: %s", err.Error())
+	}
+	current, err := readMap(group0.DB)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, errors.New("the shard map is not stored yet")
+	}
+	m.pruneUnannounced(current, true)
+	if current.Pending != nil {
+		return nil, fmt.Errorf("the split of group %d into group %d is not finished yet", current.Pending.Source, current.Pending.Target)
+	}
+
+	next, kept, moved, err := current.Split(at)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	source := m.groups[kept.Group]
+	if source == nil || source.Raft.State() != raft.Leader {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("%w of group %d", errNotLeader, kept.Group)
+	}
+	locked := Range{Start: moved.Start, End: moved.End, Group: kept.Group}
+	m.splitting = &locked
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		m.splitting = nil
+		m.mu.Unlock()
+	}()
+
+	// Wait for the writes routed to the source group before the range was
+	// locked, the ones routed later are rejected. The barrier then applies
+	// whatever else was committed to the group before its state is copied.
+	writes := m.writesOf(kept.Group)
+	writes.Lock()
+	writes.Unlock()
+	if err := source.Raft.Barrier(10 * time.Second).Error(); err != nil {
+		return nil, fmt.Errorf("error waiting for group %d to apply pending writes: %s", kept.Group, err.Error())
+	}
+
+	target, err := m.open(moved.Group, true)
+	if err != nil {
+		return nil, fmt.Errorf("error opening raft group %d: %s", moved.Group, err.Error())
+	}
+	m.mu.Lock()
+	m.groups[moved.Group] = target
+	m.mu.Unlock()
+	if err := waitLeader(target.Raft, 10*time.Second); err != nil {
+		m.removeGroup(moved.Group)
+		return nil, err
+	}
+	if err := copyRange(source.DB, target.Raft, next, moved); err != nil {
+		m.removeGroup(moved.Group)
+		return nil, err
+	}
+
+	// From here on the new group owns the range on every node. The map may
+	// still be stored after an error if this node lost leadership, so the new
+	// group is only removed once that is ruled out.
+	if err := fsm.ApplyCommand(group0.Raft, fsm.CommandPayload{Operation: "SET", Key: fsm.ShardMapKey(), Value: next}); err != nil {
+		m.mu.Lock()
+		m.unannounced[moved.Group] = current.Version
+		m.mu.Unlock()
+		return nil, fmt.Errorf("error storing shard map: %s", err.Error())
+	}
+	m.mu.Lock()
+	m.shardMap = next
+	m.mu.Unlock()
+
+	finished, err := m.finishSplit(next)
+	if err != nil {
+		return nil, fmt.Errorf("range split, finishing it is retried: %s", err.Error())
+	}
+	if finished == nil {
+		return next, nil
+	}
+	return finished, nil
+}
+
+// finishSplit adds the other servers of the source group to the new group and
+// removes the moved keys from the source group, each step on the node leading
+// the group it changes. Once both are done, the leader of group 0 stores the
+// map without the pending split and returns it.
+func (m *Manager) finishSplit(shardMap *Map) (*Map, error) {
+	pending := shardMap.Pending
+	m.mu.RLock()
+	group0, source, target := m.groups[0], m.groups[pending.Source], m.groups[pending.Target]
+	m.mu.RUnlock()
+	if source == nil || target == nil {
+		return nil, nil
+	}
+
+	missing, err := missingPeers(source, target, pending.Target-pending.Source)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		if target.Raft.State() != raft.Leader {
+			return nil, nil
+		}
+		if err := addPeers(target.Raft, missing, pending.Target); err != nil {
+			return nil, err
+		}
+	}
+
+	if source.Raft.State() == raft.Leader {
+		if err := removeMoved(source, shardMap); err != nil {
+			return nil, err
+		}
+	}
+	keys, err := movedKeys(source.DB, shardMap, pending.Source)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 || group0.Raft.State() != raft.Leader {
+		return nil, nil
+	}
+
+	finished := shardMap.finished()
+	if err := fsm.ApplyCommand(group0.Raft, fsm.CommandPayload{Operation: "SET", Key: fsm.ShardMapKey(), Value: finished}); err != nil {
+		return nil, fmt.Errorf("error storing shard map: %s", err.Error())
+	}
+	m.mu.Lock()
+	if finished.Version > m.shardMap.Version {
+		m.shardMap = finished
+	}
+	m.mu.Unlock()
+	m.logger.Info("split finished", "source", pending.Source, "target", pending.Target)
+	return finished, nil
+}
+
+// pruneUnannounced removes the new groups of failed splits whose map will not
+// be stored anymore: a newer map without them is stored, or settled is set
+// because every write to group 0 issued as its leader is applied.
+func (m *Manager) pruneUnannounced(stored *Map, settled bool) {
+	m.mu.RLock()
+	unannounced := make(map[int]uint64, len(m.unannounced))
+	for id, version := range m.unannounced {
+		unannounced[id] = version
+	}
+	m.mu.RUnlock()
+
+	for id, version := range unannounced {
+		announced := false
+		for _, g := range stored.Groups() {
+			announced = announced || g == id
+		}
+		switch {
+		case announced:
+			m.mu.Lock()
+			delete(m.unannounced, id)
+			m.mu.Unlock()
+		case settled || stored.Version > version:
+			m.removeGroup(id)
+		}
+	}
+}
+
+// removeGroup undoes the opening of the new group of a failed split.
+func (m *Manager) removeGroup(id int) {
+	m.mu.Lock()
+	g := m.groups[id]
+	delete(m.groups, id)
+	delete(m.unannounced, id)
+	m.mu.Unlock()
+
+	if g == nil || g.Remove == nil {
+		return
+	}
+	if err := g.Remove(); err != nil {
+		m.logger.Error("error removing raft group of failed split", "group", id, "error", err)
+		return
+	}
+	m.logger.Info("removed raft group of failed split", "group", id)
+}
+
+// copyRange writes the keys of the source group falling into the moved range
+// to the target group. Each batch is read in its own transaction and written
+// with one raft round trip.
+func copyRange(db *badger.DB, target *raft.Raft, shardMap *Map, moved Range) error {
+	var after []byte
+	for {
+		var batch []fsm.CommandPayload
+		done := true
+		err := db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+
+			for it.Seek(after); it.Valid(); it.Next() {
+				key := it.Item().KeyCopy(nil)
+				if after != nil && bytes.Equal(key, after) {
+					continue
+				}
+				if len(batch) == splitBatch {
+					done = false
+					return nil
+				}
+				after = key
+
+				if fsm.IsMetaKey(string(key)) || !moved.contains(shardMap.RoutingKey(string(key))) {
+					continue
+				}
+				value, err := it.Item().ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				batch = append(batch, fsm.CommandPayload{Operation: "SET", Key: string(key), Value: json.RawMessage(value)})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(batch) > 0 {
+			if err := fsm.ApplyCommands(target, batch); err != nil {
+				return fmt.Errorf("error copying keys to group %d: %s", moved.Group, err.Error())
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// movedKeys returns the keys in the local state of group id that the shard map
+// routes to another group.
+func movedKeys(db *badger.DB, shardMap *Map, id int) ([]string, error) {
+	var keys []string
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := string(it.Item().KeyCopy(nil))
+			if fsm.IsMetaKey(key) || shardMap.Lookup(key).Group == id {
+				continue
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// removeMoved deletes the keys the source group no longer owns, in batches.
+func removeMoved(source *Group, shardMap *Map) error {
+	keys, err := movedKeys(source.DB, shardMap, source.ID)
+	if err != nil {
+		return err
+	}
+
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > splitBatch {
+			n = splitBatch
+		}
+		batch := make([]fsm.CommandPayload, 0, n)
+		for _, key := range keys[:n] {
+			batch = append(batch, fsm.CommandPayload{Operation: "DELETE", Key: key})
+		}
+		if err := fsm.ApplyCommands(source.Raft, batch); err != nil {
+			return fmt.Errorf("error removing moved keys from group %d: %s", source.ID, err.Error())
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// missingPeers returns the servers of the source group that are not in the new
+// group yet, at the raft port of their source group address shifted by offset.
+func missingPeers(source, target *Group, offset int) ([]raft.Server, error) {
+	sourceFuture, targetFuture := source.Raft.GetConfiguration(), target.Raft.GetConfiguration()
+	if err := sourceFuture.Error(); err != nil {
+		return nil, err
+	}
+	if err := targetFuture.Error(); err != nil {
+		return nil, err
+	}
+
+	present := map[raft.ServerID]bool{}
+	for _, srv := range targetFuture.Configuration().Servers {
+		present[srv.ID] = true
+	}
+
+	var missing []raft.Server
+	for _, srv := range sourceFuture.Configuration().Servers {
+		if present[srv.ID] {
+			continue
+		}
+		addr, err := shiftPort(srv.Address, offset)
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, raft.Server{ID: srv.ID, Address: addr, Suffrage: srv.Suffrage})
+	}
+	return missing, nil
+}
+
+// addPeers adds the given servers to the new group with their suffrage.
+func addPeers(target *raft.Raft, servers []raft.Server, targetID int) error {
+	for _, srv := range servers {
+		var f raft.IndexFuture
+		if srv.Suffrage == raft.Voter {
+			f = target.AddVoter(srv.ID, srv.Address, 0, 0)
+		} else {
+			f = target.AddNonvoter(srv.ID, srv.Address, 0, 0)
+		}
+		if err := f.Error(); err != nil {
+			return fmt.Errorf("error adding node %s to group %d: %s", srv.ID, targetID, err.Error())
+		}
+	}
+	return nil
+}
+
+func shiftPort(addr raft.ServerAddress, offset int) (raft.ServerAddress, error) {
+	host, port, err := net.SplitHostPort(string(addr))
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", err
+	}
+	return raft.ServerAddress(net.JoinHostPort(host, strconv.Itoa(p+offset))), nil
+}
+
+func waitLeader(r *raft.Raft, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for r.State() != raft.Leader {
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for the new group to elect this node")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil
+}
+
+func readMap(db *badger.DB) (*Map, error) {
+	var shardMap *Map
+	err := fsm.ReadMeta(db, fsm.ShardMapKey(), &shardMap)
+	return shardMap, err
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
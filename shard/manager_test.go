@@ -0,0 +1,199 @@
+package shard
+
+import (
+	"bytes"
+	"dpasswd/fsm"
+	"dpasswd/httpd"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// openTestGroup starts a single node raft group on an in-memory transport.
+func openTestGroup(t *testing.T, id int, bootstrap bool) *Group {
+	t.Helper()
+
+	db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := raft.DefaultConfig()
+	cfg.LocalID = "node1"
+	cfg.HeartbeatTimeout = 50 * time.Millisecond
+	cfg.ElectionTimeout = 50 * time.Millisecond
+	cfg.LeaderLeaseTimeout = 50 * time.Millisecond
+	cfg.CommitTimeout = 5 * time.Millisecond
+	cfg.Logger = hclog.NewNullLogger()
+
+	store := raft.NewInmemStore()
+	addr, trans := raft.NewInmemTransport("")
+	r, err := raft.NewRaft(cfg, fsm.NewRaftFSM(db, hclog.NewNullLogger()), store, store, raft.NewInmemSnapshotStore(), trans)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bootstrap {
+		r.BootstrapCluster(raft.Configuration{Servers: []raft.Server{{ID: cfg.LocalID, Address: addr}}})
+	}
+
+	server := httpd.NewHTTPServer("", r, db, httpd.WithRaftConfig(cfg))
+	var closeOnce sync.Once
+	shutdown := func() error {
+		var err error
+		closeOnce.Do(func() {
+			server.Close()
+			_ = r.Shutdown().Error()
+			err = db.Close()
+		})
+		return err
+	}
+	t.Cleanup(func() { _ = shutdown() })
+
+	return &Group{
+		ID:      id,
+		Raft:    r,
+		DB:      db,
+		Handler: slowWrites(server.Handler()),
+		Remove:  shutdown,
+	}
+}
+
+// slowWrites delays writes between being routed and being applied, for up to
+// longer than a split takes.
+func slowWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			time.Sleep(time.Duration(rand.Intn(500)) * time.Millisecond)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func post(url, key, value string) (int, error) {
+	body, _ := json.Marshal(map[string]string{"key": key, "value": value})
+	resp, err := http.Post(url+"/db", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func TestSplitKeepsConcurrentWrites(t *testing.T) {
+	group0 := openTestGroup(t, 0, true)
+	initial, err := NewHashMap(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func(id int, bootstrap bool) (*Group, error) {
+		return openTestGroup(t, id, bootstrap), nil
+	}
+	m, err := NewManager("node1", group0, initial, open, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	ts := httptest.NewServer(httpd.NewHTTPServer("", group0.Raft, group0.DB, httpd.WithRouter(m)).Handler())
+	defer ts.Close()
+
+	// The leader of group 0 stores the initial map
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		stored, err := readMap(group0.DB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shard map was not stored")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, g := range m.Groups() {
+		if err := waitLeader(g.Raft, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	var acked []string
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 32; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				key := fmt.Sprintf("w%d-%d", w, i)
+				status, err := post(ts.URL, key, key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if status == http.StatusOK {
+					mu.Lock()
+					acked = append(acked, key)
+					mu.Unlock()
+				}
+			}
+		}(w)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	shardMap, err := m.Split("0768")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(stopCh)
+	wg.Wait()
+
+	if shardMap.Pending != nil {
+		t.Fatalf("expected the split to be finished, got %+v", shardMap)
+	}
+	var moved int
+	for _, key := range acked {
+		if shardMap.Lookup(key).Group == 2 {
+			moved++
+		}
+		resp, err := http.Get(ts.URL + "/db/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("acknowledged write of %s is lost, reading it answered %d", key, resp.StatusCode)
+		}
+	}
+	if moved == 0 {
+		t.Fatalf("expected some of the %d writes to go to the new group", len(acked))
+	}
+
+	m.mu.RLock()
+	source := m.groups[1]
+	m.mu.RUnlock()
+	keys, err := movedKeys(source.DB, shardMap, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("expected the moved keys to be removed from the source group, %d are left", len(keys))
+	}
+}
@@ -0,0 +1,179 @@
+package shard
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Slots is the number of hash slots keys are spread over in hash mode.
+const Slots = 1024
+
+const (
+	ModeHash   = "hash"
+	ModePrefix = "prefix"
+)
+
+// Range assigns the routing keys from Start (inclusive) up to End (exclusive,
+// empty for no upper bound) to a raft group. In prefix mode the routing key is
+// the key itself, in hash mode it is the zero padded hash slot of the key.
+type Range struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Group int    `json:"group"`
+}
+
+func (r Range) contains(routingKey string) bool {
+	return routingKey >= r.Start && (r.End == "" || routingKey < r.End)
+}
+
+// Map is the replicated assignment of key ranges to raft groups. The first
+// InitialGroups groups are bootstrapped by every node on its first start,
+// groups created by a split are started once the map announces them.
+type Map struct {
+	Mode          string  `json:"mode"`
+	Version       uint64  `json:"version"`
+	InitialGroups int     `json:"initial_groups"`
+	Ranges        []Range `json:"ranges"`
+	// Pending is the split this map was created by until it is finished
+	Pending *PendingSplit `json:"pending_split,omitempty"`
+}
+
+// PendingSplit is a split whose map is committed, but whose new group may
+// still lack the other servers of the source group, or whose source group may
+// still hold the moved keys.
+type PendingSplit struct {
+	Source int `json:"source"`
+	Target int `json:"target"`
+}
+
+// finished returns the next version of the map without the pending split.
+func (m *Map) finished() *Map {
+	next := *m
+	next.Version++
+	next.Pending = nil
+	return &next
+}
+
+// NewHashMap spreads the hash slots evenly over the given number of groups.
+func NewHashMap(groups int) (*Map, error) {
+	if groups < 1 || groups > Slots {
+		return nil, fmt.Errorf("number of groups must be between 1 and %d", Slots)
+	}
+
+	m := &Map{Mode: ModeHash, Version: 1, InitialGroups: groups}
+	for g := 0; g < groups; g++ {
+		r := Range{Start: slotKey(g * Slots / groups), Group: g}
+		if g == 0 {
+			r.Start = ""
+		}
+		if g < groups-1 {
+			r.End = slotKey((g + 1) * Slots / groups)
+		}
+		m.Ranges = append(m.Ranges, r)
+	}
+	return m, nil
+}
+
+// NewPrefixMap creates one group per key range between the given boundaries.
+func NewPrefixMap(boundaries []string) (*Map, error) {
+	sorted := append([]string(nil), boundaries...)
+	sort.Strings(sorted)
+	for i, b := range sorted {
+		if b == "" || (i > 0 && b == sorted[i-1]) {
+			return nil, fmt.Errorf("range boundaries must be unique and not empty")
+		}
+	}
+
+	m := &Map{Mode: ModePrefix, Version: 1, InitialGroups: len(sorted) + 1}
+	start := ""
+	for g, b := range sorted {
+		m.Ranges = append(m.Ranges, Range{Start: start, End: b, Group: g})
+		start = b
+	}
+	m.Ranges = append(m.Ranges, Range{Start: start, Group: len(sorted)})
+	return m, nil
+}
+
+func slotKey(slot int) string {
+	return fmt.Sprintf("%04d", slot)
+}
+
+// RoutingKey returns what the ranges of the map are compared against.
+func (m *Map) RoutingKey(key string) string {
+	if m.Mode != ModeHash {
+		return key
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return slotKey(int(h.Sum32() % Slots))
+}
+
+// Lookup returns the range owning the key.
+func (m *Map) Lookup(key string) Range {
+	return m.lookupRoutingKey(m.RoutingKey(key))
+}
+
+func (m *Map) lookupRoutingKey(routingKey string) Range {
+	for _, r := range m.Ranges {
+		if r.contains(routingKey) {
+			return r
+		}
+	}
+	// The ranges cover the whole key space
+	return m.Ranges[0]
+}
+
+// Groups returns the IDs of all groups in the map in ascending order.
+func (m *Map) Groups() []int {
+	seen := make(map[int]bool)
+	var groups []int
+	for _, r := range m.Ranges {
+		if !seen[r.Group] {
+			seen[r.Group] = true
+			groups = append(groups, r.Group)
+		}
+	}
+	sort.Ints(groups)
+	return groups
+}
+
+// Split moves the routing keys from at up to the end of the range containing
+// at into a new group. It returns the new map, the range left to the source
+// group and the range moved to the new group.
+func (m *Map) Split(at string) (*Map, Range, Range, error) {
+	if m.Mode == ModeHash {
+		slot, err := strconv.Atoi(at)
+		if err != nil || slot <= 0 || slot >= Slots || slotKey(slot) != at {
+			return nil, Range{}, Range{}, fmt.Errorf("split point of a hash map must be a slot between %s and %s", slotKey(1), slotKey(Slots-1))
+		}
+	}
+
+	next := &Map{Mode: m.Mode, Version: m.Version + 1, InitialGroups: m.InitialGroups}
+	newGroup := 0
+	for _, g := range m.Groups() {
+		if g >= newGroup {
+			newGroup = g + 1
+		}
+	}
+
+	var kept, moved Range
+	found := false
+	for _, r := range m.Ranges {
+		if !found && r.contains(at) {
+			if at == r.Start {
+				return nil, Range{}, Range{}, fmt.Errorf("split point %s is already the start of a range", at)
+			}
+			found = true
+			kept = Range{Start: r.Start, End: at, Group: r.Group}
+			moved = Range{Start: at, End: r.End, Group: newGroup}
+			next.Ranges = append(next.Ranges, kept, moved)
+			continue
+		}
+		next.Ranges = append(next.Ranges, r)
+	}
+
+	next.Pending = &PendingSplit{Source: kept.Group, Target: moved.Group}
+	return next, kept, moved, nil
+}
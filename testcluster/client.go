@@ -0,0 +1,111 @@
+package testcluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// response is the body every endpoint answers with.
+type response struct {
+	Message string          `json:"message"`
+	Error   string          `json:"error"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// Set stores a value through the HTTP API of a node.
+func (c *Cluster) Set(n *Node, key string, value interface{}) error {
+	_, err := do(n, http.MethodPost, "/db", map[string]interface{}{
+		"key":   key,
+		"value": value,
+	})
+	return err
+}
+
+// Get reads a value through the HTTP API of a node. consistency is passed as
+// the consistency parameter unless it is empty.
+func (c *Cluster) Get(n *Node, key, consistency string) (interface{}, error) {
+	path := "/db/" + url.PathEscape(key)
+	if consistency != "" {
+		path += "?consistency=" + url.QueryEscape(consistency)
+	}
+	data, err := do(n, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var kv struct {
+		Value interface{} `json:"value"`
+	}
+	if err := json.Unmarshal(data, &kv); err != nil {
+		return nil, err
+	}
+	return kv.Value, nil
+}
+
+// Delete removes a key through the HTTP API of a node.
+func (c *Cluster) Delete(n *Node, key string) error {
+	_, err := do(n, http.MethodDelete, "/db/"+url.PathEscape(key), nil)
+	return err
+}
+
+// Join adds a node started with AddNode to the cluster through the HTTP API
+// of the leader. suffrage is "voter" or "nonvoter", empty means voter.
+func (c *Cluster) Join(leader, n *Node, suffrage string) error {
+	path := "/raft/join"
+	if suffrage != "" {
+		path += "?suffrage=" + url.QueryEscape(suffrage)
+	}
+	_, err := do(leader, http.MethodPost, path, map[string]interface{}{
+		"node_id":      string(n.ID),
+		"raft_address": string(n.Address()),
+		"http_address": n.HTTPAddress(),
+	})
+	return err
+}
+
+// Remove removes a node from the cluster through the HTTP API of the leader.
+func (c *Cluster) Remove(leader, n *Node) error {
+	_, err := do(leader, http.MethodPost, "/raft/remove", map[string]interface{}{
+		"node_id": string(n.ID),
+	})
+	return err
+}
+
+// do sends a request to a node and returns the data of a 200 answer, any
+// other status is returned as error with the message of the node.
+func do(n *Node, method, path string, body interface{}) (json.RawMessage, error) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, n.URL+path, &reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("%s %s on %s answered %d: %s", method, path, n.ID, resp.StatusCode, err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s on %s answered %d: %s", method, path, n.ID, resp.StatusCode, r.Error)
+	}
+	return r.Data, nil
+}
@@ -0,0 +1,521 @@
+// Package testcluster runs a dpasswd cluster inside one process for
+// integration tests. Every node has its own raft instance on an in-memory
+// transport, in-memory log, stable and snapshot stores, Badger in a temporary
+// directory and the HTTP API on an httptest server:
+//
+//	c := testcluster.New(t, 3)
+//	leader := c.WaitForLeader(t, 5*time.Second)
+//	if err := c.Set(leader, "key", "value"); err != nil {
+//		t.Fatal(err)
+//	}
+//	c.AssertConverged(t, 5*time.Second)
+//
+// Everything is shut down and removed when the test ends.
+package testcluster
+
+import (
+	"dpasswd/fsm"
+	"dpasswd/httpd"
+	"dpasswd/logging"
+	"dpasswd/transport"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// TB is the part of testing.TB the cluster needs, so that it also runs
+// outside of tests, e.g. in the lincheck tool.
+type TB interface {
+	Helper()
+	Log(args ...interface{})
+	Fatalf(format string, args ...interface{})
+	Cleanup(func())
+}
+
+// Node is one server of the cluster.
+type Node struct {
+	ID        raft.ServerID
+	Raft      *raft.Raft
+	DB        *badger.DB
+	Digests   *fsm.Digests
+	Logs      raft.LogStore
+	Snapshots raft.SnapshotStore
+	Transport *raft.InmemTransport
+	// Faults injects faults into the RPCs the node sends
+	Faults *transport.FaultyTransport
+	Server *httptest.Server
+	// URL is the base URL of the HTTP API, e.g. http://127.0.0.1:40123
+	URL string
+
+	dir         string
+	closeServer func()
+	stopped     bool
+}
+
+// Address is the raft address of the node on the in-memory network.
+func (n *Node) Address() raft.ServerAddress {
+	return n.Transport.LocalAddr()
+}
+
+// HTTPAddress is the host and port of the HTTP API.
+func (n *Node) HTTPAddress() string {
+	return strings.TrimPrefix(n.URL, "http://")
+}
+
+type options struct {
+	raftConfig    func(*raft.Config)
+	serverOptions []httpd.Option
+	logLevel      string
+	logOutput     io.Writer
+	seed          int64
+}
+
+// Option configures the nodes of a cluster.
+type Option func(*options)
+
+// WithRaftConfig changes the raft configuration of every node, which starts
+// with timeouts suited to the in-memory transport.
+func WithRaftConfig(fn func(*raft.Config)) Option {
+	return func(o *options) {
+		o.raftConfig = fn
+	}
+}
+
+// WithServerOptions passes further options to the HTTP server of every node.
+func WithServerOptions(opts ...httpd.Option) Option {
+	return func(o *options) {
+		o.serverOptions = append(o.serverOptions, opts...)
+	}
+}
+
+// WithLogs writes the logs of all nodes at the given level to w instead of
+// the test log.
+func WithLogs(level string, w io.Writer) Option {
+	return func(o *options) {
+		o.logLevel = level
+		o.logOutput = w
+	}
+}
+
+// WithSeed makes the injected faults of every run the same, by default they
+// are seeded with the current time.
+func WithSeed(seed int64) Option {
+	return func(o *options) {
+		o.seed = seed
+	}
+}
+
+// Cluster is a set of nodes connected through in-memory transports.
+type Cluster struct {
+	opts    options
+	loggers *logging.Loggers
+	output  *testWriter
+
+	mu    sync.Mutex
+	nodes []*Node
+	// added counts the nodes started so far, including those still starting
+	added int
+	// partitions assigns nodes cut off from the others to a partition,
+	// nodes without one are in partition 0
+	partitions map[raft.ServerID]int
+}
+
+// New starts a cluster of n voters bootstrapped with each other. It does not
+// wait for a leader.
+func New(t TB, n int, opts ...Option) *Cluster {
+	t.Helper()
+
+	c := &Cluster{
+		opts:       options{logLevel: "warn", seed: time.Now().UnixNano()},
+		partitions: make(map[raft.ServerID]int),
+	}
+	for _, opt := range opts {
+		opt(&c.opts)
+	}
+
+	out := c.opts.logOutput
+	if out == nil {
+		c.output = &testWriter{t: t}
+		out = c.output
+	}
+	loggers, err := logging.New(logging.Config{Level: c.opts.logLevel, Output: out})
+	if err != nil {
+		t.Fatalf("error setting up logging: %s", err.Error())
+	}
+	c.loggers = loggers
+	t.Cleanup(c.Shutdown)
+
+	var servers []raft.Server
+	for i := 0; i < n; i++ {
+		node := c.AddNode(t)
+		servers = append(servers, raft.Server{ID: node.ID, Address: node.Address()})
+	}
+	for _, node := range c.Nodes() {
+		// A node the first bootstrapped ones already replicated to has the
+		// configuration
+		err := node.Raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+		if err != nil && err != raft.ErrCantBootstrap {
+			t.Fatalf("error bootstrapping %s: %s", node.ID, err.Error())
+		}
+	}
+	return c
+}
+
+// AddNode starts a node that is connected to the others but not a member of
+// the cluster, use Join to add it.
+func (c *Cluster) AddNode(t TB) *Node {
+	t.Helper()
+
+	// The number is taken before the node is started, so that concurrent
+	// calls do not pick the same ID
+	c.mu.Lock()
+	c.added++
+	number := c.added
+	c.mu.Unlock()
+	id := raft.ServerID(fmt.Sprintf("node%d", number))
+
+	dir, err := os.MkdirTemp("", "dpasswd-"+string(id)+"-")
+	if err != nil {
+		t.Fatalf("error creating data directory: %s", err.Error())
+	}
+	logger := func(subsystem string) hclog.Logger {
+		return c.loggers.Logger(subsystem).With("node", id)
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(logging.BadgerLogger(logger("badger"))))
+	if err != nil {
+		t.Fatalf("error opening badger: %s", err.Error())
+	}
+
+	cfg := raft.DefaultConfig()
+	cfg.LocalID = id
+	cfg.HeartbeatTimeout = 50 * time.Millisecond
+	cfg.ElectionTimeout = 50 * time.Millisecond
+	cfg.LeaderLeaseTimeout = 50 * time.Millisecond
+	cfg.CommitTimeout = 5 * time.Millisecond
+	cfg.Logger = logger("raft")
+	if c.opts.raftConfig != nil {
+		c.opts.raftConfig(cfg)
+	}
+
+	store := raft.NewInmemStore()
+	_, trans := raft.NewInmemTransport(raft.ServerAddress(id))
+	faults := transport.NewFaultyTransport(trans, c.opts.seed+int64(number-1))
+	tracker := transport.NewTracker(faults)
+	snapshots := raft.NewInmemSnapshotStore()
+	kvFSM := fsm.NewRaftFSM(db, logger("fsm"))
+	r, err := raft.NewRaft(cfg, kvFSM, store, store, snapshots, tracker)
+	if err != nil {
+		t.Fatalf("error starting raft: %s", err.Error())
+	}
+
+	// The HTTP address has to be known before the server is built, so the
+	// listener is opened first
+	ts := httptest.NewUnstartedServer(nil)
+	node := &Node{
+		ID:        id,
+		Raft:      r,
+		DB:        db,
+		Digests:   kvFSM.Digests(),
+		Logs:      store,
+		Snapshots: snapshots,
+		Transport: trans,
+		Faults:    faults,
+		Server:    ts,
+		URL:       "http://" + ts.Listener.Addr().String(),
+		dir:       dir,
+	}
+	opts := append([]httpd.Option{
+		httpd.WithTracker(tracker),
+		httpd.WithAdvertise(id, node.HTTPAddress()),
+		httpd.WithRaftConfig(cfg),
+		httpd.WithLogging(c.loggers),
+		httpd.WithSnapshotStore(snapshots),
+		httpd.WithDigests(node.Digests),
+	}, c.opts.serverOptions...)
+	server := httpd.NewHTTPServer("", r, db, opts...)
+	node.closeServer = server.Close
+	ts.Config.Handler = server.Handler()
+	ts.Start()
+
+	c.mu.Lock()
+	c.nodes = append(c.nodes, node)
+	c.mu.Unlock()
+	c.connect()
+	return node
+}
+
+// Nodes returns every node, including stopped ones.
+func (c *Cluster) Nodes() []*Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Node(nil), c.nodes...)
+}
+
+// Node returns the node with the given ID.
+func (c *Cluster) Node(id raft.ServerID) *Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range c.nodes {
+		if n.ID == id {
+			return n
+		}
+	}
+	return nil
+}
+
+// Running returns the nodes that were not stopped.
+func (c *Cluster) Running() []*Node {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var running []*Node
+	for _, n := range c.nodes {
+		if !n.stopped {
+			running = append(running, n)
+		}
+	}
+	return running
+}
+
+// Stop shuts a node down as if its process died. Its data directory is kept
+// until the cluster is shut down.
+func (c *Cluster) Stop(n *Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n.stopped {
+		return
+	}
+	n.stopped = true
+
+	for _, other := range c.nodes {
+		if other != n {
+			other.Transport.Disconnect(n.Address())
+		}
+	}
+	n.Server.Close()
+	n.closeServer()
+	_ = n.Raft.Shutdown().Error()
+	_ = n.DB.Close()
+}
+
+func (c *Cluster) stopped(n *Node) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return n.stopped
+}
+
+// Shutdown stops every node and removes their data. It runs when the test
+// ends.
+func (c *Cluster) Shutdown() {
+	for _, n := range c.Nodes() {
+		c.Stop(n)
+		_ = os.RemoveAll(n.dir)
+	}
+	if c.output != nil {
+		c.output.close()
+	}
+}
+
+// Partition cuts the given nodes off from the rest of the cluster. Nodes of
+// the same call can still reach each other, nodes of different calls cannot.
+func (c *Cluster) Partition(nodes ...*Node) {
+	c.mu.Lock()
+	partition := 1
+	for _, p := range c.partitions {
+		if p >= partition {
+			partition = p + 1
+		}
+	}
+	for _, n := range nodes {
+		c.partitions[n.ID] = partition
+	}
+	c.mu.Unlock()
+	c.connect()
+}
+
+// Heal reconnects every running node with each other.
+func (c *Cluster) Heal() {
+	c.mu.Lock()
+	c.partitions = make(map[raft.ServerID]int)
+	c.mu.Unlock()
+	c.connect()
+}
+
+// connect links every pair of running nodes in the same partition and
+// separates all others.
+func (c *Cluster) connect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, a := range c.nodes {
+		for _, b := range c.nodes {
+			if a == b || a.stopped {
+				continue
+			}
+			if b.stopped || c.partitions[a.ID] != c.partitions[b.ID] {
+				a.Transport.Disconnect(b.Address())
+				continue
+			}
+			a.Transport.Connect(b.Address(), b.Transport)
+		}
+	}
+}
+
+// SetFault injects a fault into the RPCs from one node to another. The other
+// direction is not affected.
+func (c *Cluster) SetFault(from, to *Node, fault transport.Fault) {
+	from.Faults.SetFault(to.ID, fault)
+}
+
+// ClearFaults removes the faults of every node.
+func (c *Cluster) ClearFaults() {
+	for _, n := range c.Nodes() {
+		n.Faults.ClearAll()
+	}
+}
+
+// WaitForLeader waits until one of the given nodes, or of all running nodes
+// if none are given, is the leader and returns it. A node that lost contact
+// with the others may still consider itself the leader, so after a partition
+// pass the nodes of the majority.
+func (c *Cluster) WaitForLeader(t TB, timeout time.Duration, among ...*Node) *Node {
+	t.Helper()
+	if len(among) == 0 {
+		among = c.Running()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, n := range among {
+			if c.stopped(n) || n.Raft.State() != raft.Leader {
+				continue
+			}
+			// Every node of the group has to agree, otherwise an election
+			// is still going on
+			agreed := true
+			for _, other := range among {
+				if _, leaderID := other.Raft.LeaderWithID(); !c.stopped(other) && leaderID != n.ID {
+					agreed = false
+				}
+			}
+			if agreed {
+				return n
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no leader among %s after %s", nodeIDs(among), timeout)
+	return nil
+}
+
+// AssertConverged waits until the given nodes, or all running nodes, have
+// applied the same log and hold the same data, and fails the test with the
+// differences otherwise.
+func (c *Cluster) AssertConverged(t TB, timeout time.Duration, among ...*Node) {
+	t.Helper()
+	if len(among) == 0 {
+		among = c.Running()
+	}
+
+	var diff string
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if diff = converged(among); diff == "" {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("nodes %s did not converge after %s: %s", nodeIDs(among), timeout, diff)
+}
+
+// converged describes the first difference between the nodes, it is empty
+// once they are equal.
+func converged(nodes []*Node) string {
+	if len(nodes) == 0 {
+		return ""
+	}
+
+	first := nodes[0]
+	firstData, err := Dump(first.DB)
+	if err != nil {
+		return err.Error()
+	}
+	for _, n := range nodes[1:] {
+		if n.Raft.AppliedIndex() != first.Raft.AppliedIndex() {
+			return fmt.Sprintf("%s applied index %d, %s applied index %d", first.ID, first.Raft.AppliedIndex(), n.ID, n.Raft.AppliedIndex())
+		}
+		data, err := Dump(n.DB)
+		if err != nil {
+			return err.Error()
+		}
+		for key, value := range firstData {
+			if other, ok := data[key]; !ok || other != value {
+				return fmt.Sprintf("key %q is %q on %s and %q on %s", key, value, first.ID, other, n.ID)
+			}
+		}
+		for key, value := range data {
+			if _, ok := firstData[key]; !ok {
+				return fmt.Sprintf("key %q is missing on %s and %q on %s", key, first.ID, value, n.ID)
+			}
+		}
+	}
+	return ""
+}
+
+// Dump returns every key of a node with its raw JSON value, including the
+// cluster metadata.
+func Dump(db *badger.DB) (map[string]string, error) {
+	data := make(map[string]string)
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			data[string(it.Item().Key())] = string(value)
+		}
+		return nil
+	})
+	return data, err
+}
+
+func nodeIDs(nodes []*Node) string {
+	ids := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		ids = append(ids, string(n.ID))
+	}
+	return "[" + strings.Join(ids, " ") + "]"
+}
+
+// testWriter sends the logs of the nodes to the test log. Raft may still log
+// while shutting down, after the test ended, so it stops forwarding once the
+// cluster is shut down.
+type testWriter struct {
+	t      TB
+	mu     sync.Mutex
+	closed bool
+}
+
+func (w *testWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.t.Log(strings.TrimRight(string(p), "\n"))
+	}
+	return len(p), nil
+}
+
+func (w *testWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+}
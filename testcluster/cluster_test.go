@@ -0,0 +1,159 @@
+package testcluster
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func configuration(t *testing.T, n *Node) map[raft.ServerID]raft.ServerSuffrage {
+	t.Helper()
+	future := n.Raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		t.Fatal(err)
+	}
+	servers := make(map[raft.ServerID]raft.ServerSuffrage)
+	for _, srv := range future.Configuration().Servers {
+		servers[srv.ID] = srv.Suffrage
+	}
+	return servers
+}
+
+func TestJoin(t *testing.T) {
+	c := New(t, 1)
+	leader := c.WaitForLeader(t, 5*time.Second)
+
+	voter := c.AddNode(t)
+	nonvoter := c.AddNode(t)
+	if err := c.Join(leader, voter, "voter"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Join(leader, nonvoter, "nonvoter"); err != nil {
+		t.Fatal(err)
+	}
+
+	servers := configuration(t, leader)
+	if len(servers) != 3 {
+		t.Fatalf("expected 3 servers, got %v", servers)
+	}
+	if servers[voter.ID] != raft.Voter {
+		t.Errorf("expected %s to be a voter, got %s", voter.ID, servers[voter.ID])
+	}
+	if servers[nonvoter.ID] != raft.Nonvoter {
+		t.Errorf("expected %s to be a nonvoter, got %s", nonvoter.ID, servers[nonvoter.ID])
+	}
+
+	if err := c.Set(leader, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertConverged(t, 5*time.Second)
+}
+
+func TestAddNodeConcurrently(t *testing.T) {
+	c := New(t, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.AddNode(t)
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[raft.ServerID]bool)
+	for _, n := range c.Nodes() {
+		if seen[n.ID] {
+			t.Fatalf("node ID %s is used twice", n.ID)
+		}
+		seen[n.ID] = true
+	}
+	if len(seen) != 4 {
+		t.Fatalf("expected 4 nodes, got %d", len(seen))
+	}
+}
+
+func TestRemove(t *testing.T) {
+	c := New(t, 3)
+	leader := c.WaitForLeader(t, 5*time.Second)
+
+	var follower *Node
+	for _, n := range c.Nodes() {
+		if n != leader {
+			follower = n
+			break
+		}
+	}
+	if err := c.Remove(leader, follower); err != nil {
+		t.Fatal(err)
+	}
+
+	servers := configuration(t, leader)
+	if _, ok := servers[follower.ID]; ok || len(servers) != 2 {
+		t.Fatalf("expected %s to be removed, got %v", follower.ID, servers)
+	}
+}
+
+func TestSetGetDelete(t *testing.T) {
+	c := New(t, 3)
+	leader := c.WaitForLeader(t, 5*time.Second)
+
+	if err := c.Set(leader, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	value, err := c.Get(leader, "key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "value" {
+		t.Fatalf("expected value, got %v", value)
+	}
+
+	if err := c.Delete(leader, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := c.Get(leader, "key", ""); err == nil {
+		t.Fatalf("expected key to be deleted, got %v", value)
+	}
+	c.AssertConverged(t, 5*time.Second)
+}
+
+func TestPartitionHeal(t *testing.T) {
+	c := New(t, 3)
+	leader := c.WaitForLeader(t, 5*time.Second)
+
+	var cutOff *Node
+	var majority []*Node
+	for _, n := range c.Nodes() {
+		if n != leader && cutOff == nil {
+			cutOff = n
+			continue
+		}
+		majority = append(majority, n)
+	}
+	c.Partition(cutOff)
+
+	leader = c.WaitForLeader(t, 5*time.Second, majority...)
+	if err := c.Set(leader, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := mustDump(t, cutOff)["key"]; ok {
+		t.Fatalf("expected the partitioned node to miss the write, got %s", value)
+	}
+
+	c.Heal()
+	c.WaitForLeader(t, 10*time.Second)
+	c.AssertConverged(t, 10*time.Second)
+}
+
+func mustDump(t *testing.T, n *Node) map[string]string {
+	t.Helper()
+	data, err := Dump(n.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
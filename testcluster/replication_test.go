@@ -0,0 +1,100 @@
+package testcluster
+
+import (
+	"dpasswd/httpd"
+	"dpasswd/replication"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// waitForValue reads a key from a node until it has the given value.
+func waitForValue(t *testing.T, c *Cluster, n *Node, key, value string, timeout time.Duration) {
+	t.Helper()
+	var got interface{}
+	var err error
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if got, err = c.Get(n, key, ""); err == nil && got == value {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("expected %s to be %s on %s, got %v (%v)", key, value, n.ID, got, err)
+}
+
+func TestReplicationToStandby(t *testing.T) {
+	// The log is compacted down to the snapshot, so that the standby has to
+	// start with a full sync
+	primary := New(t, 3, WithRaftConfig(func(cfg *raft.Config) {
+		cfg.TrailingLogs = 0
+		cfg.SnapshotThreshold = 1 << 20
+	}))
+	standby := New(t, 3, WithServerOptions(httpd.WithStandby()))
+	leader := primary.WaitForLeader(t, 5*time.Second)
+	standbyLeader := standby.WaitForLeader(t, 5*time.Second)
+
+	for i := 0; i < 10; i++ {
+		if err := primary.Set(leader, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := do(leader, http.MethodPost, "/admin/snapshot", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var targets []string
+	for _, n := range standby.Nodes() {
+		targets = append(targets, n.URL)
+	}
+	sources := make(map[raft.ServerID]*replication.Source)
+	for _, n := range primary.Nodes() {
+		source := replication.NewSource(append([]string(nil), targets...), n.Raft, n.Logs, n.Snapshots, hclog.NewNullLogger())
+		t.Cleanup(source.Stop)
+		sources[n.ID] = source
+	}
+
+	for i := 0; i < 10; i++ {
+		waitForValue(t, standby, standbyLeader, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i), 10*time.Second)
+	}
+
+	// Later writes are replicated entry by entry
+	if err := primary.Set(leader, "key0", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Delete(leader, "key1"); err != nil {
+		t.Fatal(err)
+	}
+	waitForValue(t, standby, standbyLeader, "key0", "changed", 10*time.Second)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := standby.Get(standbyLeader, "key1", ""); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected key1 to be deleted on the standby")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if status := sources[leader.ID].Status(); status.FullSyncs == 0 {
+		t.Errorf("expected the standby to be synced from the snapshot first, got %+v", status)
+	}
+	data, err := do(standbyLeader, http.MethodGet, "/replication/status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status replication.SinkStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Role != replication.RoleStandby || status.Checkpoint == 0 {
+		t.Errorf("expected a standby with a checkpoint, got %+v", status)
+	}
+	standby.AssertConverged(t, 5*time.Second)
+}
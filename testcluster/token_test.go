@@ -0,0 +1,102 @@
+package testcluster
+
+import (
+	"bytes"
+	"dpasswd/httpd"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// consistencyToken sends a request and returns the consistency token of the
+// answer.
+func consistencyToken(t *testing.T, req *http.Request) string {
+	t.Helper()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Token uint64 `json:"consistency_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	token := resp.Header.Get("X-Consistency-Token")
+	if resp.StatusCode != http.StatusOK || token == "" || token != strconv.FormatUint(body.Token, 10) {
+		t.Fatalf("expected a token in the header and body, got %d %q %+v", resp.StatusCode, token, body)
+	}
+	return token
+}
+
+// readWithToken reads a key carrying a consistency token and returns the
+// status and error of the answer.
+func readWithToken(t *testing.T, n *Node, key, token string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, n.URL+"/db/"+key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Consistency-Token", token)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var r response
+	_ = json.NewDecoder(resp.Body).Decode(&r)
+	return resp.StatusCode, r.Error
+}
+
+func TestConsistencyToken(t *testing.T) {
+	c := New(t, 3, WithServerOptions(httpd.WithConsistencyTokenTimeout(300*time.Millisecond)))
+	leader := c.WaitForLeader(t, 5*time.Second)
+	var follower *Node
+	for _, n := range c.Nodes() {
+		if n != leader {
+			follower = n
+			break
+		}
+	}
+
+	// The follower is cut off before the write, so it cannot have applied it
+	c.Partition(follower)
+	req, _ := http.NewRequest(http.MethodPost, leader.URL+"/db", bytes.NewBufferString(`{"key":"key","value":"value"}`))
+	req.Header.Set("Content-Type", "application/json")
+	token := consistencyToken(t, req)
+
+	start := time.Now()
+	status, message := readWithToken(t, follower, "key", token)
+	if status != http.StatusUnprocessableEntity || !strings.Contains(message, "consistency token "+token) {
+		t.Fatalf("expected the read to time out waiting for the token, got %d %s", status, message)
+	}
+	if waited := time.Since(start); waited < 300*time.Millisecond {
+		t.Fatalf("expected the read to wait for the token timeout, it answered after %s", waited)
+	}
+
+	// Once healed, a read carrying the token waits for the write. The node
+	// that was cut off may have started an election meanwhile.
+	c.Heal()
+	if status, message := readWithToken(t, follower, "key", token); status != http.StatusOK {
+		t.Fatalf("expected the read to see the write, got %d %s", status, message)
+	}
+
+	leader = c.WaitForLeader(t, 10*time.Second)
+	req, _ = http.NewRequest(http.MethodDelete, leader.URL+"/db/key", nil)
+	token = consistencyToken(t, req)
+	for _, n := range c.Nodes() {
+		if status, _ := readWithToken(t, n, "key", token); status == http.StatusOK {
+			t.Fatalf("expected the read on %s to see the delete", n.ID)
+		}
+	}
+
+	if status, message := readWithToken(t, follower, "key", "x"); status != http.StatusUnprocessableEntity || !strings.Contains(message, "invalid consistency token") {
+		t.Fatalf("expected an invalid token to be rejected, got %d %s", status, message)
+	}
+}
@@ -0,0 +1,315 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Fault describes what happens to the RPCs sent to one peer. Probabilities
+// are between 0 and 1.
+type Fault struct {
+	// Drop fails the RPC without sending it
+	Drop float64
+	// Delay, plus a random part of up to Jitter, passes before the RPC is
+	// sent
+	Delay  time.Duration
+	Jitter time.Duration
+	// Duplicate sends the RPC a second time shortly after the first
+	Duplicate float64
+	// Reorder holds the RPC back for up to ReorderWindow, so that later
+	// RPCs overtake it. The sender sees it as lost.
+	Reorder       float64
+	ReorderWindow time.Duration
+}
+
+// FaultStats counts what was done to the RPCs sent to one peer.
+type FaultStats struct {
+	Sent       uint64
+	Dropped    uint64
+	Delayed    uint64
+	Duplicated uint64
+	Reordered  uint64
+}
+
+// ErrInjected is returned for RPCs that were dropped or held back.
+type ErrInjected struct {
+	Peer  raft.ServerID
+	Fault string
+}
+
+func (e ErrInjected) Error() string {
+	return fmt.Sprintf("injected fault: %s RPC to %s", e.Fault, e.Peer)
+}
+
+// duplicateDelay is how long after the original a duplicate is sent.
+const duplicateDelay = 5 * time.Millisecond
+
+// FaultyTransport wraps a raft.Transport and injects faults into the RPCs
+// sent to single peers, e.g. to cut one direction of a link for an asymmetric
+// partition. Faults only apply to outgoing RPCs, a link between two nodes is
+// cut in both directions by setting a fault on each of them.
+//
+// Pipelined replication is disabled, so that every AppendEntries RPC goes
+// through the faults.
+type FaultyTransport struct {
+	raft.Transport
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	faults map[raft.ServerID]Fault
+	stats  map[raft.ServerID]*FaultStats
+}
+
+func NewFaultyTransport(trans raft.Transport, seed int64) *FaultyTransport {
+	return &FaultyTransport{
+		Transport: trans,
+		rand:      rand.New(rand.NewSource(seed)),
+		faults:    make(map[raft.ServerID]Fault),
+		stats:     make(map[raft.ServerID]*FaultStats),
+	}
+}
+
+// SetFault replaces the fault of the RPCs to a peer.
+func (f *FaultyTransport) SetFault(peer raft.ServerID, fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[peer] = fault
+}
+
+// ClearFault lets the RPCs to a peer through unchanged again.
+func (f *FaultyTransport) ClearFault(peer raft.ServerID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.faults, peer)
+}
+
+// ClearAll removes the faults of every peer.
+func (f *FaultyTransport) ClearAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = make(map[raft.ServerID]Fault)
+}
+
+// Faults returns the current fault of every peer that has one.
+func (f *FaultyTransport) Faults() map[raft.ServerID]Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	faults := make(map[raft.ServerID]Fault, len(f.faults))
+	for peer, fault := range f.faults {
+		faults[peer] = fault
+	}
+	return faults
+}
+
+// Stats returns the counters of every peer RPCs were sent to.
+func (f *FaultyTransport) Stats() map[raft.ServerID]FaultStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stats := make(map[raft.ServerID]FaultStats, len(f.stats))
+	for peer, s := range f.stats {
+		stats[peer] = *s
+	}
+	return stats
+}
+
+// Peers returns the peers with a fault or counters ordered by ID.
+func (f *FaultyTransport) Peers() []raft.ServerID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seen := make(map[raft.ServerID]bool)
+	var peers []raft.ServerID
+	for peer := range f.faults {
+		seen[peer] = true
+		peers = append(peers, peer)
+	}
+	for peer := range f.stats {
+		if !seen[peer] {
+			peers = append(peers, peer)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i] < peers[j] })
+	return peers
+}
+
+// decision is what happens to a single RPC.
+type decision struct {
+	drop      bool
+	reorder   bool
+	duplicate bool
+	delay     time.Duration
+}
+
+func (f *FaultyTransport) decide(peer raft.ServerID) decision {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stats, ok := f.stats[peer]
+	if !ok {
+		stats = &FaultStats{}
+		f.stats[peer] = stats
+	}
+	stats.Sent++
+
+	fault, ok := f.faults[peer]
+	if !ok {
+		return decision{}
+	}
+
+	var d decision
+	switch {
+	case fault.Drop > 0 && f.rand.Float64() < fault.Drop:
+		d.drop = true
+		stats.Dropped++
+		return d
+	case fault.Reorder > 0 && f.rand.Float64() < fault.Reorder:
+		d.reorder = true
+		stats.Reordered++
+		if fault.ReorderWindow > 0 {
+			d.delay += time.Duration(f.rand.Int63n(int64(fault.ReorderWindow)))
+		}
+	}
+	d.delay += fault.Delay
+	if fault.Jitter > 0 {
+		d.delay += time.Duration(f.rand.Int63n(int64(fault.Jitter)))
+	}
+	if d.delay > 0 && !d.reorder {
+		stats.Delayed++
+	}
+	if fault.Duplicate > 0 && f.rand.Float64() < fault.Duplicate {
+		d.duplicate = true
+		stats.Duplicated++
+	}
+	return d
+}
+
+// inject sends an RPC through the fault of the peer. An RPC delivered in the
+// background is sent by the function detach returns, which has to work on a
+// copy of the request, as the caller reuses it once the RPC returned, and
+// must not write into the response of the caller. detach is called before
+// the RPC returns.
+func (f *FaultyTransport) inject(peer raft.ServerID, duplicable bool, send func() error, detach func() func() error) error {
+	d := f.decide(peer)
+	switch {
+	case d.drop:
+		return ErrInjected{Peer: peer, Fault: "dropped"}
+	case d.reorder:
+		detached := detach()
+		go func() {
+			time.Sleep(d.delay)
+			_ = detached()
+		}()
+		return ErrInjected{Peer: peer, Fault: "reordered"}
+	}
+
+	var duplicate func() error
+	if d.duplicate && duplicable {
+		duplicate = detach()
+	}
+	if d.delay > 0 {
+		time.Sleep(d.delay)
+	}
+	err := send()
+	if duplicate != nil {
+		go func() {
+			time.Sleep(duplicateDelay)
+			_ = duplicate()
+		}()
+	}
+	return err
+}
+
+func (f *FaultyTransport) AppendEntriesPipeline(id raft.ServerID, target raft.ServerAddress) (raft.AppendPipeline, error) {
+	return nil, raft.ErrPipelineReplicationNotSupported
+}
+
+func (f *FaultyTransport) AppendEntries(id raft.ServerID, target raft.ServerAddress, args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) error {
+	return f.inject(id, true, func() error {
+		return f.Transport.AppendEntries(id, target, args, resp)
+	}, func() func() error {
+		req := copyAppendEntries(args)
+		return func() error {
+			return f.Transport.AppendEntries(id, target, req, &raft.AppendEntriesResponse{})
+		}
+	})
+}
+
+func (f *FaultyTransport) RequestVote(id raft.ServerID, target raft.ServerAddress, args *raft.RequestVoteRequest, resp *raft.RequestVoteResponse) error {
+	return f.inject(id, true, func() error {
+		return f.Transport.RequestVote(id, target, args, resp)
+	}, func() func() error {
+		req := *args
+		req.RPCHeader = copyHeader(args.RPCHeader)
+		req.Candidate = copyBytes(args.Candidate)
+		return func() error {
+			return f.Transport.RequestVote(id, target, &req, &raft.RequestVoteResponse{})
+		}
+	})
+}
+
+// InstallSnapshot can be dropped and delayed, but not duplicated or
+// reordered, as the snapshot data can only be read once.
+func (f *FaultyTransport) InstallSnapshot(id raft.ServerID, target raft.ServerAddress, args *raft.InstallSnapshotRequest, resp *raft.InstallSnapshotResponse, data io.Reader) error {
+	d := f.decide(id)
+	if d.drop || d.reorder {
+		return ErrInjected{Peer: id, Fault: "dropped"}
+	}
+	if d.delay > 0 {
+		time.Sleep(d.delay)
+	}
+	return f.Transport.InstallSnapshot(id, target, args, resp, data)
+}
+
+func (f *FaultyTransport) TimeoutNow(id raft.ServerID, target raft.ServerAddress, args *raft.TimeoutNowRequest, resp *raft.TimeoutNowResponse) error {
+	return f.inject(id, false, func() error {
+		return f.Transport.TimeoutNow(id, target, args, resp)
+	}, func() func() error {
+		req := raft.TimeoutNowRequest{RPCHeader: copyHeader(args.RPCHeader)}
+		return func() error {
+			return f.Transport.TimeoutNow(id, target, &req, &raft.TimeoutNowResponse{})
+		}
+	})
+}
+
+func (f *FaultyTransport) Close() error {
+	if c, ok := f.Transport.(raft.WithClose); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// copyAppendEntries deep copies a request, raft refills the one it passes
+// for the next RPC to the peer.
+func copyAppendEntries(args *raft.AppendEntriesRequest) *raft.AppendEntriesRequest {
+	req := *args
+	req.RPCHeader = copyHeader(args.RPCHeader)
+	req.Leader = copyBytes(args.Leader)
+	if args.Entries != nil {
+		req.Entries = make([]*raft.Log, len(args.Entries))
+		for i, entry := range args.Entries {
+			l := *entry
+			l.Data = copyBytes(entry.Data)
+			l.Extensions = copyBytes(entry.Extensions)
+			req.Entries[i] = &l
+		}
+	}
+	return &req
+}
+
+func copyHeader(h raft.RPCHeader) raft.RPCHeader {
+	h.ID = copyBytes(h.ID)
+	h.Addr = copyBytes(h.Addr)
+	return h
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
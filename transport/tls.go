@@ -0,0 +1,306 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// TLSConfig holds the files used to secure the raft transport with mutual TLS.
+// Every node presents its certificate both as a server and as a client, so
+// the certificates need the serverAuth and clientAuth extended key usages.
+type TLSConfig struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+
+	// PinPeers requires the certificate presented by a dialed peer to carry
+	// the node ID of that peer, as registered in the raft configuration, as a
+	// DNS name SAN, and the certificate of a connecting peer to carry the
+	// node ID of any member of the configuration. A node that is the only
+	// member of its configuration accepts any peer, so that it can be joined.
+	PinPeers bool
+
+	// Logger reports failed certificate reloads, defaults to hclog.Default()
+	Logger hclog.Logger
+}
+
+// Peers returns the servers of the raft configuration peers are pinned to.
+type Peers func() []raft.Server
+
+// TLSStreamLayer is a raft.StreamLayer over mutually authenticated TLS. The
+// certificate files are reloaded when they change on disk, so certificates can
+// be rotated without restarting the node.
+type TLSStreamLayer struct {
+	net.Listener
+	advertise net.Addr
+	certs     *certReloader
+	pinPeers  bool
+
+	mu    sync.RWMutex
+	peers Peers
+}
+
+func NewTLSStreamLayer(bindAddr string, advertise net.Addr, cfg TLSConfig) (*TLSStreamLayer, error) {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = hclog.Default()
+	}
+	certs := &certReloader{
+		caFile:   cfg.CAFile,
+		certFile: cfg.CertFile,
+		keyFile:  cfg.KeyFile,
+		logger:   logger,
+	}
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+
+	list, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if advertise == nil {
+		advertise = list.Addr()
+	}
+	if addr, ok := advertise.(*net.TCPAddr); !ok || addr.IP == nil || addr.IP.IsUnspecified() {
+		_ = list.Close()
+		return nil, errors.New("local bind address is not advertisable")
+	}
+
+	l := &TLSStreamLayer{
+		advertise: advertise,
+		certs:     certs,
+		pinPeers:  cfg.PinPeers,
+	}
+	l.Listener = tls.NewListener(list, &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAnyClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return certs.certificate()
+		},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if err := l.verify(cs, x509.ExtKeyUsageClientAuth, ""); err != nil {
+				return err
+			}
+			if l.pinPeers {
+				return l.verifyMember(cs.PeerCertificates[0])
+			}
+			return nil
+		},
+	})
+
+	return l, nil
+}
+
+// SetPeers sets where the configuration peers are pinned to is read from.
+// It is set after the raft node exists, as the configuration lives there.
+func (l *TLSStreamLayer) SetPeers(peers Peers) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.peers = peers
+}
+
+func (l *TLSStreamLayer) servers() ([]raft.Server, bool) {
+	l.mu.RLock()
+	peers := l.peers
+	l.mu.RUnlock()
+	if peers == nil {
+		return nil, false
+	}
+	return peers(), true
+}
+
+// Reload reads the certificate files again, regardless of their modification
+// time.
+func (l *TLSStreamLayer) Reload() error {
+	return l.certs.load()
+}
+
+func (l *TLSStreamLayer) Addr() net.Addr {
+	return l.advertise
+}
+
+func (l *TLSStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	var expectedID string
+	if l.pinPeers {
+		servers, _ := l.servers()
+		for _, srv := range servers {
+			if srv.Address == address {
+				expectedID = string(srv.ID)
+			}
+		}
+		if expectedID == "" {
+			return nil, fmt.Errorf("no node ID known for peer %s", address)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", string(address), &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The chain and the pinned node ID are checked in VerifyConnection,
+		// raft addresses are plain IPs that certificates rarely carry.
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return l.certs.certificate()
+		},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return l.verify(cs, x509.ExtKeyUsageServerAuth, expectedID)
+		},
+	})
+}
+
+func (l *TLSStreamLayer) verify(cs tls.ConnectionState, usage x509.ExtKeyUsage, expectedID string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+
+	roots, err := l.certs.roots()
+	if err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	leaf := cs.PeerCertificates[0]
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		return err
+	}
+
+	if expectedID == "" {
+		return nil
+	}
+	for _, name := range leaf.DNSNames {
+		if name == expectedID {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer certificate is not issued for node %s", expectedID)
+}
+
+// verifyMember checks that a connecting peer holds the certificate of a member
+// of the configuration, so that no other holder of a certificate of the CA
+// can send raft RPCs.
+func (l *TLSStreamLayer) verifyMember(leaf *x509.Certificate) error {
+	servers, ok := l.servers()
+	if !ok {
+		return errors.New("raft configuration is not known yet")
+	}
+	if len(servers) <= 1 {
+		// Not joined to a cluster yet, the leader joining it is no member
+		return nil
+	}
+	for _, srv := range servers {
+		for _, name := range leaf.DNSNames {
+			if name == string(srv.ID) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("peer certificate for %v is issued for no member of the cluster", leaf.DNSNames)
+}
+
+type certReloader struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	logger   hclog.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+func (c *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %s", err.Error())
+	}
+
+	ca, err := os.ReadFile(c.caFile)
+	if err != nil {
+		return fmt.Errorf("error reading CA: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificates found in CA file %s", c.caFile)
+	}
+
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.pool = pool
+	c.modTime = modTime
+	return nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{c.caFile, c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// maybeReload reloads the files if any of them changed since the last load.
+// A failed reload, e.g. while a new key is written next to the old
+// certificate, keeps the previous certificates in use.
+func (c *certReloader) maybeReload() {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return
+	}
+
+	c.mu.RLock()
+	changed := modTime.After(c.modTime)
+	c.mu.RUnlock()
+
+	if changed {
+		if err := c.load(); err != nil {
+			c.logger.Error("error reloading raft TLS certificates", "error", err)
+		}
+	}
+}
+
+func (c *certReloader) certificate() (*tls.Certificate, error) {
+	c.maybeReload()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+func (c *certReloader) roots() (*x509.CertPool, error) {
+	c.maybeReload()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.pool, nil
+}
@@ -0,0 +1,276 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func writePEM(t *testing.T, file, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{t: t, dir: t.TempDir(), cert: cert, key: key}
+	ca.file = filepath.Join(ca.dir, "ca.crt")
+	writePEM(t, ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+// issue writes a certificate for the node ID name and returns the files of
+// the certificate and its key.
+func (ca *testCA) issue(name string) (string, string) {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(ca.dir, name+".crt"), filepath.Join(ca.dir, name+".key")
+	writePEM(ca.t, certFile, "CERTIFICATE", der)
+	writePEM(ca.t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+// testLayer is a stream layer that reports the outcome of the handshake of
+// every connection it accepts.
+type testLayer struct {
+	*TLSStreamLayer
+	handshakes chan error
+}
+
+func newTestLayer(t *testing.T, ca *testCA, name string, pin bool) *testLayer {
+	t.Helper()
+	return newTestLayerTrusting(t, ca, ca.file, name, pin)
+}
+
+// newTestLayerTrusting issues the certificate of the layer with ca, but
+// verifies peers with the CAs in caFile.
+func newTestLayerTrusting(t *testing.T, ca *testCA, caFile, name string, pin bool) *testLayer {
+	t.Helper()
+	certFile, keyFile := ca.issue(name)
+	l, err := NewTLSStreamLayer("127.0.0.1:0", nil, TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, PinPeers: pin, Logger: hclog.NewNullLogger()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	tl := &testLayer{TLSStreamLayer: l, handshakes: make(chan error, 16)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+				tl.handshakes <- conn.(*tls.Conn).Handshake()
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return tl
+}
+
+func (l *testLayer) address() raft.ServerAddress {
+	return raft.ServerAddress(l.Addr().String())
+}
+
+// connect dials to and returns the errors of both ends of the handshake.
+func connect(t *testing.T, from, to *testLayer, address raft.ServerAddress) (error, error) {
+	t.Helper()
+	conn, dialErr := from.Dial(address, time.Second)
+	if dialErr == nil {
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+		dialErr = conn.(*tls.Conn).Handshake()
+	}
+	if conn != nil && dialErr == nil {
+		// With TLS 1.3 the dialing end learns of a rejected certificate only
+		// when it reads
+		_, dialErr = conn.Read(make([]byte, 1))
+		if dialErr != nil && !strings.Contains(dialErr.Error(), "certificate") {
+			dialErr = nil
+		}
+	}
+	select {
+	case acceptErr := <-to.handshakes:
+		return dialErr, acceptErr
+	case <-time.After(2 * time.Second):
+		t.Fatal("no connection was accepted")
+		return nil, nil
+	}
+}
+
+func TestTLSStreamLayer(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	n1, n2 := newTestLayer(t, ca, "node1", false), newTestLayer(t, ca, "node2", false)
+
+	if dialErr, acceptErr := connect(t, n1, n2, n2.address()); dialErr != nil || acceptErr != nil {
+		t.Fatalf("expected the handshake to succeed, got %v and %v", dialErr, acceptErr)
+	}
+
+	// A certificate of another CA is rejected by both ends, the layer with it
+	// trusts both CAs to get past its own check
+	otherCA := newTestCA(t, "other")
+	both := filepath.Join(otherCA.dir, "both.crt")
+	writePEM(t, both, "CERTIFICATE", otherCA.cert.Raw)
+	data, err := os.ReadFile(ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(both, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write(data)
+	_ = f.Close()
+	other := newTestLayerTrusting(t, otherCA, both, "node3", false)
+	if _, acceptErr := connect(t, other, n1, n1.address()); acceptErr == nil {
+		t.Error("expected a certificate of another CA to be rejected when connecting")
+	}
+	if dialErr, _ := connect(t, n1, other, other.address()); dialErr == nil {
+		t.Error("expected a certificate of another CA to be rejected when dialing")
+	}
+}
+
+func TestTLSStreamLayerPinsPeers(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	n1, n2 := newTestLayer(t, ca, "node1", true), newTestLayer(t, ca, "node2", true)
+	intruder := newTestLayer(t, ca, "node9", true)
+
+	members := []raft.Server{{ID: "node1", Address: n1.address()}, {ID: "node2", Address: n2.address()}}
+	for _, l := range []*testLayer{n1, n2, intruder} {
+		l.SetPeers(func() []raft.Server { return members })
+	}
+
+	if dialErr, acceptErr := connect(t, n1, n2, n2.address()); dialErr != nil || acceptErr != nil {
+		t.Fatalf("expected members to connect, got %v and %v", dialErr, acceptErr)
+	}
+	if _, acceptErr := connect(t, intruder, n1, n1.address()); acceptErr == nil || !strings.Contains(acceptErr.Error(), "no member") {
+		t.Errorf("expected a certificate of no member to be rejected, got %v", acceptErr)
+	}
+	if _, err := n1.Dial(intruder.address(), time.Second); err == nil || !strings.Contains(err.Error(), "no node ID known") {
+		t.Errorf("expected dialing an address of no member to fail, got %v", err)
+	}
+
+	// The configuration says node2 is at the address node9 listens on
+	n1.SetPeers(func() []raft.Server {
+		return []raft.Server{{ID: "node1", Address: n1.address()}, {ID: "node2", Address: intruder.address()}}
+	})
+	if dialErr, _ := connect(t, n1, intruder, intruder.address()); dialErr == nil || !strings.Contains(dialErr.Error(), "not issued for node node2") {
+		t.Errorf("expected the certificate of another node to be rejected, got %v", dialErr)
+	}
+
+	// A node of its own can be joined by anyone with a certificate of the CA
+	single := newTestLayer(t, ca, "node5", true)
+	single.SetPeers(func() []raft.Server { return []raft.Server{{ID: "node5", Address: single.address()}} })
+	joining := newTestLayer(t, ca, "node6", false)
+	if _, acceptErr := connect(t, joining, single, single.address()); acceptErr != nil {
+		t.Errorf("expected a single node to accept any peer, got %v", acceptErr)
+	}
+}
+
+func TestTLSStreamLayerReloads(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	n1 := newTestLayer(t, ca, "node1", false)
+	before, err := n1.certs.certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotated files are picked up by their modification time
+	ca.issue("node1")
+	later := time.Now().Add(time.Minute)
+	for _, file := range []string{"node1.crt", "node1.key"} {
+		if err := os.Chtimes(filepath.Join(ca.dir, file), later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := n1.certs.certificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after.Certificate[0]) == string(before.Certificate[0]) {
+		t.Fatal("expected the rotated certificate to be loaded")
+	}
+
+	// A broken key keeps the previous certificate in use
+	keyFile := filepath.Join(ca.dir, "node1.key")
+	if err := os.WriteFile(keyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(keyFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	current, err := n1.certs.certificate()
+	if err != nil || current != after {
+		t.Fatalf("expected the previous certificate after a failed reload, got %v", err)
+	}
+	if err := n1.Reload(); err == nil {
+		t.Fatal("expected reloading a broken key to fail")
+	}
+}
@@ -0,0 +1,149 @@
+package transport
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// PeerProgress is what the local node last learned about a peer from the
+// responses to the AppendEntries RPCs it sent while being the leader.
+type PeerProgress struct {
+	MatchIndex  uint64
+	LastContact time.Time
+}
+
+// Tracker wraps a raft.Transport and records the replication progress of
+// every peer, which hashicorp/raft otherwise keeps private to the leader.
+type Tracker struct {
+	raft.Transport
+
+	mu    sync.RWMutex
+	peers map[raft.ServerID]PeerProgress
+}
+
+func NewTracker(trans raft.Transport) *Tracker {
+	return &Tracker{
+		Transport: trans,
+		peers:     make(map[raft.ServerID]PeerProgress),
+	}
+}
+
+// Progress returns the last known progress of the given peer.
+func (t *Tracker) Progress(id raft.ServerID) (PeerProgress, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	p, ok := t.peers[id]
+	return p, ok
+}
+
+// Forget drops the progress of a peer, e.g. after it was removed.
+func (t *Tracker) Forget(id raft.ServerID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.peers, id)
+}
+
+func (t *Tracker) observe(id raft.ServerID, resp *raft.AppendEntriesResponse) {
+	if resp == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.peers[id]
+	if resp.Success {
+		p.MatchIndex = resp.LastLog
+	}
+	p.LastContact = time.Now()
+	t.peers[id] = p
+}
+
+func (t *Tracker) AppendEntries(id raft.ServerID, target raft.ServerAddress, args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) error {
+	if err := t.Transport.AppendEntries(id, target, args, resp); err != nil {
+		return err
+	}
+	t.observe(id, resp)
+	return nil
+}
+
+func (t *Tracker) AppendEntriesPipeline(id raft.ServerID, target raft.ServerAddress) (raft.AppendPipeline, error) {
+	p, err := t.Transport.AppendEntriesPipeline(id, target)
+	if err != nil {
+		return nil, err
+	}
+	return newTrackedPipeline(p, func(resp *raft.AppendEntriesResponse) {
+		t.observe(id, resp)
+	}), nil
+}
+
+func (t *Tracker) InstallSnapshot(id raft.ServerID, target raft.ServerAddress, args *raft.InstallSnapshotRequest, resp *raft.InstallSnapshotResponse, data io.Reader) error {
+	if err := t.Transport.InstallSnapshot(id, target, args, resp, data); err != nil {
+		return err
+	}
+	if resp.Success {
+		t.mu.Lock()
+		t.peers[id] = PeerProgress{MatchIndex: args.LastLogIndex, LastContact: time.Now()}
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+func (t *Tracker) Close() error {
+	if c, ok := t.Transport.(raft.WithClose); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type trackedPipeline struct {
+	raft.AppendPipeline
+	observe func(*raft.AppendEntriesResponse)
+
+	consumerCh chan raft.AppendFuture
+	shutdownCh chan struct{}
+	closeOnce  sync.Once
+}
+
+func newTrackedPipeline(p raft.AppendPipeline, observe func(*raft.AppendEntriesResponse)) *trackedPipeline {
+	tp := &trackedPipeline{
+		AppendPipeline: p,
+		observe:        observe,
+		consumerCh:     make(chan raft.AppendFuture),
+		shutdownCh:     make(chan struct{}),
+	}
+	go tp.forward()
+	return tp
+}
+
+func (tp *trackedPipeline) forward() {
+	for {
+		select {
+		case future, ok := <-tp.AppendPipeline.Consumer():
+			if !ok {
+				return
+			}
+			if future.Error() == nil {
+				tp.observe(future.Response())
+			}
+			select {
+			case tp.consumerCh <- future:
+			case <-tp.shutdownCh:
+				return
+			}
+		case <-tp.shutdownCh:
+			return
+		}
+	}
+}
+
+func (tp *trackedPipeline) Consumer() <-chan raft.AppendFuture {
+	return tp.consumerCh
+}
+
+func (tp *trackedPipeline) Close() error {
+	tp.closeOnce.Do(func() { close(tp.shutdownCh) })
+	return tp.AppendPipeline.Close()
+}